@@ -0,0 +1,979 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Skyenought/trimpb"
+	"github.com/Skyenought/trimpb/grpcreflection"
+	"github.com/jhump/protoreflect/desc"
+	"github.com/pmezard/go-difflib/difflib"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/proto"
+	"gopkg.in/yaml.v3"
+)
+
+// stringSlice collects the values of a repeatable flag.
+type stringSlice []string
+
+func (s *stringSlice) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringSlice) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// commentScopes maps the values of -comments to their scope.
+var commentScopes = map[string]trimpb.CommentScope{
+	"all":   trimpb.CommentScopeAll,
+	"entry": trimpb.CommentScopeEntryOnly,
+	"none":  trimpb.CommentScopeNone,
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+func run(args []string, stdout, stderr io.Writer) int {
+	if len(args) > 0 && args[0] == "services" {
+		return runServices(args[1:], stdout, stderr)
+	}
+	if len(args) > 0 && args[0] == "message" {
+		return runMessage(args[1:], stdout, stderr)
+	}
+
+	flags := flag.NewFlagSet("trimpb", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: trimpb [flags] <entry.proto>...")
+		fmt.Fprintln(stderr, "       trimpb services [-r root]... <entry.proto>...")
+		fmt.Fprintln(stderr, "       trimpb message [-r root]... [-no-merge] <pkg.Message> <entry.proto>...")
+		flags.PrintDefaults()
+	}
+
+	var sourceRoots, methodNames, methodRegexes, excludeTypes, excludeFiles, anyTypes, keepPackages, packageRenames stringSlice
+	flags.Var(&sourceRoots, "r", "source root used as import path (repeatable, default \".\")")
+	flags.Var(&methodNames, "m", "method to keep: Method, Service.Method, package.Service.Method or /regex/ (repeatable)")
+	substr := flags.Bool("substr", false, "match a bare -m method name as a substring instead of exactly")
+	strict := flags.Bool("strict", false, "accept only Service.Method and fully-qualified -m names, failing on bare names, globs and regexes")
+	flags.Var(&methodRegexes, "mregex", "regular expression matched against method names (repeatable)")
+	outputDir := flags.String("o", "trimmed", "output directory")
+	descOut := flags.String("desc", "", "write the trimmed schema as a binary FileDescriptorSet to this file instead of .proto files")
+	includeSourceInfo := flags.Bool("include-source-info", false, "keep source code info (comments) in the -desc output")
+	singleOut := flags.String("single", "", "merge every trimmed file into this single .proto file; all kept files must share a package")
+	zipOut := flags.String("zip", "", "write the trimmed .proto files into this zip archive instead of the output directory")
+	flatten := flags.Bool("flatten", false, "write every trimmed file directly into the output directory, dropping its subdirectories (imports are not rewritten)")
+	maxDepth := flags.Int("max-depth", -1, "follow at most this many fields from the selected methods, removing fields whose types lie beyond (0 keeps only the request and response, -1 keeps everything)")
+	flags.Var(&keepPackages, "keep-all-in-package", "package whose every definition is kept, while other packages are trimmed as usual (repeatable)")
+	flags.Var(&packageRenames, "rename-package", "old.pkg=new.pkg: move the trimmed files of a package to a new one, updating type references and go_package (repeatable)")
+	flags.Var(&excludeTypes, "exclude", "fully-qualified message or enum never to keep (repeatable)")
+	flags.Var(&excludeFiles, "exclude-file", "import name of a file to leave out of the output while keeping its imports (repeatable)")
+	stripExcludedFields := flags.Bool("strip-excluded-fields", false, "remove fields whose type is excluded instead of failing")
+	flags.Var(&anyTypes, "any-type", "pkg.Message.field=pkg.Concrete: keep a message held by a google.protobuf.Any field whenever the field is kept (repeatable)")
+	requireMethods := flags.Bool("require-methods", false, "fail instead of warning when no method is selected, because -m matched nothing or the entry files declare no services")
+	normalize := flags.Bool("normalize", false, "write LF line endings and strip trailing whitespace in every output file")
+	sortElements := flags.Bool("sort", false, "print messages, then enums, then services, each sorted by name, instead of keeping declaration order")
+	comments := flags.String("comments", "all", "comments to keep: all, entry (only those of the selected methods and their request and response messages) or none")
+	noSourceInfo := flags.Bool("no-source-info", false, "parse without source code info: faster, smaller output without any comments")
+	verify := flags.Bool("verify", false, "parse the trimmed files again and fail if they do not compile")
+	keepUnusedImports := flags.Bool("keep-unused-imports", false, "keep the original imports of every emitted file even when they are no longer used")
+	showRemoved := flags.Bool("show-removed", false, "after trimming, list the removed messages, enums and methods per file on stderr")
+	diff := flags.Bool("diff", false, "print a unified diff of every source file against its trimmed version, removed files as fully deleted, without writing any files")
+	dryRun := flags.Bool("dry-run", false, "report what would be kept and removed without writing any files")
+	reflectAddr := flags.String("reflect", "", "fetch the schema from the gRPC server at this address through server reflection instead of -r; entry files are optional and default to every file declaring a service")
+	var quiet bool
+	flags.BoolVar(&quiet, "quiet", false, "print nothing but errors")
+	flags.BoolVar(&quiet, "q", false, "shorthand for -quiet")
+	configPath := flags.String("config", "", "YAML or JSON manifest listing entry_files, methods, import_paths and output_dir; flags override it")
+	if err := flags.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return 2
+	}
+
+	entryFiles := flags.Args()
+	var trims []trimSpec
+	if *configPath != "" {
+		m, err := loadManifest(*configPath)
+		if err != nil {
+			fmt.Fprintf(stderr, "Error: %v\n", err)
+			return 1
+		}
+		setFlags := make(map[string]bool)
+		flags.Visit(func(f *flag.Flag) { setFlags[f.Name] = true })
+		if len(entryFiles) == 0 {
+			entryFiles = m.EntryFiles
+		}
+		if len(sourceRoots) == 0 {
+			sourceRoots = m.ImportPaths
+		}
+		if len(methodNames) == 0 && len(methodRegexes) == 0 {
+			methodNames = m.Methods
+		}
+		if !setFlags["o"] && m.OutputDir != "" {
+			*outputDir = m.OutputDir
+		}
+		trims = m.Trims
+		if len(trims) > 0 {
+			for _, name := range []string{"o", "m", "mregex", "reflect", "desc", "single", "zip", "flatten", "diff", "dry-run", "show-removed"} {
+				if setFlags[name] {
+					fmt.Fprintf(stderr, "Error: -%s cannot be used with the trims of -config\n", name)
+					return 2
+				}
+			}
+			if len(entryFiles) > 0 {
+				fmt.Fprintln(stderr, "Error: entry files cannot be given with the trims of -config")
+				return 2
+			}
+		}
+	}
+	if len(entryFiles) == 0 && *reflectAddr == "" && len(trims) == 0 {
+		flags.Usage()
+		return 2
+	}
+	if *maxDepth < -1 {
+		fmt.Fprintf(stderr, "Error: -max-depth must be -1 (no limit) or more, got %d\n", *maxDepth)
+		return 2
+	}
+	commentScope, ok := commentScopes[*comments]
+	if !ok {
+		fmt.Fprintf(stderr, "Error: -comments must be all, entry or none, got %q\n", *comments)
+		return 2
+	}
+	inferRoots := len(sourceRoots) == 0 && *reflectAddr == "" && len(trims) == 0
+	if len(sourceRoots) == 0 {
+		sourceRoots = stringSlice{"."}
+	}
+	for _, pattern := range methodRegexes {
+		methodNames = append(methodNames, "/"+pattern+"/")
+	}
+	anyTypeMap := make(map[string][]string)
+	for _, anyType := range anyTypes {
+		field, concrete, ok := strings.Cut(anyType, "=")
+		if !ok || field == "" || concrete == "" {
+			fmt.Fprintf(stderr, "Error: -any-type must be field=message, got %q\n", anyType)
+			return 2
+		}
+		anyTypeMap[field] = append(anyTypeMap[field], concrete)
+	}
+	renames := make(map[string]string)
+	for _, rename := range packageRenames {
+		oldPkg, newPkg, ok := strings.Cut(rename, "=")
+		if !ok || oldPkg == "" || newPkg == "" {
+			fmt.Fprintf(stderr, "Error: -rename-package must be old=new, got %q\n", rename)
+			return 2
+		}
+		renames[oldPkg] = newPkg
+	}
+
+	logger := log.New(stdout, "", 0)
+	if quiet {
+		logger.SetOutput(io.Discard)
+	} else if *diff {
+		logger.SetOutput(stderr) // Keep stdout a valid patch
+	}
+	if inferRoots {
+		sourceRoots = inferSourceRoots(entryFiles)
+		if len(sourceRoots) > 1 || sourceRoots[0] != "." {
+			logger.Printf("Info: no -r given, using inferred import roots: %s", sourceRoots.String())
+		}
+	}
+	opts := trimpb.Options{
+		MethodNames:         methodNames,
+		SubstringMatch:      *substr,
+		StrictMethodNames:   *strict,
+		KeepPackages:        keepPackages,
+		ExcludeTypes:        excludeTypes,
+		ExcludeFiles:        excludeFiles,
+		StripExcludedFields: *stripExcludedFields,
+		AnyTypes:            anyTypeMap,
+		PackageRenames:      renames,
+		RequireMethods:      *requireMethods,
+		NormalizeOutput:     *normalize,
+		CommentScope:        commentScope,
+		SortElements:        *sortElements,
+		OmitSourceInfo:      *noSourceInfo,
+		KeepUnusedImports:   *keepUnusedImports,
+		Verify:              *verify,
+		Logger:              logger,
+	}
+	if *maxDepth >= 0 {
+		opts.MaxDepth = maxDepth
+	}
+	if len(trims) > 0 {
+		if err := runBatch(opts, trims, sourceRoots); err != nil {
+			fmt.Fprintf(stderr, "Error: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+	if *reflectAddr != "" {
+		files, err := loadReflection(*reflectAddr)
+		if err != nil {
+			fmt.Fprintf(stderr, "Error: %v\n", err)
+			return 1
+		}
+		logger.Printf("Fetched %d proto files from %s", len(files), *reflectAddr)
+		opts.Files = files
+		opts.EntryFiles = entryFiles
+		if len(entryFiles) == 0 {
+			for _, fd := range files {
+				opts.EntryFiles = append(opts.EntryFiles, fd.GetName())
+			}
+		}
+	} else {
+		protoContents, fileRoots, err := trimpb.LoadProtosWithRoots(sourceRoots)
+		if err != nil {
+			fmt.Fprintf(stderr, "Error: %v\n", err)
+			return 1
+		}
+		if len(protoContents) == 0 {
+			fmt.Fprintf(stderr, "Error: no .proto files found under %s\n", sourceRoots.String())
+			return 1
+		}
+		logger.Printf("Found and loaded %d proto files", len(protoContents))
+
+		opts.EntryFiles, err = canonicalizeEntryFiles(entryFiles, sourceRoots)
+		if err != nil {
+			fmt.Fprintf(stderr, "Error: %v\n", err)
+			return 1
+		}
+		opts.ImportPaths = sourceRoots
+		opts.ProtoContents = protoContents
+		opts.FileRoots = fileRoots
+	}
+	if len(methodNames) == 0 {
+		logger.Println("Info: no methods given, keeping every method and removing unused definitions")
+	}
+
+	if *diff {
+		if *reflectAddr != "" {
+			fmt.Fprintln(stderr, "Error: -diff needs local sources and cannot be used with -reflect")
+			return 2
+		}
+		if err := printDiff(stdout, opts, sourceRoots); err != nil {
+			fmt.Fprintf(stderr, "Error: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+
+	if *dryRun {
+		report, err := trimpb.Analyze(opts)
+		if err != nil {
+			fmt.Fprintf(stderr, "Error: %v\n", err)
+			return 1
+		}
+		printReport(stdout, report)
+		return 0
+	}
+
+	if *descOut != "" {
+		if err := writeDescriptorSet(*descOut, opts, *includeSourceInfo); err != nil {
+			fmt.Fprintf(stderr, "Error: %v\n", err)
+			return 1
+		}
+		logger.Printf("Writing trimmed descriptor set to: %s", *descOut)
+		return 0
+	}
+
+	if *singleOut != "" {
+		if err := writeSingleFile(*singleOut, opts); err != nil {
+			fmt.Fprintf(stderr, "Error: %v\n", err)
+			return 1
+		}
+		logger.Printf("Writing merged file to: %s", *singleOut)
+		return 0
+	}
+
+	if *showRemoved && opts.Files == nil {
+		// Parse once for both the trim and the report of removed symbols
+		files, err := trimpb.Parse(opts)
+		if err != nil {
+			fmt.Fprintf(stderr, "Error: %v\n", err)
+			return 1
+		}
+		opts.Files = files
+	}
+
+	if *zipOut == "" && !*flatten {
+		if err := trimpb.TrimToDir(opts, *outputDir); err != nil {
+			fmt.Fprintf(stderr, "Error: %v\n", err)
+			return 1
+		}
+		if *showRemoved {
+			if err := showRemovedSymbols(stderr, opts); err != nil {
+				fmt.Fprintf(stderr, "Error: %v\n", err)
+				return 1
+			}
+		}
+		return 0
+	}
+
+	result, err := trimpb.TrimWithOptions(opts)
+	if err != nil {
+		fmt.Fprintf(stderr, "Error: %v\n", err)
+		return 1
+	}
+	if *showRemoved {
+		if err := showRemovedSymbols(stderr, opts); err != nil {
+			fmt.Fprintf(stderr, "Error: %v\n", err)
+			return 1
+		}
+	}
+
+	outputs, err := outputFiles(result, sourceRoots, *flatten)
+	if err != nil {
+		fmt.Fprintf(stderr, "Error: %v\n", err)
+		return 1
+	}
+
+	if *zipOut != "" {
+		if err := writeZip(*zipOut, outputs); err != nil {
+			fmt.Fprintf(stderr, "Error: %v\n", err)
+			return 1
+		}
+		logger.Printf("Writing trimmed archive to: %s", *zipOut)
+		return 0
+	}
+
+	// Write in name order so the log and any partial output are reproducible
+	names := make([]string, 0, len(outputs))
+	for name := range outputs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		outPath := filepath.Join(*outputDir, filepath.FromSlash(name))
+		logger.Printf("Writing trimmed file to: %s", outPath)
+		if err := os.MkdirAll(filepath.Dir(outPath), 0o755); err != nil {
+			fmt.Fprintf(stderr, "Error: %v\n", err)
+			return 1
+		}
+		if err := os.WriteFile(outPath, []byte(outputs[name]), 0o644); err != nil {
+			fmt.Fprintf(stderr, "Error: %v\n", err)
+			return 1
+		}
+	}
+	return 0
+}
+
+// printDiff prints a unified diff between every source file of the trim
+// described by opts and its trimmed version, in name order. Files the trim
+// removes are diffed against /dev/null and unchanged files are skipped.
+func printDiff(w io.Writer, opts trimpb.Options, sourceRoots []string) error {
+	fds, err := trimpb.Parse(opts)
+	if err != nil {
+		return err
+	}
+	opts.Files = fds // Trim the files just parsed instead of parsing them again
+	result, err := trimpb.TrimWithOptions(opts)
+	if err != nil {
+		return err
+	}
+	outputs, err := outputFiles(result, sourceRoots, false)
+	if err != nil {
+		return err
+	}
+
+	for _, fd := range fds {
+		name := fd.GetName()
+		original, ok := opts.ProtoContents[filepath.Join(opts.FileRoots[name], filepath.FromSlash(name))]
+		if !ok {
+			continue // Supplied by the parser, such as well-known files
+		}
+		ud := difflib.UnifiedDiff{
+			A:        difflib.SplitLines(original),
+			FromFile: "a/" + name,
+			ToFile:   "/dev/null",
+			Context:  3,
+		}
+		if trimmed, ok := outputs[name]; ok {
+			ud.B = difflib.SplitLines(trimmed)
+			ud.ToFile = "b/" + name
+		}
+		text, err := difflib.GetUnifiedDiffString(ud)
+		if err != nil {
+			return err
+		}
+		fmt.Fprint(w, text)
+	}
+	return nil
+}
+
+// showRemovedSymbols analyzes the trim described by opts and prints what it
+// removes.
+func showRemovedSymbols(w io.Writer, opts trimpb.Options) error {
+	report, err := trimpb.Analyze(opts)
+	if err != nil {
+		return err
+	}
+	printRemoved(w, report)
+	return nil
+}
+
+// printRemoved writes the fully-qualified names of the removed definitions,
+// grouped by file. Files losing nothing are skipped.
+func printRemoved(w io.Writer, report *trimpb.TrimReport) {
+	for _, file := range report.Files {
+		var removed []string
+		for _, names := range [][]string{file.RemovedMessages, file.RemovedEnums, file.RemovedMethods} {
+			removed = append(removed, names...)
+		}
+		if len(removed) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "Removed from %s:\n", file.Path)
+		for _, name := range removed {
+			fmt.Fprintf(w, "  - %s\n", name)
+		}
+	}
+}
+
+// runServices implements `trimpb services`: it prints the fully-qualified name
+// and method count of every service declared in the entry files, one per line
+// separated by a tab, sorted by name.
+func runServices(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("trimpb services", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: trimpb services [-r root]... <entry.proto>...")
+		flags.PrintDefaults()
+	}
+	var sourceRoots stringSlice
+	flags.Var(&sourceRoots, "r", "source root used as import path (repeatable, default \".\")")
+	if err := flags.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return 2
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+	if len(sourceRoots) == 0 {
+		sourceRoots = stringSlice{"."}
+	}
+
+	protoContents, fileRoots, err := trimpb.LoadProtosWithRoots(sourceRoots)
+	if err != nil {
+		fmt.Fprintf(stderr, "Error: %v\n", err)
+		return 1
+	}
+	entryFiles, err := canonicalizeEntryFiles(flags.Args(), sourceRoots)
+	if err != nil {
+		fmt.Fprintf(stderr, "Error: %v\n", err)
+		return 1
+	}
+	fds, err := trimpb.Parse(trimpb.Options{
+		EntryFiles:    entryFiles,
+		ImportPaths:   sourceRoots,
+		ProtoContents: protoContents,
+		FileRoots:     fileRoots,
+	})
+	if err != nil {
+		fmt.Fprintf(stderr, "Error: %v\n", err)
+		return 1
+	}
+
+	entries := make(map[string]struct{}, len(entryFiles))
+	for _, name := range entryFiles {
+		entries[name] = struct{}{}
+	}
+	methodCounts := make(map[string]int)
+	for _, fd := range fds {
+		if _, ok := entries[fd.GetName()]; !ok {
+			continue
+		}
+		for _, service := range fd.GetServices() {
+			methodCounts[service.GetFullyQualifiedName()] = len(service.GetMethods())
+		}
+	}
+	services := make([]string, 0, len(methodCounts))
+	for service := range methodCounts {
+		services = append(services, service)
+	}
+	sort.Strings(services)
+	for _, service := range services {
+		fmt.Fprintf(stdout, "%s\t%d\n", service, methodCounts[service])
+	}
+	return 0
+}
+
+// runMessage implements `trimpb message`: it prints to stdout the definitions
+// needed by a single message, looked up among the entry files and their
+// imports, merged into one file. With -no-merge the trimmed files are printed
+// one after another instead, each after a comment naming it, so that the
+// closure may span packages.
+func runMessage(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("trimpb message", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: trimpb message [-r root]... [-no-merge] <pkg.Message> <entry.proto>...")
+		flags.PrintDefaults()
+	}
+	var sourceRoots stringSlice
+	flags.Var(&sourceRoots, "r", "source root used as import path (repeatable, default \".\")")
+	noMerge := flags.Bool("no-merge", false, "print every trimmed file separately instead of merging them, allowing several packages")
+	if err := flags.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return 2
+	}
+	if flags.NArg() < 2 {
+		flags.Usage()
+		return 2
+	}
+	if len(sourceRoots) == 0 {
+		sourceRoots = stringSlice{"."}
+	}
+
+	protoContents, fileRoots, err := trimpb.LoadProtosWithRoots(sourceRoots)
+	if err != nil {
+		fmt.Fprintf(stderr, "Error: %v\n", err)
+		return 1
+	}
+	entryFiles, err := canonicalizeEntryFiles(flags.Args()[1:], sourceRoots)
+	if err != nil {
+		fmt.Fprintf(stderr, "Error: %v\n", err)
+		return 1
+	}
+	opts := trimpb.Options{
+		EntryFiles:    entryFiles,
+		KeepMessages:  []string{flags.Arg(0)},
+		ImportPaths:   sourceRoots,
+		ProtoContents: protoContents,
+		FileRoots:     fileRoots,
+	}
+
+	if !*noMerge {
+		content, err := trimpb.TrimToSingleFile(opts, entryFiles[0])
+		if err != nil {
+			fmt.Fprintf(stderr, "Error: %v\n", err)
+			return 1
+		}
+		fmt.Fprint(stdout, content)
+		return 0
+	}
+
+	result, err := trimpb.TrimWithOptions(opts)
+	if err != nil {
+		fmt.Fprintf(stderr, "Error: %v\n", err)
+		return 1
+	}
+	outputs, err := outputFiles(result, sourceRoots, false)
+	if err != nil {
+		fmt.Fprintf(stderr, "Error: %v\n", err)
+		return 1
+	}
+	names := make([]string, 0, len(outputs))
+	for name := range outputs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for i, name := range names {
+		if i > 0 {
+			fmt.Fprintln(stdout)
+		}
+		fmt.Fprintf(stdout, "// %s\n%s", name, outputs[name])
+	}
+	return 0
+}
+
+// reflectTimeout bounds fetching a schema through server reflection.
+const reflectTimeout = 30 * time.Second
+
+// loadReflection fetches the files declaring every service of the server at
+// addr, which must serve gRPC reflection over plaintext.
+func loadReflection(addr string) ([]*desc.FileDescriptor, error) {
+	conn, err := grpc.Dial(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", addr, err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), reflectTimeout)
+	defer cancel()
+	return grpcreflection.Load(ctx, conn, nil)
+}
+
+// runBatch loads and parses the sources once, then runs every trim of a batch
+// manifest against the shared descriptors, writing each to its output_dir.
+func runBatch(opts trimpb.Options, trims []trimSpec, sourceRoots []string) error {
+	protoContents, fileRoots, err := trimpb.LoadProtosWithRoots(sourceRoots)
+	if err != nil {
+		return err
+	}
+	if len(protoContents) == 0 {
+		return fmt.Errorf("no .proto files found under %s", strings.Join(sourceRoots, ","))
+	}
+	opts.Logger.Printf("Found and loaded %d proto files", len(protoContents))
+	opts.ImportPaths = sourceRoots
+	opts.ProtoContents = protoContents
+	opts.FileRoots = fileRoots
+
+	// Parse the entry files of every trim together, so each file is parsed once
+	entries := make([][]string, len(trims))
+	seen := make(map[string]bool)
+	for i, spec := range trims {
+		entries[i], err = canonicalizeEntryFiles(spec.EntryFiles, sourceRoots)
+		if err != nil {
+			return err
+		}
+		for _, name := range entries[i] {
+			if !seen[name] {
+				seen[name] = true
+				opts.EntryFiles = append(opts.EntryFiles, name)
+			}
+		}
+	}
+	opts.Files, err = trimpb.Parse(opts)
+	if err != nil {
+		return err
+	}
+
+	for i, spec := range trims {
+		opts.EntryFiles = entries[i]
+		opts.MethodNames = spec.Methods
+		opts.Logger.Printf("Trim %d of %d: %s", i+1, len(trims), strings.Join(entries[i], ", "))
+		if err := trimpb.TrimToDir(opts, spec.OutputDir); err != nil {
+			return fmt.Errorf("trim %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+// manifest is the selection read from a -config file. Relative paths in it
+// are resolved against the directory of the file.
+type manifest struct {
+	EntryFiles  []string   `yaml:"entry_files"`
+	Methods     []string   `yaml:"methods"`
+	ImportPaths []string   `yaml:"import_paths"`
+	OutputDir   string     `yaml:"output_dir"`
+	Trims       []trimSpec `yaml:"trims"`
+}
+
+// trimSpec is one trim of a batch manifest, sharing its import_paths.
+type trimSpec struct {
+	EntryFiles []string `yaml:"entry_files"`
+	Methods    []string `yaml:"methods"`
+	OutputDir  string   `yaml:"output_dir"`
+}
+
+// loadManifest reads a YAML manifest from path. JSON is accepted as well,
+// being a subset of YAML.
+func loadManifest(path string) (*manifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config %s: %w", path, err)
+	}
+	m := &manifest{}
+	if err := yaml.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("failed to parse config %s: %w", path, err)
+	}
+
+	dir := filepath.Dir(path)
+	resolve := func(p string) string {
+		if filepath.IsAbs(p) {
+			return p
+		}
+		return filepath.Join(dir, p)
+	}
+	for i := range m.EntryFiles {
+		m.EntryFiles[i] = resolve(m.EntryFiles[i])
+	}
+	for i := range m.ImportPaths {
+		m.ImportPaths[i] = resolve(m.ImportPaths[i])
+	}
+	if m.OutputDir != "" {
+		m.OutputDir = resolve(m.OutputDir)
+	}
+	for i := range m.Trims {
+		spec := &m.Trims[i]
+		if len(spec.EntryFiles) == 0 || spec.OutputDir == "" {
+			return nil, fmt.Errorf("trim %d of config %s needs entry_files and output_dir", i+1, path)
+		}
+		for j := range spec.EntryFiles {
+			spec.EntryFiles[j] = resolve(spec.EntryFiles[j])
+		}
+		spec.OutputDir = resolve(spec.OutputDir)
+	}
+	return m, nil
+}
+
+// printReport writes a dry-run summary: the matched methods, then per file
+// the kept counts and every removed definition.
+func printReport(w io.Writer, report *trimpb.TrimReport) {
+	fmt.Fprintf(w, "Matched %d methods:\n", len(report.MatchedMethods))
+	for _, method := range report.MatchedMethods {
+		fmt.Fprintf(w, "  %s\n", method)
+	}
+	for _, file := range report.Files {
+		if file.Dropped {
+			fmt.Fprintf(w, "%s: dropped\n", file.Path)
+			continue
+		}
+		fmt.Fprintf(w, "%s: keeping %d messages, %d enums, %d methods\n",
+			file.Path, len(file.KeptMessages), len(file.KeptEnums), len(file.KeptMethods))
+		for _, names := range [][]string{file.RemovedMessages, file.RemovedEnums, file.RemovedMethods} {
+			for _, name := range names {
+				fmt.Fprintf(w, "  - %s\n", name)
+			}
+		}
+	}
+}
+
+// writeDescriptorSet trims the schema and marshals it as a binary
+// FileDescriptorSet, dependencies first, to path.
+func writeDescriptorSet(path string, opts trimpb.Options, includeSourceInfo bool) error {
+	fileSet, err := trimpb.TrimToDescriptorSet(opts)
+	if err != nil {
+		return err
+	}
+	if !includeSourceInfo {
+		for _, fd := range fileSet.GetFile() {
+			fd.SourceCodeInfo = nil
+		}
+	}
+
+	data, err := proto.Marshal(fileSet)
+	if err != nil {
+		return fmt.Errorf("failed to marshal descriptor set: %w", err)
+	}
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return err
+		}
+	}
+	return os.WriteFile(path, data, 0o644)
+}
+
+// writeSingleFile trims the schema and writes every kept definition into one
+// file at path, named after its base name.
+func writeSingleFile(path string, opts trimpb.Options) error {
+	content, err := trimpb.TrimToSingleFile(opts, filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return err
+		}
+	}
+	return os.WriteFile(path, []byte(content), 0o644)
+}
+
+// zipModTime is the timestamp of every archive entry, so that the same input
+// always produces a byte-identical archive.
+var zipModTime = time.Date(1980, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// outputFiles names every trimmed file by its slash-separated path relative to
+// its source root, or by its base name alone when flatten is set. It fails if
+// two files would share a name, rather than letting one overwrite the other.
+func outputFiles(result map[string]string, sourceRoots []string, flatten bool) (map[string]string, error) {
+	filePaths := make([]string, 0, len(result))
+	for filePath := range result {
+		filePaths = append(filePaths, filePath)
+	}
+	sort.Strings(filePaths)
+
+	outputs := make(map[string]string, len(result))
+	sources := make(map[string]string, len(result))
+	for _, filePath := range filePaths {
+		name := filepath.ToSlash(relativeToRoots(filePath, sourceRoots))
+		if flatten {
+			name = path.Base(name)
+		}
+		if other, ok := sources[name]; ok {
+			if flatten {
+				return nil, fmt.Errorf("cannot flatten output: %s and %s both map to %s", other, filePath, name)
+			}
+			return nil, fmt.Errorf("cannot write output: %s and %s both map to %s", other, filePath, name)
+		}
+		sources[name] = filePath
+		outputs[name] = result[filePath]
+	}
+	return outputs, nil
+}
+
+// writeZip packages the output files into a zip archive at path, written in
+// sorted order.
+func writeZip(path string, entries map[string]string) error {
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return err
+		}
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	zw := zip.NewWriter(f)
+	for _, name := range names {
+		w, err := zw.CreateHeader(&zip.FileHeader{
+			Name:     name,
+			Method:   zip.Deflate,
+			Modified: zipModTime,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to add %s to archive: %w", name, err)
+		}
+		if _, err := io.WriteString(w, entries[name]); err != nil {
+			return fmt.Errorf("failed to add %s to archive: %w", name, err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("failed to write archive %s: %w", path, err)
+	}
+	return f.Close()
+}
+
+// inferSourceRoots guesses the import roots of entry files given without -r.
+// The working directory is kept when the imports of every entry file resolve
+// under it; otherwise each entry file contributes the deepest of its ancestor
+// directories under which all its imports exist. Well-known imports are
+// supplied by the parser and ignored. An entry file for which no directory
+// fits falls back to the working directory, leaving the parser to report the
+// missing import.
+func inferSourceRoots(entryFiles []string) stringSlice {
+	imports := make([][]string, len(entryFiles))
+	resolved := true
+	for i, entry := range entryFiles {
+		imports[i] = entryImports(entry)
+		resolved = resolved && importsExist(".", imports[i])
+	}
+	if resolved {
+		return stringSlice{"."}
+	}
+
+	var roots stringSlice
+	seen := make(map[string]bool)
+	for i, entry := range entryFiles {
+		root := "."
+		for dir := filepath.Dir(filepath.Clean(entry)); ; dir = filepath.Dir(dir) {
+			if importsExist(dir, imports[i]) {
+				root = dir
+				break
+			}
+			if dir == filepath.Dir(dir) {
+				break
+			}
+		}
+		if !seen[root] {
+			seen[root] = true
+			roots = append(roots, root)
+		}
+	}
+	return roots
+}
+
+// entryImports returns the names imported by the file at path, or nil when it
+// cannot be read.
+func entryImports(path string) []string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	var names []string
+	for _, name := range trimpb.Imports(string(data)) {
+		if !strings.HasPrefix(name, "google/protobuf/") {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// importsExist reports whether every name exists as a file under root.
+func importsExist(root string, names []string) bool {
+	for _, name := range names {
+		if info, err := os.Stat(filepath.Join(root, filepath.FromSlash(name))); err != nil || info.IsDir() {
+			return false
+		}
+	}
+	return true
+}
+
+// canonicalizeEntryFiles turns entry file paths given on the command line into
+// import-path-relative names, as expected by the parser. An entry may be a
+// path under one of the roots, absolute or relative to the working directory,
+// or a name already relative to a root.
+func canonicalizeEntryFiles(entryFiles []string, sourceRoots []string) ([]string, error) {
+	canonical := make([]string, 0, len(entryFiles))
+	for _, entry := range entryFiles {
+		if rel, ok := relativeToRoot(filepath.Clean(entry), sourceRoots); ok {
+			canonical = append(canonical, filepath.ToSlash(rel))
+			continue
+		}
+		if !filepath.IsAbs(entry) && existsUnderRoot(filepath.Clean(entry), sourceRoots) {
+			canonical = append(canonical, filepath.ToSlash(filepath.Clean(entry)))
+			continue
+		}
+		return nil, fmt.Errorf("entry file %s is not under any source root (%s)", entry, strings.Join(sourceRoots, ", "))
+	}
+	return canonical, nil
+}
+
+// existsUnderRoot reports whether name, read as relative to a root, names a
+// file in one of the roots.
+func existsUnderRoot(name string, sourceRoots []string) bool {
+	for _, root := range sourceRoots {
+		if info, err := os.Stat(filepath.Join(root, name)); err == nil && !info.IsDir() {
+			return true
+		}
+	}
+	return false
+}
+
+// relativeToRoots strips the first source root that contains path, returning
+// path unchanged when none does.
+func relativeToRoots(path string, sourceRoots []string) string {
+	if rel, ok := relativeToRoot(path, sourceRoots); ok {
+		return rel
+	}
+	return path
+}
+
+// relativeToRoot returns path relative to the first source root containing
+// it. Both are compared in absolute form, so that absolute and relative
+// spellings of the same location match.
+func relativeToRoot(path string, sourceRoots []string) (string, bool) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return "", false
+	}
+	for _, root := range sourceRoots {
+		absRoot, err := filepath.Abs(root)
+		if err != nil {
+			continue
+		}
+		rel, err := filepath.Rel(absRoot, absPath)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return rel, true
+		}
+	}
+	return "", false
+}
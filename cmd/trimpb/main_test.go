@@ -0,0 +1,714 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Skyenought/trimpb"
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/desc/protoparse"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/reflection"
+	reflectionpb "google.golang.org/grpc/reflection/grpc_reflection_v1"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// exampleRoot 指向仓库根目录下的 example 目录
+var exampleRoot = filepath.Join("..", "..", "example")
+
+func runCLI(t *testing.T, args ...string) (string, string, int) {
+	t.Helper()
+	var stdout, stderr bytes.Buffer
+	code := run(args, &stdout, &stderr)
+	return stdout.String(), stderr.String(), code
+}
+
+func readOutput(t *testing.T, path string) string {
+	t.Helper()
+	bytes, err := os.ReadFile(path)
+	require.NoError(t, err, "未能读取输出文件: %s", path)
+	return string(bytes)
+}
+
+func TestRun_MethodRegex(t *testing.T) {
+	outDir := t.TempDir()
+	_, stderr, code := runCLI(t, "-r", exampleRoot, "-o", outDir, "-mregex", "^Create", filepath.Join(exampleRoot, "project.proto"))
+	require.Equal(t, 0, code, stderr)
+
+	content := readOutput(t, filepath.Join(outDir, "project.proto"))
+	assert.Contains(t, content, "rpc CreateProject")
+	assert.NotContains(t, content, "rpc DeleteProject")
+	assert.FileExists(t, filepath.Join(outDir, "common.proto"))
+	assert.FileExists(t, filepath.Join(outDir, "domain", "user.proto"))
+}
+
+func TestRun_NoEntryFiles(t *testing.T) {
+	_, stderr, code := runCLI(t, "-r", exampleRoot)
+	assert.Equal(t, 2, code)
+	assert.Contains(t, stderr, "Usage: trimpb")
+}
+
+func readDescriptorSet(t *testing.T, path string) *descriptorpb.FileDescriptorSet {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	fileSet := &descriptorpb.FileDescriptorSet{}
+	require.NoError(t, proto.Unmarshal(data, fileSet))
+	return fileSet
+}
+
+func TestRun_DescriptorSet(t *testing.T) {
+	descPath := filepath.Join(t.TempDir(), "out.pb")
+	_, stderr, code := runCLI(t, "-r", exampleRoot, "-desc", descPath, "-m", "ProjectService.CreateProject", filepath.Join(exampleRoot, "project.proto"))
+	require.Equal(t, 0, code, stderr)
+
+	fileSet := readDescriptorSet(t, descPath)
+	fds, err := desc.CreateFileDescriptorsFromSet(fileSet)
+	require.NoError(t, err)
+
+	projectFd := fds["project.proto"]
+	require.NotNil(t, projectFd)
+	assert.NotNil(t, projectFd.FindSymbol("project.v1.ProjectService.CreateProject"))
+	assert.NotNil(t, projectFd.FindSymbol("project.v1.CreateProjectRequest"))
+	assert.Nil(t, projectFd.FindSymbol("project.v1.ProjectService.DeleteProject"))
+	assert.Nil(t, projectFd.FindSymbol("project.v1.UnrelatedMessage"))
+	for _, fd := range fileSet.GetFile() {
+		assert.Nil(t, fd.GetSourceCodeInfo(), "未指定 -include-source-info 时不应包含源码信息: %s", fd.GetName())
+	}
+
+	// 指定 -include-source-info 后保留注释
+	_, stderr, code = runCLI(t, "-r", exampleRoot, "-desc", descPath, "-include-source-info", "-m", "ProjectService.CreateProject", filepath.Join(exampleRoot, "project.proto"))
+	require.Equal(t, 0, code, stderr)
+	for _, fd := range readDescriptorSet(t, descPath).GetFile() {
+		assert.NotNil(t, fd.GetSourceCodeInfo(), "应包含源码信息: %s", fd.GetName())
+	}
+}
+
+func TestRun_DryRun(t *testing.T) {
+	outDir := filepath.Join(t.TempDir(), "out")
+	stdout, stderr, code := runCLI(t, "-r", exampleRoot, "-o", outDir, "-dry-run", "-m", "ProjectService.CreateProject", filepath.Join(exampleRoot, "project.proto"))
+	require.Equal(t, 0, code, stderr)
+
+	assert.Contains(t, stdout, "  project.v1.ProjectService.CreateProject\n")
+	assert.Contains(t, stdout, "project.proto: keeping 3 messages, 0 enums, 1 methods\n")
+	assert.Contains(t, stdout, "  - project.v1.UnrelatedMessage\n")
+	assert.Contains(t, stdout, "  - project.v1.ProjectService.DeleteProject\n")
+	assert.NoDirExists(t, outDir, "dry-run 不应写出任何文件")
+}
+
+func TestRun_ShowRemoved(t *testing.T) {
+	outDir := t.TempDir()
+	_, stderr, code := runCLI(t, "-r", exampleRoot, "-o", outDir, "-show-removed", "-m", "ProjectService.CreateProject", filepath.Join(exampleRoot, "project.proto"))
+	require.Equal(t, 0, code, stderr)
+
+	assert.Contains(t, stderr, "Removed from "+filepath.Join(exampleRoot, "project.proto")+":\n")
+	assert.Contains(t, stderr, "  - project.v1.UnrelatedMessage\n")
+	assert.Contains(t, stderr, "  - project.v1.ProjectService.DeleteProject\n")
+	assert.NotContains(t, stderr, "project.v1.CreateProjectRequest")
+	assert.FileExists(t, filepath.Join(outDir, "project.proto"))
+
+	// 未指定时不输出
+	_, stderr, code = runCLI(t, "-r", exampleRoot, "-o", outDir, "-m", "ProjectService.CreateProject", filepath.Join(exampleRoot, "project.proto"))
+	require.Equal(t, 0, code, stderr)
+	assert.NotContains(t, stderr, "Removed from")
+}
+
+func TestRun_Zip(t *testing.T) {
+	outDir := t.TempDir()
+	zipPath := filepath.Join(outDir, "trimmed.zip")
+	_, stderr, code := runCLI(t, "-r", exampleRoot, "-o", outDir, "-zip", zipPath, "-m", "ProjectService.CreateProject", filepath.Join(exampleRoot, "project.proto"))
+	require.Equal(t, 0, code, stderr)
+	assert.NoFileExists(t, filepath.Join(outDir, "project.proto"))
+
+	zr, err := zip.OpenReader(zipPath)
+	require.NoError(t, err)
+	defer zr.Close()
+
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+	}
+	assert.Equal(t, []string{"common.proto", "domain/user.proto", "project.proto"}, names)
+
+	rc, err := zr.File[2].Open()
+	require.NoError(t, err)
+	content, err := io.ReadAll(rc)
+	require.NoError(t, rc.Close())
+	require.NoError(t, err)
+	assert.Contains(t, string(content), "rpc CreateProject")
+	assert.NotContains(t, string(content), "rpc DeleteProject")
+
+	// 相同输入应产生完全相同的归档
+	first := readOutput(t, zipPath)
+	_, stderr, code = runCLI(t, "-r", exampleRoot, "-zip", zipPath, "-m", "ProjectService.CreateProject", filepath.Join(exampleRoot, "project.proto"))
+	require.Equal(t, 0, code, stderr)
+	assert.Equal(t, first, readOutput(t, zipPath))
+}
+
+func TestRun_EntriesAcrossRoots(t *testing.T) {
+	dir := t.TempDir()
+	app, vendor := filepath.Join(dir, "app"), filepath.Join(dir, "vendor")
+	protos := map[string]string{
+		filepath.Join(app, "api", "v1", "api.proto"): `
+syntax = "proto3";
+package api.v1;
+import "shared/v1/types.proto";
+service ApiService { rpc Get(shared.v1.Request) returns (shared.v1.Response); }`,
+		filepath.Join(vendor, "shared", "v1", "types.proto"): `
+syntax = "proto3";
+package shared.v1;
+message Request { string id = 1; }
+message Response { string value = 1; }
+message Unused { string value = 1; }`,
+		filepath.Join(vendor, "shared", "v1", "admin.proto"): `
+syntax = "proto3";
+package shared.v1;
+import "shared/v1/types.proto";
+service AdminService { rpc Reset(Request) returns (Response); }`,
+	}
+	for path, content := range protos {
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+	}
+
+	// 入口文件分别位于两个根目录, 且存在跨根目录的 import
+	entries := []string{filepath.Join(app, "api", "v1", "api.proto"), filepath.Join(vendor, "shared", "v1", "admin.proto")}
+	outDir := t.TempDir()
+	args := append([]string{"-r", app, "-r", vendor, "-o", outDir, "-verify"}, entries...)
+	_, stderr, code := runCLI(t, args...)
+	require.Equal(t, 0, code, stderr)
+	assert.Contains(t, readOutput(t, filepath.Join(outDir, "api", "v1", "api.proto")), "rpc Get")
+	assert.Contains(t, readOutput(t, filepath.Join(outDir, "shared", "v1", "admin.proto")), "rpc Reset")
+	types := readOutput(t, filepath.Join(outDir, "shared", "v1", "types.proto"))
+	assert.Contains(t, types, "message Request")
+	assert.NotContains(t, types, "message Unused")
+
+	// 输出的文件按 import 名称组织, 可以直接以输出目录为根重新解析
+	parser := protoparse.Parser{ImportPaths: []string{outDir}}
+	_, err := parser.ParseFiles("api/v1/api.proto", "shared/v1/admin.proto")
+	require.NoError(t, err)
+
+	// zip 中的条目同样相对于各自的根目录
+	zipPath := filepath.Join(t.TempDir(), "out.zip")
+	args = append([]string{"-r", app, "-r", vendor, "-zip", zipPath}, entries...)
+	_, stderr, code = runCLI(t, args...)
+	require.Equal(t, 0, code, stderr)
+	zr, err := zip.OpenReader(zipPath)
+	require.NoError(t, err)
+	defer zr.Close()
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+	}
+	assert.Equal(t, []string{"api/v1/api.proto", "shared/v1/admin.proto", "shared/v1/types.proto"}, names)
+}
+
+func TestRun_Flatten(t *testing.T) {
+	outDir := t.TempDir()
+	stdout, stderr, code := runCLI(t, "-r", exampleRoot, "-o", outDir, "-flatten", "-m", "ProjectService.CreateProject", filepath.Join(exampleRoot, "project.proto"))
+	require.Equal(t, 0, code, stderr)
+	assert.FileExists(t, filepath.Join(outDir, "project.proto"))
+	assert.FileExists(t, filepath.Join(outDir, "user.proto"))
+	assert.NoDirExists(t, filepath.Join(outDir, "domain"))
+
+	// 文件按名称顺序写入
+	var written []string
+	for _, line := range strings.Split(stdout, "\n") {
+		if i := strings.Index(line, "Writing trimmed file to: "); i >= 0 {
+			written = append(written, filepath.Base(line[i+len("Writing trimmed file to: "):]))
+		}
+	}
+	assert.Equal(t, []string{"common.proto", "project.proto", "user.proto"}, written)
+}
+
+func TestRun_FlattenCollision(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		"a/types.proto": `syntax = "proto3"; package a; message A {}`,
+		"b/types.proto": `syntax = "proto3"; package b; message B {}`,
+		"api.proto": `syntax = "proto3";
+package api;
+import "a/types.proto";
+import "b/types.proto";
+service Api { rpc Call(a.A) returns (b.B); }`,
+	}
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+	}
+
+	outDir := t.TempDir()
+	_, stderr, code := runCLI(t, "-r", root, "-o", outDir, "-flatten", filepath.Join(root, "api.proto"))
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stderr, "cannot flatten output")
+	assert.Contains(t, stderr, "both map to types.proto")
+	assert.NoFileExists(t, filepath.Join(outDir, "api.proto"))
+}
+
+func TestRun_Config(t *testing.T) {
+	root, err := filepath.Abs(exampleRoot)
+	require.NoError(t, err)
+	dir := t.TempDir()
+	config := `entry_files:
+  - ` + filepath.Join(root, "project.proto") + `
+methods:
+  - ProjectService.CreateProject
+import_paths:
+  - ` + root + `
+output_dir: out
+`
+	configPath := filepath.Join(dir, "trim.yaml")
+	require.NoError(t, os.WriteFile(configPath, []byte(config), 0o644))
+
+	_, stderr, code := runCLI(t, "-config", configPath)
+	require.Equal(t, 0, code, stderr)
+
+	// output_dir 相对于配置文件所在目录
+	content := readOutput(t, filepath.Join(dir, "out", "project.proto"))
+	assert.Contains(t, content, "rpc CreateProject")
+	assert.NotContains(t, content, "rpc DeleteProject")
+	assert.FileExists(t, filepath.Join(dir, "out", "domain", "user.proto"))
+
+	// 命令行参数优先于配置文件
+	outDir := t.TempDir()
+	_, stderr, code = runCLI(t, "-config", configPath, "-o", outDir, "-m", "ProjectService.DeleteProject")
+	require.Equal(t, 0, code, stderr)
+	content = readOutput(t, filepath.Join(outDir, "project.proto"))
+	assert.Contains(t, content, "rpc DeleteProject")
+	assert.NotContains(t, content, "rpc CreateProject")
+}
+
+func TestRun_ConfigJSON(t *testing.T) {
+	root, err := filepath.Abs(exampleRoot)
+	require.NoError(t, err)
+	outDir := t.TempDir()
+	configPath := filepath.Join(t.TempDir(), "trim.json")
+	config := fmt.Sprintf(`{"entry_files": [%q], "methods": ["CreateProject"], "import_paths": [%q], "output_dir": %q}`,
+		filepath.Join(root, "project.proto"), root, outDir)
+	require.NoError(t, os.WriteFile(configPath, []byte(config), 0o644))
+
+	_, stderr, code := runCLI(t, "-config", configPath)
+	require.Equal(t, 0, code, stderr)
+	assert.Contains(t, readOutput(t, filepath.Join(outDir, "project.proto")), "rpc CreateProject")
+
+	_, stderr, code = runCLI(t, "-config", filepath.Join(t.TempDir(), "missing.yaml"))
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stderr, "failed to read config")
+}
+
+func TestRun_ConfigBatch(t *testing.T) {
+	root, err := filepath.Abs(exampleRoot)
+	require.NoError(t, err)
+	dir := t.TempDir()
+	config := `import_paths:
+  - ` + root + `
+trims:
+  - entry_files: [` + filepath.Join(root, "project.proto") + `]
+    methods: [ProjectService.CreateProject]
+    output_dir: create
+  - entry_files: [` + filepath.Join(root, "project.proto") + `]
+    methods: [ProjectService.DeleteProject]
+    output_dir: delete
+`
+	configPath := filepath.Join(dir, "trim.yaml")
+	require.NoError(t, os.WriteFile(configPath, []byte(config), 0o644))
+
+	stdout, stderr, code := runCLI(t, "-config", configPath)
+	require.Equal(t, 0, code, stderr)
+	// 源文件只加载一次
+	assert.Equal(t, 1, strings.Count(stdout, "Found and loaded"))
+
+	// 每个 trim 写入各自的 output_dir
+	content := readOutput(t, filepath.Join(dir, "create", "project.proto"))
+	assert.Contains(t, content, "rpc CreateProject")
+	assert.NotContains(t, content, "rpc DeleteProject")
+	content = readOutput(t, filepath.Join(dir, "delete", "project.proto"))
+	assert.Contains(t, content, "rpc DeleteProject")
+	assert.NotContains(t, content, "rpc CreateProject")
+
+	// 批量模式不接受单次裁剪的参数
+	_, stderr, code = runCLI(t, "-config", configPath, "-m", "CreateProject")
+	assert.Equal(t, 2, code)
+	assert.Contains(t, stderr, "-m cannot be used with the trims of -config")
+}
+
+func TestRun_InferRoot(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "protos")
+	protos := map[string]string{
+		"shop/v1/types.proto": `
+syntax = "proto3";
+package shop.v1;
+message Item { string id = 1; }`,
+		"shop/v1/service.proto": `
+syntax = "proto3";
+package shop.v1;
+import "google/protobuf/empty.proto";
+import "shop/v1/types.proto";
+service ShopService { rpc GetItem(google.protobuf.Empty) returns (Item); }`,
+	}
+	for name, content := range protos {
+		path := filepath.Join(root, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+	}
+
+	// 未指定 -r 时，沿入口文件的上级目录查找能解析其 import 的根目录
+	outDir := t.TempDir()
+	stdout, stderr, code := runCLI(t, "-o", outDir, "-m", "GetItem", filepath.Join(root, "shop", "v1", "service.proto"))
+	require.Equal(t, 0, code, stderr)
+	assert.Contains(t, stdout, "Info: no -r given, using inferred import roots: "+root)
+	assert.Contains(t, readOutput(t, filepath.Join(outDir, "shop", "v1", "service.proto")), "rpc GetItem")
+	assert.FileExists(t, filepath.Join(outDir, "shop", "v1", "types.proto"))
+
+	// import 在工作目录下即可解析时仍使用工作目录
+	assert.Equal(t, stringSlice{"."}, inferSourceRoots([]string{filepath.Join(exampleRoot, "proto2", "search.proto")}))
+}
+
+func TestRun_Single(t *testing.T) {
+	dir := t.TempDir()
+	protos := map[string]string{
+		"shop/v1/types.proto": `
+syntax = "proto3";
+package shop.v1;
+message Item { string id = 1; }
+message Unused { string value = 1; }`,
+		"shop/v1/service.proto": `
+syntax = "proto3";
+package shop.v1;
+import "shop/v1/types.proto";
+service ShopService { rpc GetItem(GetItemRequest) returns (Item); }
+message GetItemRequest { string id = 1; }`,
+	}
+	for name, content := range protos {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+	}
+
+	singlePath := filepath.Join(t.TempDir(), "out", "shop.proto")
+	_, stderr, code := runCLI(t, "-r", dir, "-single", singlePath, filepath.Join(dir, "shop/v1/service.proto"))
+	require.Equal(t, 0, code, stderr)
+
+	content := readOutput(t, singlePath)
+	assert.Contains(t, content, "service ShopService")
+	assert.Contains(t, content, "message Item")
+	assert.NotContains(t, content, "message Unused")
+	assert.NotContains(t, content, "import")
+
+	_, stderr, code = runCLI(t, "-r", exampleRoot, "-single", singlePath, filepath.Join(exampleRoot, "project.proto"))
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stderr, "cannot merge")
+}
+
+func TestRun_Substr(t *testing.T) {
+	outDir := t.TempDir()
+	_, stderr, code := runCLI(t, "-r", exampleRoot, "-o", outDir, "-m", "Create", filepath.Join(exampleRoot, "project.proto"))
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stderr, "method matching 'Create' not found")
+
+	_, stderr, code = runCLI(t, "-r", exampleRoot, "-o", outDir, "-substr", "-m", "Create", filepath.Join(exampleRoot, "project.proto"))
+	require.Equal(t, 0, code, stderr)
+	content := readOutput(t, filepath.Join(outDir, "project.proto"))
+	assert.Contains(t, content, "rpc CreateProject")
+	assert.NotContains(t, content, "rpc DeleteProject")
+}
+
+func Test_canonicalizeEntryFiles(t *testing.T) {
+	absRoot, err := filepath.Abs(exampleRoot)
+	require.NoError(t, err)
+
+	for name, entry := range map[string]string{
+		"absolute":      filepath.Join(absRoot, "domain", "user.proto"),
+		"dot-prefixed":  "." + string(filepath.Separator) + filepath.Join(exampleRoot, "domain", "user.proto"),
+		"root-relative": "domain/user.proto",
+	} {
+		t.Run(name, func(t *testing.T) {
+			// 相对根目录与绝对根目录都能匹配
+			for _, root := range []string{exampleRoot, absRoot} {
+				canonical, err := canonicalizeEntryFiles([]string{entry}, []string{root})
+				require.NoError(t, err)
+				assert.Equal(t, []string{"domain/user.proto"}, canonical)
+			}
+		})
+	}
+
+	_, err = canonicalizeEntryFiles([]string{filepath.Join(t.TempDir(), "other.proto")}, []string{exampleRoot, "protos"})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "is not under any source root ("+exampleRoot+", protos)")
+}
+
+func TestRun_AbsoluteEntry(t *testing.T) {
+	absEntry, err := filepath.Abs(filepath.Join(exampleRoot, "project.proto"))
+	require.NoError(t, err)
+	outDir := t.TempDir()
+	_, stderr, code := runCLI(t, "-r", exampleRoot, "-o", outDir, "-m", "CreateProject", absEntry)
+	require.Equal(t, 0, code, stderr)
+	assert.Contains(t, readOutput(t, filepath.Join(outDir, "project.proto")), "rpc CreateProject")
+
+	_, stderr, code = runCLI(t, "-r", exampleRoot, "-o", outDir, filepath.Join(t.TempDir(), "missing.proto"))
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stderr, "is not under any source root")
+}
+
+func TestRun_MaxDepth(t *testing.T) {
+	outDir := t.TempDir()
+	_, stderr, code := runCLI(t, "-r", exampleRoot, "-o", outDir, "-max-depth", "1", "-m", "CreateProject", filepath.Join(exampleRoot, "project.proto"))
+	require.Equal(t, 0, code, stderr)
+
+	// Project 位于深度 1, 其字段引用的 Status 和 User 被移除
+	content := readOutput(t, filepath.Join(outDir, "project.proto"))
+	assert.Contains(t, content, "message Project {")
+	assert.NotContains(t, content, "Status status")
+	assert.NotContains(t, content, "user.User owner")
+	assert.NoFileExists(t, filepath.Join(outDir, "common.proto"))
+	assert.NoFileExists(t, filepath.Join(outDir, "domain", "user.proto"))
+
+	// 深度 0 只保留请求/响应消息
+	outDir = t.TempDir()
+	_, stderr, code = runCLI(t, "-r", exampleRoot, "-o", outDir, "-max-depth", "0", "-m", "CreateProject", filepath.Join(exampleRoot, "project.proto"))
+	require.Equal(t, 0, code, stderr)
+	content = readOutput(t, filepath.Join(outDir, "project.proto"))
+	assert.Contains(t, content, "message CreateProjectResponse {")
+	assert.NotContains(t, content, "message Project {")
+
+	_, stderr, code = runCLI(t, "-r", exampleRoot, "-o", outDir, "-max-depth", "-2", filepath.Join(exampleRoot, "project.proto"))
+	assert.Equal(t, 2, code)
+	assert.Contains(t, stderr, "-max-depth must be -1 (no limit) or more")
+}
+
+func TestRun_Exclude(t *testing.T) {
+	outDir := t.TempDir()
+	args := []string{"-r", exampleRoot, "-o", outDir, "-m", "CreateProject", "-exclude", "project.v1.user.User", filepath.Join(exampleRoot, "project.proto")}
+	_, stderr, code := runCLI(t, args...)
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stderr, "field project.v1.Project.owner references excluded type project.v1.user.User")
+
+	_, stderr, code = runCLI(t, append([]string{"-strip-excluded-fields"}, args...)...)
+	require.Equal(t, 0, code, stderr)
+	content := readOutput(t, filepath.Join(outDir, "project.proto"))
+	assert.Contains(t, content, "Status status = 3;")
+	assert.NotContains(t, content, "user.User owner")
+	assert.NoFileExists(t, filepath.Join(outDir, "domain", "user.proto"))
+}
+
+// reflectedServices 只向反射服务公布给定的服务名
+type reflectedServices []string
+
+func (s reflectedServices) GetServiceInfo() map[string]grpc.ServiceInfo {
+	info := make(map[string]grpc.ServiceInfo, len(s))
+	for _, name := range s {
+		info[name] = grpc.ServiceInfo{}
+	}
+	return info
+}
+
+func TestRun_Reflect(t *testing.T) {
+	protoContents, err := trimpb.LoadProtos([]string{exampleRoot})
+	require.NoError(t, err)
+	fds, err := trimpb.Parse(trimpb.Options{
+		EntryFiles:    []string{"project.proto"},
+		ImportPaths:   []string{exampleRoot},
+		ProtoContents: protoContents,
+	})
+	require.NoError(t, err)
+	fileSet := &descriptorpb.FileDescriptorSet{}
+	for _, fd := range fds {
+		fileSet.File = append(fileSet.File, fd.AsFileDescriptorProto())
+	}
+	files, err := protodesc.NewFiles(fileSet)
+	require.NoError(t, err)
+
+	// 在本地端口上启动只提供反射服务的 gRPC 服务器
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := grpc.NewServer()
+	reflectionpb.RegisterServerReflectionServer(server, reflection.NewServerV1(reflection.ServerOptions{
+		Services:           reflectedServices{"project.v1.ProjectService"},
+		DescriptorResolver: files,
+	}))
+	go server.Serve(listener)
+	defer server.Stop()
+
+	outDir := t.TempDir()
+	stdout, stderr, code := runCLI(t, "-reflect", listener.Addr().String(), "-o", outDir, "-m", "CreateProject")
+	require.Equal(t, 0, code, stderr)
+	assert.Contains(t, stdout, "Fetched 1 proto files from ")
+
+	content := readOutput(t, filepath.Join(outDir, "project.proto"))
+	assert.Contains(t, content, "rpc CreateProject")
+	assert.NotContains(t, content, "rpc DeleteProject")
+	assert.FileExists(t, filepath.Join(outDir, "common.proto"))
+	assert.FileExists(t, filepath.Join(outDir, "domain", "user.proto"))
+}
+
+func TestRun_RequireMethods(t *testing.T) {
+	outDir := t.TempDir()
+	_, stderr, code := runCLI(t, "-r", exampleRoot, "-o", outDir, "-require-methods", filepath.Join(exampleRoot, "common.proto"))
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stderr, "the entry files declare no services: common.proto")
+}
+
+func TestRun_MethodSuggestions(t *testing.T) {
+	outDir := t.TempDir()
+	_, stderr, code := runCLI(t, "-r", exampleRoot, "-o", outDir, "-m", "ProjectService.CreatProject", filepath.Join(exampleRoot, "project.proto"))
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stderr, "did you mean project.v1.ProjectService.CreateProject?")
+}
+
+func TestRun_Strict(t *testing.T) {
+	entry := filepath.Join(exampleRoot, "project.proto")
+
+	// 默认情况下片段配合 -substr 可以匹配多个方法
+	outDir := t.TempDir()
+	_, stderr, code := runCLI(t, "-r", exampleRoot, "-o", outDir, "-substr", "-m", "Project", entry)
+	require.Equal(t, 0, code, stderr)
+	assert.Contains(t, readOutput(t, filepath.Join(outDir, "project.proto")), "rpc CreateProject")
+
+	// -strict 拒绝片段、通配符和正则
+	for _, args := range [][]string{{"-substr", "-m", "Project"}, {"-m", "CreateProject"}, {"-m", "ProjectService.Create*"}, {"-mregex", "^Create"}} {
+		args = append([]string{"-strict", "-r", exampleRoot, "-o", t.TempDir()}, append(args, entry)...)
+		_, stderr, code = runCLI(t, args...)
+		assert.Equal(t, 1, code, args)
+		assert.Contains(t, stderr, "strict matching", args)
+	}
+
+	// 完整写法仍然可用
+	outDir = t.TempDir()
+	_, stderr, code = runCLI(t, "-strict", "-r", exampleRoot, "-o", outDir, "-m", "ProjectService.CreateProject", "-m", "project.v1.ProjectService.DeleteProject", entry)
+	require.Equal(t, 0, code, stderr)
+	content := readOutput(t, filepath.Join(outDir, "project.proto"))
+	assert.Contains(t, content, "rpc CreateProject")
+	assert.Contains(t, content, "rpc DeleteProject")
+	assert.NotContains(t, content, "rpc GetProjectDetails")
+}
+
+func TestRun_Comments(t *testing.T) {
+	outDir := t.TempDir()
+	_, stderr, code := runCLI(t, "-r", exampleRoot, "-o", outDir, "-comments", "none", "-m", "ProjectService.CreateProject", filepath.Join(exampleRoot, "project.proto"))
+	require.Equal(t, 0, code, stderr)
+	content := readOutput(t, filepath.Join(outDir, "project.proto"))
+	assert.Contains(t, content, "rpc CreateProject")
+	assert.NotContains(t, content, "//")
+
+	_, stderr, code = runCLI(t, "-r", exampleRoot, "-o", outDir, "-comments", "some", filepath.Join(exampleRoot, "project.proto"))
+	assert.Equal(t, 2, code)
+	assert.Contains(t, stderr, "-comments must be all, entry or none")
+}
+
+func TestRun_Quiet(t *testing.T) {
+	for _, flag := range []string{"-quiet", "-q"} {
+		outDir := t.TempDir()
+		stdout, stderr, code := runCLI(t, flag, "-r", exampleRoot, "-o", outDir, filepath.Join(exampleRoot, "project.proto"))
+		require.Equal(t, 0, code, stderr)
+		assert.Empty(t, stdout)
+		assert.Empty(t, stderr)
+		assert.FileExists(t, filepath.Join(outDir, "project.proto"))
+
+		// 错误仍然写到 stderr
+		stdout, stderr, code = runCLI(t, flag, "-r", exampleRoot, "-o", outDir, "-m", "Missing", filepath.Join(exampleRoot, "project.proto"))
+		assert.Equal(t, 1, code)
+		assert.Empty(t, stdout)
+		assert.Contains(t, stderr, "Error: method matching 'Missing' not found")
+	}
+}
+
+func TestRun_Services(t *testing.T) {
+	muitRoot := filepath.Join(exampleRoot, "muit")
+	stdout, stderr, code := runCLI(t, "services", "-r", exampleRoot, "-r", muitRoot,
+		filepath.Join(muitRoot, "api", "v1", "commerce_service.proto"),
+		filepath.Join(exampleRoot, "project.proto"),
+	)
+	require.Equal(t, 0, code, stderr)
+	// 每行一个服务: 全限定名与方法数以制表符分隔, 按名称排序
+	assert.Equal(t, "api.v1.CommerceService\t6\napi.v1.TestService\t3\nproject.v1.ProjectService\t3\n", stdout)
+
+	_, stderr, code = runCLI(t, "services", "-r", exampleRoot)
+	assert.Equal(t, 2, code)
+	assert.Contains(t, stderr, "Usage: trimpb services")
+}
+
+func TestRun_Message(t *testing.T) {
+	entry := filepath.Join(exampleRoot, "project.proto")
+
+	// 消息的闭包合并为一个文件输出到 stdout, 不写任何文件
+	stdout, stderr, code := runCLI(t, "message", "-r", exampleRoot, "project.v1.DeleteProjectRequest", entry)
+	require.Equal(t, 0, code, stderr)
+	assert.Contains(t, stdout, "package project.v1;")
+	assert.Contains(t, stdout, "message DeleteProjectRequest {")
+	assert.NotContains(t, stdout, "service ProjectService")
+	assert.NotContains(t, stdout, "message Project {")
+
+	// 闭包跨越多个包时无法合并
+	stdout, stderr, code = runCLI(t, "message", "-r", exampleRoot, "project.v1.CreateProjectResponse", entry)
+	assert.Equal(t, 1, code)
+	assert.Empty(t, stdout)
+	assert.Contains(t, stderr, "cannot merge domain/user.proto")
+
+	// -no-merge 依次输出每个文件, 并以注释标出文件名
+	stdout, stderr, code = runCLI(t, "message", "-r", exampleRoot, "-no-merge", "project.v1.CreateProjectResponse", entry)
+	require.Equal(t, 0, code, stderr)
+	assert.Contains(t, stdout, "// common.proto\nsyntax = \"proto3\";")
+	assert.Contains(t, stdout, "\n// domain/user.proto\nsyntax = \"proto3\";")
+	assert.Contains(t, stdout, "\n// project.proto\nsyntax = \"proto3\";")
+	assert.Contains(t, stdout, "message CreateProjectResponse {")
+	assert.NotContains(t, stdout, "message PersonalInfo")
+
+	_, stderr, code = runCLI(t, "message", "-r", exampleRoot, "project.v1.Project")
+	assert.Equal(t, 2, code)
+	assert.Contains(t, stderr, "Usage: trimpb message")
+}
+
+func TestRun_KeepAllInPackage(t *testing.T) {
+	outDir := t.TempDir()
+	_, stderr, code := runCLI(t, "-r", exampleRoot, "-o", outDir, "-m", "ProjectService.DeleteProject", "-keep-all-in-package", "project.v1.user", filepath.Join(exampleRoot, "project.proto"))
+	require.Equal(t, 0, code, stderr)
+	user := readOutput(t, filepath.Join(outDir, "domain", "user.proto"))
+	assert.Contains(t, user, "message User")
+	assert.Contains(t, user, "message PersonalInfo")
+	assert.NotContains(t, readOutput(t, filepath.Join(outDir, "project.proto")), "rpc CreateProject")
+	assert.NoFileExists(t, filepath.Join(outDir, "common.proto"))
+}
+
+func TestRun_RenamePackage(t *testing.T) {
+	outDir := t.TempDir()
+	_, stderr, code := runCLI(t, "-r", exampleRoot, "-o", outDir, "-m", "ProjectService.CreateProject", "-rename-package", "project.v1=extracted.v1", filepath.Join(exampleRoot, "project.proto"))
+	require.Equal(t, 0, code, stderr)
+	content := readOutput(t, filepath.Join(outDir, "project.proto"))
+	assert.Contains(t, content, "package extracted.v1;")
+	assert.Contains(t, content, `option go_package = "example/extractedv1";`)
+
+	_, stderr, code = runCLI(t, "-r", exampleRoot, "-o", outDir, "-rename-package", "project.v1", filepath.Join(exampleRoot, "project.proto"))
+	assert.Equal(t, 2, code)
+	assert.Contains(t, stderr, "-rename-package must be old=new")
+}
+
+func TestRun_Diff(t *testing.T) {
+	outDir := filepath.Join(t.TempDir(), "out")
+	stdout, stderr, code := runCLI(t, "-diff", "-r", exampleRoot, "-o", outDir, "-m", "ProjectService.DeleteProject", filepath.Join(exampleRoot, "project.proto"))
+	require.Equal(t, 0, code, stderr)
+	assert.NoDirExists(t, outDir, "-diff 不写任何文件")
+
+	// 被整体移除的文件显示为全部删除
+	assert.Contains(t, stdout, "--- a/common.proto\n+++ /dev/null\n@@ -1,17 +0,0 @@\n-syntax = \"proto3\";\n")
+	assert.Contains(t, stdout, "--- a/domain/user.proto\n+++ /dev/null\n")
+	// 保留的文件与原文件逐行比较
+	assert.Contains(t, stdout, "--- a/project.proto\n+++ b/project.proto\n")
+	assert.Contains(t, stdout, "\n-  rpc CreateProject(CreateProjectRequest) returns (CreateProjectResponse);\n")
+	assert.Contains(t, stdout, "\n-message UnrelatedMessage {\n")
+	assert.Contains(t, stdout, "\n+  rpc DeleteProject ( DeleteProjectRequest ) returns ( DeleteProjectResponse );\n")
+	// 进度信息写到 stderr, stdout 只有 diff
+	assert.NotContains(t, stdout, "Found and loaded")
+	assert.Contains(t, stderr, "Found and loaded")
+}
@@ -0,0 +1,116 @@
+package trimpb
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/jhump/protoreflect/desc"
+)
+
+// MethodNotFoundError is returned when a name in Options.MethodNames matches
+// no method.
+type MethodNotFoundError struct {
+	// Name is the name as given.
+	Name string
+	// Candidates are the methods, among the entry files and their imports,
+	// closest to Name: those with the same simple name regardless of case and
+	// those within a few edits of Name, compared on as many trailing segments
+	// as Name has. They are always fully-qualified method names, however Name
+	// was written. The closest come first, at most maxCandidates.
+	Candidates []string
+}
+
+// maxCandidates bounds MethodNotFoundError.Candidates.
+const maxCandidates = 5
+
+func (e *MethodNotFoundError) Error() string {
+	msg := fmt.Sprintf("method matching '%s' not found in any of the provided entry files or their imports", e.Name)
+	if len(e.Candidates) > 0 {
+		msg += fmt.Sprintf(", did you mean %s?", strings.Join(e.Candidates, ", "))
+	}
+	return msg
+}
+
+// AmbiguousMethodError is returned when a fully-qualified method name is
+// declared by several files.
+type AmbiguousMethodError struct {
+	// Name is the name as given.
+	Name string
+	// Matches are the names of the files declaring the method.
+	Matches []string
+}
+
+func (e *AmbiguousMethodError) Error() string {
+	return fmt.Sprintf("method '%s' is ambiguous, it is defined in %s", e.Name, strings.Join(e.Matches, ", "))
+}
+
+// newMethodNotFoundError builds the error for methodName, suggesting the
+// methods of files whose name is close to it.
+func newMethodNotFoundError(methodName string, files []*desc.FileDescriptor) *MethodNotFoundError {
+	segments := strings.Count(methodName, ".") + 1
+	given := strings.ToLower(methodName)
+	simpleName := given[strings.LastIndex(given, ".")+1:]
+	maxDistance := max(1, len(simpleName)/4)
+
+	type candidate struct {
+		name     string
+		distance int
+	}
+	seen := make(map[string]struct{})
+	var candidates []candidate
+	for _, fd := range files {
+		for _, service := range fd.GetServices() {
+			for _, method := range service.GetMethods() {
+				name := method.GetFullyQualifiedName()
+				if _, ok := seen[name]; ok || name == methodName {
+					continue
+				}
+				seen[name] = struct{}{}
+				// Compare with as many trailing segments as were given
+				parts := strings.Split(strings.ToLower(name), ".")
+				if len(parts) > segments {
+					parts = parts[len(parts)-segments:]
+				}
+				distance := editDistance(given, strings.Join(parts, "."))
+				if distance <= maxDistance || strings.ToLower(method.GetName()) == simpleName {
+					candidates = append(candidates, candidate{name, distance})
+				}
+			}
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].distance != candidates[j].distance {
+			return candidates[i].distance < candidates[j].distance
+		}
+		return candidates[i].name < candidates[j].name
+	})
+
+	err := &MethodNotFoundError{Name: methodName}
+	for i := 0; i < len(candidates) && i < maxCandidates; i++ {
+		err.Candidates = append(err.Candidates, candidates[i].name)
+	}
+	return err
+}
+
+// editDistance returns the Levenshtein distance between a and b, counted in
+// bytes.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	curr := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		curr[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(b)]
+}
@@ -0,0 +1,64 @@
+package trimpb
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMethodNotFoundError(t *testing.T) {
+	protoFiles := map[string]string{
+		"api/service.proto": `
+syntax = "proto3";
+package api.v1;
+import "admin/service.proto";
+service Users { rpc GetUser(Msg) returns (Msg); }
+message Msg {}`,
+		"admin/service.proto": `
+syntax = "proto3";
+package admin.v1;
+service Admin {
+  rpc getuser(Req) returns (Req);
+  rpc DeleteUser(Req) returns (Req);
+}
+message Req {}`,
+	}
+
+	// 拼写相近的方法按编辑距离排在前面, 与给定名称写法一致地比较
+	for name, want := range map[string][]string{
+		"api.v1.Users.GetUsr": {"api.v1.Users.GetUser"},
+		"Users.GetUsr":        {"api.v1.Users.GetUser"},
+		"GetUser2":            {"admin.v1.Admin.getuser", "api.v1.Users.GetUser"},
+		"ListProjects":        nil,
+	} {
+		_, err := TrimWithOptions(Options{
+			EntryFiles:    []string{"api/service.proto"},
+			MethodNames:   []string{name},
+			ProtoContents: protoFiles,
+		})
+		var notFound *MethodNotFoundError
+		require.True(t, errors.As(err, &notFound), "%s: %v", name, err)
+		assert.Equal(t, name, notFound.Name)
+		assert.Equal(t, want, notFound.Candidates, name)
+	}
+
+	// 同名 (忽略大小写) 的其他方法即使相差较远也作为候选
+	_, err := TrimWithOptions(Options{
+		EntryFiles:    []string{"api/service.proto"},
+		MethodNames:   []string{"other.v1.Users.GetUser"},
+		ProtoContents: protoFiles,
+	})
+	var notFound *MethodNotFoundError
+	require.True(t, errors.As(err, &notFound), err)
+	assert.Equal(t, []string{"api.v1.Users.GetUser", "admin.v1.Admin.getuser"}, notFound.Candidates)
+	assert.EqualError(t, notFound, "method matching 'other.v1.Users.GetUser' not found in any of the provided entry files or their imports, did you mean api.v1.Users.GetUser, admin.v1.Admin.getuser?")
+
+	_, err = TrimWithOptions(Options{
+		EntryFiles:    []string{"api/service.proto"},
+		MethodNames:   []string{"ListProjects"},
+		ProtoContents: protoFiles,
+	})
+	assert.EqualError(t, err, "method matching 'ListProjects' not found in any of the provided entry files or their imports")
+}
@@ -0,0 +1,201 @@
+package trimpb
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jhump/protoreflect/desc"
+)
+
+// Node kinds used in a DependencyGraph.
+const (
+	NodeMethod  = "method"
+	NodeMessage = "message"
+	NodeEnum    = "enum"
+	NodeFile    = "file"
+)
+
+// GraphNode is a method, message or enum identified by its fully-qualified
+// name, or a file identified by its path in Options.ProtoContents.
+type GraphNode struct {
+	ID   string `json:"id"`
+	Kind string `json:"kind"`
+}
+
+// GraphEdge records that From requires To.
+type GraphEdge struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// DependencyGraph is the reachability graph behind a trim: edges lead from each
+// entry method through its input and output messages to every transitively
+// required message and enum, and from each of those to the file declaring it.
+// The graph holds exactly the definitions the trim emits: excluded types,
+// fields cut by MaxDepth and removed fields add no nodes or edges. Messages and
+// enums kept for other reasons, such as KeepMessages, KeepEnums, KeepPackages,
+// FileGranularity or the types of custom options, are roots without incoming
+// edges.
+// Nodes and edges are listed in traversal order.
+type DependencyGraph struct {
+	Nodes []GraphNode `json:"nodes"`
+	Edges []GraphEdge `json:"edges"`
+}
+
+// BuildDependencyGraph resolves the entry-point methods selected by opts and
+// returns the graph explaining why each definition and file is retained.
+func BuildDependencyGraph(opts Options) (*DependencyGraph, error) {
+	entryFds, allFds, err := opts.parse()
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := resolveTrimmer(entryFds, allFds, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &graphBuilder{
+		t:     t,
+		graph: &DependencyGraph{},
+		nodes: make(map[string]struct{}),
+		edges: make(map[GraphEdge]struct{}),
+	}
+	for _, method := range t.entryPointMethods {
+		id := b.addNode(method.GetFullyQualifiedName(), NodeMethod)
+		b.addEdge(id, b.addFile(method.GetFile()))
+		b.addEdge(id, b.addMessage(method.GetInputType()))
+		b.addEdge(id, b.addMessage(method.GetOutputType()))
+	}
+	// Everything else the trimmer kept becomes a root, in file order
+	var addRoots func(mds []*desc.MessageDescriptor, eds []*desc.EnumDescriptor)
+	addRoots = func(mds []*desc.MessageDescriptor, eds []*desc.EnumDescriptor) {
+		for _, md := range mds {
+			if _, ok := t.requiredMessages[md.Unwrap().FullName()]; ok {
+				b.addMessage(md)
+			}
+			addRoots(md.GetNestedMessageTypes(), md.GetNestedEnumTypes())
+		}
+		for _, ed := range eds {
+			if _, ok := t.requiredEnums[ed.Unwrap().FullName()]; ok {
+				b.addEnum(ed)
+			}
+		}
+	}
+	for _, fd := range allFds {
+		addRoots(fd.GetMessageTypes(), fd.GetEnumTypes())
+	}
+	return b.graph, nil
+}
+
+// DOT renders the graph in Graphviz format.
+func (g *DependencyGraph) DOT() string {
+	var sb strings.Builder
+	sb.WriteString("digraph trimpb {\n")
+	for _, node := range g.Nodes {
+		shape := "ellipse"
+		switch node.Kind {
+		case NodeMethod:
+			shape = "box"
+		case NodeEnum:
+			shape = "diamond"
+		case NodeFile:
+			shape = "note"
+		}
+		fmt.Fprintf(&sb, "  %q [shape=%s];\n", node.ID, shape)
+	}
+	for _, edge := range g.Edges {
+		fmt.Fprintf(&sb, "  %q -> %q;\n", edge.From, edge.To)
+	}
+	sb.WriteString("}\n")
+	return sb.String()
+}
+
+type graphBuilder struct {
+	t     *trimmer
+	graph *DependencyGraph
+	nodes map[string]struct{}
+	edges map[GraphEdge]struct{}
+}
+
+func (b *graphBuilder) addNode(id, kind string) string {
+	if _, ok := b.nodes[id]; !ok {
+		b.nodes[id] = struct{}{}
+		b.graph.Nodes = append(b.graph.Nodes, GraphNode{ID: id, Kind: kind})
+	}
+	return id
+}
+
+func (b *graphBuilder) addEdge(from, to string) {
+	edge := GraphEdge{From: from, To: to}
+	if _, ok := b.edges[edge]; !ok {
+		b.edges[edge] = struct{}{}
+		b.graph.Edges = append(b.graph.Edges, edge)
+	}
+}
+
+func (b *graphBuilder) addFile(fd *desc.FileDescriptor) string {
+	return b.addNode(b.t.opts.realPath(fd.GetName()), NodeFile)
+}
+
+// addMessage adds md and, on first visit, the definitions it leads the trimmer
+// to emit: its enclosing and nested messages and the types of its remaining
+// fields and nested extensions.
+func (b *graphBuilder) addMessage(md *desc.MessageDescriptor) string {
+	id := md.GetFullyQualifiedName()
+	if _, ok := b.nodes[id]; ok {
+		return id
+	}
+	b.addNode(id, NodeMessage)
+	b.addEdge(id, b.addFile(md.GetFile()))
+	if parent, ok := md.GetParent().(*desc.MessageDescriptor); ok {
+		b.addEdge(id, b.addMessage(parent))
+	}
+	for _, nested := range md.GetNestedMessageTypes() {
+		// Map entries are reached through their field, if it is kept
+		if !nested.IsMapEntry() && b.t.isEmitted(nested) {
+			b.addEdge(id, b.addMessage(nested))
+		}
+	}
+	for _, field := range md.GetFields() {
+		if !b.t.isFieldTypeEmitted(field) {
+			continue
+		}
+		b.addFieldType(id, field)
+		for _, concrete := range b.t.anyTypes[field.GetFullyQualifiedName()] {
+			if b.t.isEmitted(concrete) {
+				b.addEdge(id, b.addMessage(concrete))
+			}
+		}
+	}
+	for _, ext := range md.GetNestedExtensions() {
+		b.addEdge(id, b.addMessage(ext.GetOwner()))
+		b.addFieldType(id, ext)
+	}
+	return id
+}
+
+// addFieldType adds an edge from id to the message or enum type of field,
+// when the trimmer emits it.
+func (b *graphBuilder) addFieldType(id string, field *desc.FieldDescriptor) {
+	if mt := field.GetMessageType(); mt != nil && b.t.isEmitted(mt) {
+		b.addEdge(id, b.addMessage(mt))
+	}
+	if enum := field.GetEnumType(); enum != nil && b.t.isEmitted(enum) {
+		b.addEdge(id, b.addEnum(enum))
+	}
+}
+
+// addEnum adds ed with its file and, when nested, its enclosing message.
+func (b *graphBuilder) addEnum(ed *desc.EnumDescriptor) string {
+	id := ed.GetFullyQualifiedName()
+	if _, ok := b.nodes[id]; ok {
+		return id
+	}
+	b.addNode(id, NodeEnum)
+	b.addEdge(id, b.addFile(ed.GetFile()))
+	if parent, ok := ed.GetParent().(*desc.MessageDescriptor); ok {
+		b.addEdge(id, b.addMessage(parent))
+	}
+	return id
+}
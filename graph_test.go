@@ -0,0 +1,113 @@
+package trimpb
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuildDependencyGraph(t *testing.T) {
+	graph, err := BuildDependencyGraph(Options{
+		EntryFiles:  []string{"project.proto"},
+		MethodNames: []string{"ProjectService.CreateProject"},
+		ImportPaths: []string{"example"},
+		ProtoContents: loadProtoFiles(t, "example",
+			"project.proto",
+			"common.proto",
+			"domain/user.proto",
+		),
+	})
+	require.NoError(t, err)
+
+	// 方法 -> 响应消息 -> 导入文件中的消息 -> 文件
+	assert.Contains(t, graph.Edges, GraphEdge{From: "project.v1.ProjectService.CreateProject", To: "project.v1.CreateProjectResponse"})
+	assert.Contains(t, graph.Edges, GraphEdge{From: "project.v1.CreateProjectResponse", To: "project.v1.Project"})
+	assert.Contains(t, graph.Edges, GraphEdge{From: "project.v1.Project", To: "project.v1.user.User"})
+	assert.Contains(t, graph.Edges, GraphEdge{From: "project.v1.user.User", To: "example/domain/user.proto"})
+	assert.Contains(t, graph.Edges, GraphEdge{From: "project.v1.Project", To: "project.v1.Status"})
+	assert.Contains(t, graph.Edges, GraphEdge{From: "project.v1.Status", To: "example/common.proto"})
+
+	assert.Contains(t, graph.Nodes, GraphNode{ID: "project.v1.ProjectService.CreateProject", Kind: NodeMethod})
+	assert.Contains(t, graph.Nodes, GraphNode{ID: "project.v1.Status", Kind: NodeEnum})
+	assert.Contains(t, graph.Nodes, GraphNode{ID: "example/domain/user.proto", Kind: NodeFile})
+	assert.NotContains(t, graph.Nodes, GraphNode{ID: "project.v1.user.PersonalInfo", Kind: NodeMessage})
+
+	data, err := json.Marshal(graph)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `{"from":"project.v1.user.User","to":"example/domain/user.proto"}`)
+
+	dot := graph.DOT()
+	assert.Contains(t, dot, "digraph trimpb {")
+	assert.Contains(t, dot, `"project.v1.ProjectService.CreateProject" [shape=box];`)
+	assert.Contains(t, dot, `"project.v1.Project" -> "project.v1.user.User";`)
+}
+
+func TestBuildDependencyGraph_FollowsTrimOptions(t *testing.T) {
+	protoFiles := map[string]string{
+		"graph/service.proto": `
+syntax = "proto3";
+package graph.v1;
+
+import "graph/common.proto";
+
+service Users { rpc Get(Request) returns (User); }
+
+message Request { string id = 1; }
+
+message User {
+  Internal internal = 1;
+  Profile profile = 2;
+  message Nested { Secret secret = 1; }
+  Nested nested = 3;
+}
+
+message Internal { Secret secret = 1; }
+
+message Profile { Address address = 1; }
+
+message Address { string city = 1; }
+
+message Secret { string value = 1; }`,
+		"graph/common.proto": `
+syntax = "proto3";
+package common.v1;
+
+message Money { int64 units = 1; }`,
+	}
+	opts := Options{
+		EntryFiles:          []string{"graph/service.proto"},
+		MethodNames:         []string{"Users.Get"},
+		ExcludeTypes:        []string{"graph.v1.Internal", "graph.v1.User.Nested"},
+		StripExcludedFields: true,
+		ProtoContents:       protoFiles,
+	}
+
+	// 被排除的类型及只被它们引用的类型不出现在图中
+	graph, err := BuildDependencyGraph(opts)
+	require.NoError(t, err)
+	assert.Contains(t, graph.Edges, GraphEdge{From: "graph.v1.User", To: "graph.v1.Profile"})
+	assert.NotContains(t, graph.Nodes, GraphNode{ID: "graph.v1.Internal", Kind: NodeMessage})
+	assert.NotContains(t, graph.Nodes, GraphNode{ID: "graph.v1.User.Nested", Kind: NodeMessage})
+	assert.NotContains(t, graph.Nodes, GraphNode{ID: "graph.v1.Secret", Kind: NodeMessage})
+
+	// 超出 MaxDepth 的字段类型同样不在图中
+	depth := 1
+	opts.MaxDepth = &depth
+	graph, err = BuildDependencyGraph(opts)
+	require.NoError(t, err)
+	assert.Contains(t, graph.Nodes, GraphNode{ID: "graph.v1.Profile", Kind: NodeMessage})
+	assert.NotContains(t, graph.Nodes, GraphNode{ID: "graph.v1.Address", Kind: NodeMessage})
+
+	// KeepPackages 保留的类型作为没有入边的根节点出现
+	opts.MaxDepth = nil
+	opts.KeepPackages = []string{"common.v1"}
+	graph, err = BuildDependencyGraph(opts)
+	require.NoError(t, err)
+	assert.Contains(t, graph.Nodes, GraphNode{ID: "common.v1.Money", Kind: NodeMessage})
+	assert.Contains(t, graph.Edges, GraphEdge{From: "common.v1.Money", To: "graph/common.proto"})
+	for _, edge := range graph.Edges {
+		assert.NotEqual(t, "common.v1.Money", edge.To)
+	}
+}
@@ -0,0 +1,59 @@
+// Package grpcreflection loads the schema of a live gRPC server through server
+// reflection, for trimming with trimpb. It is kept apart from trimpb so that
+// only its importers depend on grpc.
+package grpcreflection
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/grpcreflect"
+	"google.golang.org/grpc"
+)
+
+// reflectionPrefix is the package of the gRPC reflection service itself,
+// which Load skips when listing a server's services.
+const reflectionPrefix = "grpc.reflection."
+
+// Load fetches the schema of a live server through the gRPC server
+// reflection service reachable over conn. It returns the files declaring the
+// named services, or every service the server lists except reflection itself
+// when services is empty, sorted by name. Their imports are fetched as well
+// and reached through their dependencies, so the result can be used directly
+// as trimpb.Options.Files, with EntryFiles naming some or all of the returned
+// files.
+func Load(ctx context.Context, conn grpc.ClientConnInterface, services []string) ([]*desc.FileDescriptor, error) {
+	client := grpcreflect.NewClientAuto(ctx, conn)
+	defer client.Reset()
+
+	if len(services) == 0 {
+		listed, err := client.ListServices()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list services through reflection: %w", err)
+		}
+		for _, service := range listed {
+			if !strings.HasPrefix(service, reflectionPrefix) {
+				services = append(services, service)
+			}
+		}
+	}
+
+	files := make(map[string]*desc.FileDescriptor)
+	for _, service := range services {
+		sd, err := client.ResolveService(service)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve service %s through reflection: %w", service, err)
+		}
+		files[sd.GetFile().GetName()] = sd.GetFile()
+	}
+
+	fds := make([]*desc.FileDescriptor, 0, len(files))
+	for _, fd := range files {
+		fds = append(fds, fd)
+	}
+	sort.Slice(fds, func(i, j int) bool { return fds[i].GetName() < fds[j].GetName() })
+	return fds, nil
+}
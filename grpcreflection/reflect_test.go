@@ -0,0 +1,91 @@
+package grpcreflection
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/Skyenought/trimpb"
+	"github.com/jhump/protoreflect/desc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/reflection"
+	reflectionpb "google.golang.org/grpc/reflection/grpc_reflection_v1"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/reflect/protodesc"
+)
+
+// reflectedServices 只向反射服务公布给定的服务名
+type reflectedServices []string
+
+func (s reflectedServices) GetServiceInfo() map[string]grpc.ServiceInfo {
+	info := make(map[string]grpc.ServiceInfo, len(s))
+	for _, name := range s {
+		info[name] = grpc.ServiceInfo{}
+	}
+	return info
+}
+
+// startReflectionServer 在进程内启动一个只提供反射服务的 gRPC 服务器,
+// 其描述符来自 fds, 并返回连接到它的客户端连接
+func startReflectionServer(t *testing.T, fds []*desc.FileDescriptor, services ...string) *grpc.ClientConn {
+	t.Helper()
+	files, err := protodesc.NewFiles(desc.ToFileDescriptorSet(fds...))
+	require.NoError(t, err)
+
+	listener := bufconn.Listen(1 << 20)
+	server := grpc.NewServer()
+	reflectionpb.RegisterServerReflectionServer(server, reflection.NewServerV1(reflection.ServerOptions{
+		Services:           reflectedServices(services),
+		DescriptorResolver: files,
+	}))
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestLoad(t *testing.T) {
+	exampleRoot := filepath.Join("..", "example")
+	protoContents, err := trimpb.LoadProtos([]string{exampleRoot})
+	require.NoError(t, err)
+	fds, err := trimpb.Parse(trimpb.Options{
+		EntryFiles:    []string{"project.proto"},
+		ImportPaths:   []string{exampleRoot},
+		ProtoContents: protoContents,
+	})
+	require.NoError(t, err)
+	conn := startReflectionServer(t, fds, "project.v1.ProjectService", "grpc.reflection.v1.ServerReflection")
+
+	// 未指定服务时列出服务器上的全部服务, 跳过反射服务本身
+	files, err := Load(context.Background(), conn, nil)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	assert.Equal(t, "project.proto", files[0].GetName())
+
+	result, err := trimpb.TrimWithOptions(trimpb.Options{
+		EntryFiles:  []string{"project.proto"},
+		MethodNames: []string{"ProjectService.CreateProject"},
+		Files:       files,
+	})
+	require.NoError(t, err)
+	assert.Len(t, result, 3)
+	assert.Contains(t, result["project.proto"], "rpc CreateProject")
+	assert.NotContains(t, result["project.proto"], "rpc DeleteProject")
+	assert.NotContains(t, result["project.proto"], "message UnrelatedMessage")
+
+	_, err = Load(context.Background(), conn, []string{"project.v1.MissingService"})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to resolve service project.v1.MissingService through reflection")
+}
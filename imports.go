@@ -0,0 +1,105 @@
+package trimpb
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// importPattern matches an import statement at the start of a line and
+// captures the imported file name.
+var importPattern = regexp.MustCompile(`(?m)^\s*import\s+(?:public\s+|weak\s+)?"([^"]+)"\s*;`)
+
+// Imports returns the file names imported by the proto source content, in
+// declaration order. It only scans import statements, so it works on files
+// that do not parse yet.
+func Imports(content string) []string {
+	var names []string
+	for _, match := range importPattern.FindAllStringSubmatch(content, -1) {
+		names = append(names, match[1])
+	}
+	return names
+}
+
+// checkImportCycles scans the imports of opts.ProtoContents reachable from
+// the entry files and reports the first cycle found, naming its members in
+// import order. Imports that cannot be resolved are left for the parser to
+// report.
+func (opts Options) checkImportCycles() error {
+	const (
+		visiting = 1
+		done     = 2
+	)
+	state := make(map[string]int)
+	var stack []string
+	var visit func(name string) error
+	visit = func(name string) error {
+		switch state[name] {
+		case visiting:
+			for i, member := range stack {
+				if member == name {
+					cycle := append(append([]string(nil), stack[i:]...), name)
+					return fmt.Errorf("import cycle detected: %s", strings.Join(cycle, " -> "))
+				}
+			}
+		case done:
+			return nil
+		}
+		path, ok := opts.resolvePath(name)
+		if !ok {
+			return nil
+		}
+		state[name] = visiting
+		stack = append(stack, name)
+		for _, imported := range Imports(opts.ProtoContents[path]) {
+			if err := visit(imported); err != nil {
+				return err
+			}
+		}
+		stack = stack[:len(stack)-1]
+		state[name] = done
+		return nil
+	}
+	for _, name := range opts.EntryFiles {
+		if err := visit(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// declarationPattern matches the start of a message, enum, service or extension
+// declaration.
+var declarationPattern = regexp.MustCompile(`(?m)^\s*(?:message|enum|service|extend)\s+[\w.]+\s*\{`)
+
+// checkDuplicateContents reports files reachable from the entry files that
+// are imported under different names but have identical contents, such as a
+// file found through overlapping import paths. The parser would otherwise
+// fail with a redefinition of every symbol they declare. Files declaring
+// nothing cannot clash and are left alone.
+func (opts Options) checkDuplicateContents() error {
+	byContent := make(map[string]string)
+	seen := make(map[string]struct{})
+	queue := append([]string(nil), opts.EntryFiles...)
+	for len(queue) > 0 {
+		name := queue[0]
+		queue = queue[1:]
+		if _, ok := seen[name]; ok {
+			continue
+		}
+		seen[name] = struct{}{}
+		path, ok := opts.resolvePath(name)
+		if !ok {
+			continue
+		}
+		content := opts.ProtoContents[path]
+		if first, ok := byContent[content]; ok && declarationPattern.MatchString(content) {
+			return fmt.Errorf("%s and %s have identical contents, the same file is probably imported under two names through overlapping import paths; import it under a single name", first, name)
+		}
+		byContent[content] = name
+		for _, match := range importPattern.FindAllStringSubmatch(content, -1) {
+			queue = append(queue, match[1])
+		}
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package trimpb
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrimWithOptions_ImportCycle(t *testing.T) {
+	_, err := TrimWithOptions(Options{
+		EntryFiles:  []string{"cycle/a.proto"},
+		ImportPaths: []string{"protos"},
+		ProtoContents: map[string]string{
+			"protos/cycle/a.proto": `
+syntax = "proto3";
+package cycle;
+import "cycle/b.proto";
+service S { rpc M(A) returns (A); }
+message A {}`,
+			"protos/cycle/b.proto": `
+syntax = "proto3";
+package cycle;
+// import "cycle/c.proto"; is commented out and ignored
+import public "cycle/a.proto";
+message B {}`,
+		},
+	})
+	require.Error(t, err)
+	assert.Equal(t, "import cycle detected: cycle/a.proto -> cycle/b.proto -> cycle/a.proto", err.Error())
+}
+
+func TestCheckImportCycles_Acyclic(t *testing.T) {
+	opts := Options{
+		EntryFiles:  []string{"project.proto"},
+		ImportPaths: []string{"example"},
+		ProtoContents: loadProtoFiles(t, "example",
+			"project.proto",
+			"common.proto",
+			"domain/user.proto",
+		),
+	}
+	assert.NoError(t, opts.checkImportCycles())
+}
+
+func TestTrimWithOptions_DuplicateContents(t *testing.T) {
+	common := `
+syntax = "proto3";
+package common.v1;
+message Status { int32 code = 1; }`
+	api := `
+syntax = "proto3";
+package api.v1;
+import "common.proto";
+import "v1/common.proto";
+service Api { rpc Ping(common.v1.Status) returns (common.v1.Status); }`
+
+	// 同一份内容以两个键出现, 并通过不同的名字被导入
+	_, err := TrimWithOptions(Options{
+		EntryFiles:  []string{"api.proto"},
+		ImportPaths: []string{"protos", "vendor"},
+		ProtoContents: map[string]string{
+			"protos/api.proto":       api,
+			"protos/common.proto":    common,
+			"vendor/v1/common.proto": common,
+		},
+	})
+	require.Error(t, err)
+	assert.Equal(t, "common.proto and v1/common.proto have identical contents, the same file is probably imported under two names through overlapping import paths; import it under a single name", err.Error())
+
+	// 重叠的导入路径使同一个键可以通过两个名字导入
+	_, err = TrimWithOptions(Options{
+		EntryFiles:  []string{"api.proto"},
+		ImportPaths: []string{"protos", "protos/v1"},
+		ProtoContents: map[string]string{
+			"protos/api.proto":       api,
+			"protos/v1/common.proto": common,
+		},
+	})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "common.proto and v1/common.proto have identical contents")
+
+	// 未被导入的重复内容不影响裁剪
+	result, err := TrimWithOptions(Options{
+		EntryFiles:  []string{"api.proto"},
+		ImportPaths: []string{"protos", "vendor"},
+		ProtoContents: map[string]string{
+			"protos/api.proto":    strings.Replace(api, "import \"v1/common.proto\";\n", "", 1),
+			"protos/common.proto": common,
+			"vendor/common.proto": common,
+		},
+	})
+	require.NoError(t, err)
+	assert.Len(t, result, 2)
+
+	// 不声明任何符号的不同文件内容相同也不冲突
+	empty := `syntax = "proto3";`
+	result, err = TrimWithOptions(Options{
+		EntryFiles: []string{"api.proto"},
+		ProtoContents: map[string]string{
+			"api.proto": `
+syntax = "proto3";
+package api.v1;
+import "x.proto";
+import "y.proto";
+service Api { rpc Ping(Req) returns (Req); }
+message Req {}`,
+			"x.proto": empty,
+			"y.proto": empty,
+		},
+	})
+	require.NoError(t, err)
+	assert.Contains(t, result, "api.proto")
+}
+
+func TestImports(t *testing.T) {
+	content := `
+syntax = "proto3";
+package a;
+import "b/b.proto";
+  import public "c/c.proto";
+import weak "d/d.proto" ;
+// import "e/e.proto"; 注释中的导入不算
+message A {}`
+	assert.Equal(t, []string{"b/b.proto", "c/c.proto", "d/d.proto"}, Imports(content))
+	assert.Empty(t, Imports(`syntax = "proto3";`))
+}
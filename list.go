@@ -0,0 +1,22 @@
+package trimpb
+
+// ListMethods parses the entry files of opts and lists the methods they
+// declare, so that callers can offer or validate MethodNames before trimming.
+// Each method appears twice, as Service.Method followed by its
+// fully-qualified name, in declaration order. MethodNames is ignored.
+func ListMethods(opts Options) ([]string, error) {
+	entryFds, _, err := opts.parse()
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, fd := range entryFds {
+		for _, service := range fd.GetServices() {
+			for _, method := range service.GetMethods() {
+				names = append(names, service.GetName()+"."+method.GetName(), method.GetFullyQualifiedName())
+			}
+		}
+	}
+	return names, nil
+}
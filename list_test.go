@@ -0,0 +1,36 @@
+package trimpb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListMethods(t *testing.T) {
+	opts := Options{
+		EntryFiles:  []string{"project.proto"},
+		ImportPaths: []string{"example"},
+		ProtoContents: loadProtoFiles(t, "example",
+			"project.proto",
+			"common.proto",
+			"domain/user.proto",
+		),
+	}
+
+	names, err := ListMethods(opts)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"ProjectService.CreateProject", "project.v1.ProjectService.CreateProject",
+		"ProjectService.DeleteProject", "project.v1.ProjectService.DeleteProject",
+		"ProjectService.GetProjectDetails", "project.v1.ProjectService.GetProjectDetails",
+	}, names)
+
+	// 列出的每个名字都可以直接作为 MethodNames 使用
+	for _, name := range names {
+		opts.MethodNames = []string{name}
+		report, err := Analyze(opts)
+		require.NoError(t, err)
+		assert.Len(t, report.MatchedMethods, 1, name)
+	}
+}
@@ -0,0 +1,160 @@
+package trimpb
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// LoadProtos walks every root and reads all .proto files into a map keyed by
+// their path on disk (root joined with the file's relative path), which is the
+// layout TrimMulti expects together with the same roots as importPaths.
+// A path reachable from several roots is only read once. Files are read
+// concurrently once the walk has listed them.
+func LoadProtos(roots []string) (map[string]string, error) {
+	protoContents, _, err := LoadProtosWithRoots(roots)
+	return protoContents, err
+}
+
+// LoadProtosWithRoots is LoadProtos that also returns, for every relative file
+// name found, the root it was loaded from, for use as Options.FileRoots. When
+// several roots contain the same relative name the first root wins, as it
+// would when resolving an import against the roots in order.
+func LoadProtosWithRoots(roots []string) (map[string]string, map[string]string, error) {
+	return LoadProtosFunc(roots, nil, nil)
+}
+
+// LoadProtosFunc is LoadProtosWithRoots with a filter, called during the walk
+// with the path of every directory below a root and of every .proto file:
+// returning false skips the directory, without walking it, or the file. A nil
+// filter keeps everything. logger, when not nil, receives the number of files
+// found under each root as the walk progresses.
+func LoadProtosFunc(roots []string, filter func(path string) bool, logger Logger) (map[string]string, map[string]string, error) {
+	if logger == nil {
+		logger = nopLogger{}
+	}
+	seen := make(map[string]struct{})
+	fileRoots := make(map[string]string)
+	var paths []string
+	for _, root := range roots {
+		found := 0
+		err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() {
+				if path != root && filter != nil && !filter(path) {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if filepath.Ext(path) != ".proto" || (filter != nil && !filter(path)) {
+				return nil
+			}
+			found++
+			if rel, err := filepath.Rel(root, path); err == nil {
+				if _, ok := fileRoots[filepath.ToSlash(rel)]; !ok {
+					fileRoots[filepath.ToSlash(rel)] = root
+				}
+			}
+			if _, ok := seen[path]; ok {
+				return nil
+			}
+			seen[path] = struct{}{}
+			paths = append(paths, path)
+			return nil
+		})
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to load proto files from %s: %w", root, err)
+		}
+		logger.Printf("Found %d proto files under %s", found, root)
+	}
+	protoContents, err := readProtos(paths, os.ReadFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	return protoContents, fileRoots, nil
+}
+
+// LoadProtosFS is LoadProtos for an fs.FS, such as an embed.FS. Roots and the
+// returned keys are slash-separated paths within fsys.
+func LoadProtosFS(fsys fs.FS, roots []string) (map[string]string, error) {
+	seen := make(map[string]struct{})
+	var paths []string
+	for _, root := range roots {
+		err := fs.WalkDir(fsys, root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() || filepath.Ext(path) != ".proto" {
+				return nil
+			}
+			if _, ok := seen[path]; ok {
+				return nil
+			}
+			seen[path] = struct{}{}
+			paths = append(paths, path)
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to load proto files from %s: %w", root, err)
+		}
+	}
+	return readProtos(paths, func(path string) ([]byte, error) {
+		return fs.ReadFile(fsys, path)
+	})
+}
+
+// LoadProtosZip reads every .proto entry of a zip archive, keyed by its path
+// inside the archive. Trim the result with "." as the import path, or with the
+// archive directories that act as proto roots.
+func LoadProtosZip(r io.ReaderAt, size int64) (map[string]string, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open zip archive: %w", err)
+	}
+	return LoadProtosFS(zr, []string{"."})
+}
+
+// LoadDescriptorSet reads a binary FileDescriptorSet, such as the output of
+// protoc --descriptor_set_out, for use as Options.DescriptorSet.
+func LoadDescriptorSet(path string) (*descriptorpb.FileDescriptorSet, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load descriptor set %s: %w", path, err)
+	}
+	fileSet := &descriptorpb.FileDescriptorSet{}
+	if err := proto.Unmarshal(data, fileSet); err != nil {
+		return nil, fmt.Errorf("failed to decode descriptor set %s: %w", path, err)
+	}
+	return fileSet, nil
+}
+
+// readProtos reads paths concurrently with readFile and keys the contents by
+// path.
+func readProtos(paths []string, readFile func(path string) ([]byte, error)) (map[string]string, error) {
+	contents := make([]string, len(paths))
+	err := forEachParallel(len(paths), func(i int) error {
+		content, err := readFile(paths[i])
+		if err != nil {
+			return fmt.Errorf("failed to load proto file %s: %w", paths[i], err)
+		}
+		contents[i] = string(content)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	protoContents := make(map[string]string, len(paths))
+	for i, path := range paths {
+		protoContents[path] = contents[i]
+	}
+	return protoContents, nil
+}
@@ -0,0 +1,170 @@
+package trimpb
+
+import (
+	"archive/zip"
+	"bytes"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadProtos(t *testing.T) {
+	protoContents, err := LoadProtos([]string{"example/thrift", "example/thrift/alice_edu"})
+	require.NoError(t, err)
+
+	// 两个根目录包含相同的文件时, 每个文件只读取一次
+	assert.Len(t, protoContents, 2)
+	assert.Contains(t, protoContents, "example/thrift/alice_edu/service/common/feedback.proto")
+	assert.Contains(t, protoContents, "example/thrift/alice_edu/service/turing/question_search/qs_service.proto")
+}
+
+func TestLoadProtosWithRoots(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"local/common.proto": `
+syntax = "proto3";
+package common.v1;
+message Status { int32 code = 1; }`,
+		"vendor/common.proto": `
+syntax = "proto3";
+package common.v1;
+message Status { string message = 1; }`,
+		"local/api.proto": `
+syntax = "proto3";
+package api.v1;
+import "common.proto";
+service Api { rpc Ping(common.v1.Status) returns (common.v1.Status); }`,
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+	}
+	local, vendor := filepath.Join(dir, "local"), filepath.Join(dir, "vendor")
+
+	protoContents, fileRoots, err := LoadProtosWithRoots([]string{local, vendor})
+	require.NoError(t, err)
+	assert.Len(t, protoContents, 3)
+	assert.Equal(t, map[string]string{"common.proto": local, "api.proto": local}, fileRoots)
+
+	// FileRoots 决定 common.proto 来自 local, 与 ImportPaths 的顺序无关
+	result, err := TrimWithOptions(Options{
+		EntryFiles:    []string{"api.proto"},
+		ImportPaths:   []string{vendor, local},
+		ProtoContents: protoContents,
+		FileRoots:     fileRoots,
+	})
+	require.NoError(t, err)
+	assert.Len(t, result, 2)
+	assert.Contains(t, result, filepath.Join(local, "api.proto"))
+	require.Contains(t, result, filepath.Join(local, "common.proto"))
+	assert.Contains(t, result[filepath.Join(local, "common.proto")], "int32 code = 1;")
+}
+
+func TestLoadProtosFunc(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"api/api.proto", "api/api_test.proto", "testdata/fixture.proto", "README.md"} {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		require.NoError(t, os.WriteFile(path, []byte(`syntax = "proto3";`), 0o644))
+	}
+
+	var visited []string
+	var logs bytes.Buffer
+	protoContents, fileRoots, err := LoadProtosFunc([]string{dir}, func(path string) bool {
+		visited = append(visited, path)
+		return filepath.Base(path) != "testdata" && !strings.HasSuffix(path, "_test.proto")
+	}, log.New(&logs, "", 0))
+	require.NoError(t, err)
+
+	// 被过滤的文件不出现在结果中
+	assert.Equal(t, map[string]string{filepath.Join(dir, "api", "api.proto"): `syntax = "proto3";`}, protoContents)
+	assert.Equal(t, map[string]string{"api/api.proto": dir}, fileRoots)
+	// 被跳过的目录不会继续遍历, 非 .proto 文件不经过过滤函数
+	assert.NotContains(t, visited, filepath.Join(dir, "testdata", "fixture.proto"))
+	assert.NotContains(t, visited, filepath.Join(dir, "README.md"))
+	assert.Contains(t, visited, filepath.Join(dir, "testdata"))
+	assert.Equal(t, "Found 1 proto files under "+dir+"\n", logs.String())
+}
+
+func TestLoadProtosFS(t *testing.T) {
+	fsys := fstest.MapFS{
+		"protos/common.proto": {Data: []byte(`
+syntax = "proto3";
+package common.v1;
+message Status { int32 code = 1; }`)},
+		"protos/api/project.proto": {Data: []byte(`
+syntax = "proto3";
+package project.v1;
+import "common.proto";
+service ProjectService {
+  rpc CreateProject(CreateProjectRequest) returns (common.v1.Status);
+  rpc DeleteProject(DeleteProjectRequest) returns (common.v1.Status);
+}
+message CreateProjectRequest { string name = 1; }
+message DeleteProjectRequest { string id = 1; }`)},
+		"protos/README.md": {Data: []byte("not a proto file")},
+	}
+
+	protoContents, err := LoadProtosFS(fsys, []string{"protos", "protos/api"})
+	require.NoError(t, err)
+	assert.Len(t, protoContents, 2)
+	assert.Contains(t, protoContents, "protos/common.proto")
+	assert.Contains(t, protoContents, "protos/api/project.proto")
+
+	result, err := TrimMulti([]string{"api/project.proto"}, []string{"CreateProject"}, []string{"protos"}, protoContents)
+	require.NoError(t, err)
+	assert.Contains(t, result["protos/api/project.proto"], "rpc CreateProject")
+	assert.NotContains(t, result["protos/api/project.proto"], "message DeleteProjectRequest")
+
+	_, err = LoadProtosFS(fsys, []string{"missing"})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to load proto files from missing")
+}
+
+func TestLoadProtosZip(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, name := range []string{"project.proto", "common.proto", "domain/user.proto"} {
+		content, err := os.ReadFile(filepath.Join("example", name))
+		require.NoError(t, err)
+		w, err := zw.Create(name)
+		require.NoError(t, err)
+		_, err = w.Write(content)
+		require.NoError(t, err)
+	}
+	w, err := zw.Create("docs/readme.txt")
+	require.NoError(t, err)
+	_, err = w.Write([]byte("not a proto file"))
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+
+	protoContents, err := LoadProtosZip(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	require.NoError(t, err)
+	assert.Len(t, protoContents, 3)
+	assert.Contains(t, protoContents, "domain/user.proto")
+
+	result, err := Trim("project.proto", []string{"ProjectService.CreateProject"}, []string{"."}, protoContents)
+	require.NoError(t, err)
+	assert.Contains(t, result["project.proto"], "rpc CreateProject")
+	assert.NotContains(t, result["project.proto"], "rpc DeleteProject")
+	assert.Contains(t, result, "domain/user.proto")
+
+	_, err = LoadProtosZip(bytes.NewReader([]byte("not a zip")), 9)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to open zip archive")
+}
+
+func BenchmarkLoadProtos(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		if _, err := LoadProtos([]string{"example"}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
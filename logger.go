@@ -0,0 +1,20 @@
+package trimpb
+
+// Logger receives the informational messages of a trim, such as how many
+// methods matched. *log.Logger satisfies it.
+type Logger interface {
+	Printf(format string, v ...any)
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Printf(string, ...any) {}
+
+// logger returns opts.Logger, or a no-op Logger so that library callers get
+// no output unless they ask for it.
+func (opts Options) logger() Logger {
+	if opts.Logger == nil {
+		return nopLogger{}
+	}
+	return opts.Logger
+}
@@ -0,0 +1,115 @@
+package trimpb
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrimWithOptions_NoStdoutByDefault(t *testing.T) {
+	protoFiles := loadProtoFiles(t, "example",
+		"project.proto",
+		"common.proto",
+		"domain/user.proto",
+	)
+
+	r, w, err := os.Pipe()
+	require.NoError(t, err)
+	rescueStdout := os.Stdout
+	os.Stdout = w
+	_, trimErr := TrimWithOptions(Options{
+		EntryFiles:     []string{"project.proto"},
+		MethodNames:    []string{"Project"},
+		SubstringMatch: true,
+		ImportPaths:    []string{"example"},
+		ProtoContents:  protoFiles,
+	})
+	w.Close()
+	os.Stdout = rescueStdout
+
+	require.NoError(t, trimErr)
+	output, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Empty(t, string(output), "库默认不应向标准输出打印任何内容")
+}
+
+func TestTrimWithOptions_Logger(t *testing.T) {
+	var buf bytes.Buffer
+	_, err := TrimWithOptions(Options{
+		EntryFiles:     []string{"project.proto"},
+		MethodNames:    []string{"Project"},
+		SubstringMatch: true,
+		ImportPaths:    []string{"example"},
+		ProtoContents: loadProtoFiles(t, "example",
+			"project.proto",
+			"common.proto",
+			"domain/user.proto",
+		),
+		Logger: log.New(&buf, "", 0),
+	})
+	require.NoError(t, err)
+	assert.Contains(t, buf.String(), "Found 3 methods matching 'Project'\n")
+	assert.Contains(t, buf.String(), "Found 3 files containing required definitions.\n")
+	assert.Contains(t, buf.String(), "Done!\n")
+}
+
+func TestTrimWithOptions_NoEntryPoints(t *testing.T) {
+	protoFiles := map[string]string{
+		"types/only.proto": `
+syntax = "proto3";
+package types.v1;
+message Thing { string id = 1; }`,
+		"svc/service.proto": `
+syntax = "proto3";
+package svc.v1;
+service Api { rpc Get(Req) returns (Req); }
+message Req { string id = 1; }`,
+	}
+
+	// 入口文件中没有任何服务
+	var buf bytes.Buffer
+	result, err := TrimWithOptions(Options{
+		EntryFiles:    []string{"types/only.proto"},
+		ProtoContents: protoFiles,
+		Logger:        log.New(&buf, "", 0),
+	})
+	require.NoError(t, err)
+	assert.Empty(t, result)
+	assert.Contains(t, buf.String(), "Warning: The entry files declare no services (types/only.proto), no files will be trimmed.\n")
+	assert.NotContains(t, buf.String(), "No methods matched")
+
+	_, err = TrimWithOptions(Options{
+		EntryFiles:     []string{"types/only.proto"},
+		ProtoContents:  protoFiles,
+		RequireMethods: true,
+	})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "no methods to keep, the entry files declare no services: types/only.proto")
+
+	// 指定的方法没有匹配任何方法
+	buf.Reset()
+	result, err = TrimWithOptions(Options{
+		EntryFiles:    []string{"svc/service.proto"},
+		MethodNames:   []string{"/^List/"},
+		ProtoContents: protoFiles,
+		Logger:        log.New(&buf, "", 0),
+	})
+	require.NoError(t, err)
+	assert.Empty(t, result)
+	assert.Contains(t, buf.String(), "Warning: No methods matched the given names, no files will be trimmed.\n")
+	assert.NotContains(t, buf.String(), "declare no services")
+
+	_, err = TrimWithOptions(Options{
+		EntryFiles:     []string{"svc/service.proto"},
+		MethodNames:    []string{"/^List/"},
+		ProtoContents:  protoFiles,
+		RequireMethods: true,
+	})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "no methods matched the given names")
+}
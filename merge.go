@@ -0,0 +1,184 @@
+package trimpb
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jhump/protoreflect/desc"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// Field numbers of the top-level definitions in FileDescriptorProto, used as
+// the first element of a SourceCodeInfo path.
+const (
+	fileMessageTypeField = 4
+	fileEnumTypeField    = 5
+	fileServiceField     = 6
+	fileExtensionField   = 7
+)
+
+// wellKnownPrefix is the import prefix of the files shipped with every
+// protobuf compiler. They stay imports of a merged file instead of being
+// merged into it.
+const wellKnownPrefix = "google/protobuf/"
+
+// TrimToSingleFile performs the same trim as TrimWithOptions and merges every
+// trimmed file into one printed file called name. All merged files must share
+// a package and syntax; imports between them are dropped, while well-known
+// imports under google/protobuf/ are kept. The options of the first entry file
+// become the options of the merged file, and opts.MergedPackage, when set,
+// its package.
+func TrimToSingleFile(opts Options, name string) (string, error) {
+	entryFds, allFds, err := opts.parse()
+	if err != nil {
+		return "", err
+	}
+
+	newFds, err := buildTrimmedFiles(entryFds, allFds, opts)
+	if err != nil {
+		return "", err
+	}
+	str, err := printMerged(entryFds, newFds, name, opts)
+	if err != nil {
+		return "", err
+	}
+	if opts.NormalizeOutput {
+		str = normalizeSource(str)
+	}
+	return str, nil
+}
+
+// printMerged merges the trimmed files newFds into one file called name and
+// prints it.
+func printMerged(entryFds []*desc.FileDescriptor, newFds map[string]*desc.FileDescriptor, name string, opts Options) (string, error) {
+	fd, err := buildMerged(entryFds, newFds, name, opts)
+	if err != nil {
+		return "", err
+	}
+	str, err := opts.printer().PrintProtoToString(fd)
+	if err != nil {
+		return "", fmt.Errorf("failed to print merged proto file %s: %w", name, err)
+	}
+	return str, nil
+}
+
+// buildMerged merges the trimmed files newFds into one linked file called
+// name, importing the well-known and excluded files it still needs.
+func buildMerged(entryFds []*desc.FileDescriptor, newFds map[string]*desc.FileDescriptor, name string, opts Options) (*desc.FileDescriptor, error) {
+	if len(newFds) == 0 {
+		return nil, fmt.Errorf("nothing to merge, no definitions were kept")
+	}
+
+	var optionsFrom string
+	if len(entryFds) > 0 {
+		optionsFrom = opts.rewriteImport(entryFds[0].GetName())
+	}
+	excluded := opts.excludedFiles()
+	isImport := func(name string) bool {
+		_, ok := excluded[name]
+		return ok || strings.HasPrefix(name, wellKnownPrefix)
+	}
+	merged, deps, err := mergeFiles(sortFilesTopologically(newFds), name, optionsFrom, isImport)
+	if err != nil {
+		return nil, err
+	}
+	if opts.MergedPackage != "" && opts.MergedPackage != merged.GetPackage() {
+		renamePackages([]*descriptorpb.FileDescriptorProto{merged}, map[string]string{merged.GetPackage(): opts.MergedPackage})
+	}
+
+	fd, err := desc.CreateFileDescriptor(merged, deps...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create merged descriptor: %w", err)
+	}
+	return fd, nil
+}
+
+// mergeFiles concatenates the definitions of fds, which must follow their
+// dependencies, into a single file called name, returning it along with the
+// files it still imports, those for which isImport reports true. The file
+// options are taken from the file named optionsFrom, or from the first merged
+// file when it is not among them.
+func mergeFiles(fds []*desc.FileDescriptor, name string, optionsFrom string, isImport func(name string) bool) (*descriptorpb.FileDescriptorProto, []*desc.FileDescriptor, error) {
+	var sources, deps []*desc.FileDescriptor
+	for _, fd := range fds {
+		if isImport(fd.GetName()) {
+			deps = append(deps, fd)
+		} else {
+			sources = append(sources, fd)
+		}
+	}
+	if len(sources) == 0 {
+		return nil, nil, fmt.Errorf("nothing to merge, only well-known or excluded files were kept")
+	}
+
+	first := sources[0].AsFileDescriptorProto()
+	merged := &descriptorpb.FileDescriptorProto{
+		Name:    stringPtr(name),
+		Package: first.Package,
+		Syntax:  first.Syntax,
+		Edition: first.Edition,
+		Options: first.GetOptions(),
+	}
+	var locations []*descriptorpb.SourceCodeInfo_Location
+	var lineOffset, lastLine int32
+	for _, fd := range sources {
+		fp := fd.AsFileDescriptorProto()
+		if fp.GetPackage() != merged.GetPackage() {
+			return nil, nil, fmt.Errorf("cannot merge %s (package %q) with %s (package %q)", fp.GetName(), fp.GetPackage(), first.GetName(), first.GetPackage())
+		}
+		if fp.GetSyntax() != merged.GetSyntax() || fp.GetEdition() != merged.GetEdition() {
+			return nil, nil, fmt.Errorf("cannot merge %s (syntax %q) with %s (syntax %q)", fp.GetName(), fp.GetSyntax(), first.GetName(), first.GetSyntax())
+		}
+		if fp.GetName() == optionsFrom {
+			merged.Options = fp.GetOptions()
+		}
+
+		// Shift the paths of this file's comments past the definitions
+		// already merged
+		offsets := map[int32]int32{
+			fileMessageTypeField: int32(len(merged.MessageType)),
+			fileEnumTypeField:    int32(len(merged.EnumType)),
+			fileServiceField:     int32(len(merged.Service)),
+			fileExtensionField:   int32(len(merged.Extension)),
+		}
+		for _, loc := range fp.GetSourceCodeInfo().GetLocation() {
+			path := loc.GetPath()
+			if len(path) < 2 {
+				continue // File-level locations describe the original file only
+			}
+			offset, ok := offsets[path[0]]
+			if !ok {
+				continue
+			}
+			newLoc := proto.Clone(loc).(*descriptorpb.SourceCodeInfo_Location)
+			newLoc.Path[1] += offset
+			// Lines continue after the previous file, so the printer keeps
+			// the merged definitions in file order
+			newLoc.Span[0] += lineOffset
+			endLine := newLoc.Span[0]
+			if len(newLoc.Span) == 4 {
+				newLoc.Span[2] += lineOffset
+				endLine = newLoc.Span[2]
+			}
+			if endLine > lastLine {
+				lastLine = endLine
+			}
+			locations = append(locations, newLoc)
+		}
+		lineOffset = lastLine + 1
+
+		merged.MessageType = append(merged.MessageType, fp.GetMessageType()...)
+		merged.EnumType = append(merged.EnumType, fp.GetEnumType()...)
+		merged.Service = append(merged.Service, fp.GetService()...)
+		merged.Extension = append(merged.Extension, fp.GetExtension()...)
+	}
+
+	for _, dep := range deps {
+		merged.Dependency = append(merged.Dependency, dep.GetName())
+	}
+	if len(locations) > 0 {
+		merged.SourceCodeInfo = &descriptorpb.SourceCodeInfo{Location: locations}
+	}
+	return proto.Clone(merged).(*descriptorpb.FileDescriptorProto), deps, nil
+}
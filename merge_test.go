@@ -0,0 +1,204 @@
+package trimpb
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrimToSingleFile(t *testing.T) {
+	protoContents := map[string]string{
+		"shop/v1/types.proto": `
+syntax = "proto3";
+package shop.v1;
+import "google/protobuf/timestamp.proto";
+// Item 是商品
+message Item {
+  string id = 1;
+  google.protobuf.Timestamp created_at = 2;
+  Status status = 3;
+}
+enum Status { STATUS_UNSPECIFIED = 0; STATUS_ACTIVE = 1; }
+message Unused { string value = 1; }`,
+		"shop/v1/service.proto": `
+syntax = "proto3";
+package shop.v1;
+import "shop/v1/types.proto";
+option go_package = "example.com/shop/v1";
+// ShopService 管理商品
+service ShopService {
+  // GetItem 返回一个商品
+  rpc GetItem(GetItemRequest) returns (Item);
+  rpc DeleteItem(GetItemRequest) returns (GetItemRequest);
+}
+message GetItemRequest { string id = 1; }`,
+	}
+	opts := Options{
+		EntryFiles:    []string{"shop/v1/service.proto"},
+		MethodNames:   []string{"ShopService.GetItem"},
+		ProtoContents: protoContents,
+	}
+
+	content, err := TrimToSingleFile(opts, "shop.proto")
+	require.NoError(t, err)
+	assert.Contains(t, content, "package shop.v1;")
+	assert.Contains(t, content, `import "google/protobuf/timestamp.proto";`)
+	assert.NotContains(t, content, `import "shop/v1/types.proto";`)
+	assert.Contains(t, content, `option go_package = "example.com/shop/v1";`)
+	assert.Contains(t, content, "message Item")
+	assert.Contains(t, content, "enum Status")
+	assert.Contains(t, content, "// Item 是商品")
+	assert.Contains(t, content, "// GetItem 返回一个商品")
+	assert.NotContains(t, content, "message Unused")
+	assert.NotContains(t, content, "rpc DeleteItem")
+
+	fds := parseTrimmed(t, map[string]string{"shop.proto": content}, nil, "shop.proto")
+	assert.NotNil(t, fds[0].FindSymbol("shop.v1.ShopService.GetItem"))
+	assert.NotNil(t, fds[0].FindSymbol("shop.v1.Item"))
+}
+
+func TestTrimToSingleFile_PackageMismatch(t *testing.T) {
+	_, err := TrimToSingleFile(Options{
+		EntryFiles:    []string{"project.proto"},
+		MethodNames:   []string{"ProjectService.CreateProject"},
+		ImportPaths:   []string{"example"},
+		ProtoContents: loadProtoFiles(t, "example", "project.proto", "common.proto", "domain/user.proto"),
+	}, "merged.proto")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "cannot merge")
+}
+
+func TestTrimWithOptions_MergedFileName(t *testing.T) {
+	opts := Options{
+		EntryFiles:  []string{"shop/v1/service.proto"},
+		MethodNames: []string{"ShopService.GetItem"},
+		ProtoContents: map[string]string{
+			"shop/v1/types.proto": `
+syntax = "proto3";
+package shop.v1;
+import "google/protobuf/timestamp.proto";
+message Item { string id = 1; google.protobuf.Timestamp created_at = 2; }`,
+			"shop/v1/service.proto": `
+syntax = "proto3";
+package shop.v1;
+import "shop/v1/types.proto";
+option go_package = "example.com/shop/v1";
+service ShopService { rpc GetItem(GetItemRequest) returns (Item); }
+message GetItemRequest { string id = 1; }`,
+		},
+		MergedFileName: "store/store.proto",
+		MergedPackage:  "store.v2",
+		Verify:         true,
+	}
+
+	// 合并后的结果只有一个文件, 键为配置的文件名
+	result, err := TrimWithOptions(opts)
+	require.NoError(t, err)
+	require.Len(t, result, 1)
+	content := result["store/store.proto"]
+	assert.Contains(t, content, "package store.v2;")
+	assert.Contains(t, content, `option go_package = "example.com/store/v2";`)
+	assert.Contains(t, content, "rpc GetItem ( GetItemRequest ) returns ( Item );")
+
+	fds := parseTrimmed(t, result, nil, "store/store.proto")
+	assert.Equal(t, "store/store.proto", fds[0].GetName())
+	method := fds[0].FindService("store.v2.ShopService").FindMethodByName("GetItem")
+	require.NotNil(t, method)
+	assert.Equal(t, "store.v2.Item", method.GetOutputType().GetFullyQualifiedName())
+	assert.Equal(t, "google.protobuf.Timestamp", method.GetOutputType().FindFieldByName("created_at").GetMessageType().GetFullyQualifiedName())
+
+	// TrimToDir 写出同一个文件
+	outDir := t.TempDir()
+	require.NoError(t, TrimToDir(opts, outDir))
+	written, err := os.ReadFile(filepath.Join(outDir, "store", "store.proto"))
+	require.NoError(t, err)
+	assert.Equal(t, content, string(written))
+
+	// 被排除的文件不并入, 而是作为 import 保留
+	opts.ExcludeFiles = []string{"shop/v1/types.proto"}
+	opts.MergedPackage = ""
+	opts.Verify = false
+	content, err = TrimToSingleFile(opts, "shop.proto")
+	require.NoError(t, err)
+	assert.Contains(t, content, `import "shop/v1/types.proto";`)
+	assert.NotContains(t, content, "message Item")
+	assert.Contains(t, content, "rpc GetItem ( GetItemRequest ) returns ( Item );")
+}
+
+func TestMergedFileName_AllEntryPoints(t *testing.T) {
+	opts := Options{
+		EntryFiles:  []string{"shop/v1/service.proto"},
+		MethodNames: []string{"ShopService.GetItem"},
+		ProtoContents: map[string]string{
+			"shop/v1/types.proto": `
+syntax = "proto3";
+package shop.v1;
+import "google/protobuf/timestamp.proto";
+message Item { string id = 1; google.protobuf.Timestamp created_at = 2; }`,
+			"shop/v1/service.proto": `
+syntax = "proto3";
+package shop.v1;
+import "shop/v1/types.proto";
+service ShopService { rpc GetItem(GetItemRequest) returns (Item); }
+message GetItemRequest { string id = 1; }`,
+		},
+		MergedFileName: "shop.proto",
+	}
+	want, err := TrimWithOptions(opts)
+	require.NoError(t, err)
+
+	// TrimEach 与 TrimWithStats 同样只输出合并后的文件
+	streamed := make(map[string]string)
+	require.NoError(t, TrimEach(opts, func(path string, r io.Reader) error {
+		content, err := io.ReadAll(r)
+		streamed[path] = string(content)
+		return err
+	}))
+	assert.Equal(t, want, streamed)
+
+	result, _, err := TrimWithStats(opts)
+	require.NoError(t, err)
+	assert.Equal(t, want, result)
+
+	files, err := RequiredFilesWithOptions(opts)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"shop.proto"}, files)
+
+	// 描述符集包含合并后的文件及其 import 的标准文件
+	fileSet, err := TrimToDescriptorSet(opts)
+	require.NoError(t, err)
+	var names []string
+	for _, fp := range fileSet.GetFile() {
+		names = append(names, fp.GetName())
+	}
+	assert.Equal(t, []string{"google/protobuf/timestamp.proto", "shop.proto"}, names)
+
+	// 无法合并时所有入口都报错, 而不是输出未合并的文件
+	opts.ProtoContents["shop/v1/types.proto"] = `
+syntax = "proto3";
+package catalog.v1;
+message Item { string id = 1; }`
+	opts.ProtoContents["shop/v1/service.proto"] = `
+syntax = "proto3";
+package shop.v1;
+import "shop/v1/types.proto";
+service ShopService { rpc GetItem(GetItemRequest) returns (catalog.v1.Item); }
+message GetItemRequest { string id = 1; }`
+	_, err = TrimWithOptions(opts)
+	assert.ErrorContains(t, err, "cannot merge")
+	err = TrimEach(opts, func(path string, r io.Reader) error {
+		t.Errorf("unexpected file %s", path)
+		return nil
+	})
+	assert.ErrorContains(t, err, "cannot merge")
+	_, _, err = TrimWithStats(opts)
+	assert.ErrorContains(t, err, "cannot merge")
+	_, err = RequiredFilesWithOptions(opts)
+	assert.ErrorContains(t, err, "cannot merge")
+	_, err = TrimToDescriptorSet(opts)
+	assert.ErrorContains(t, err, "cannot merge")
+}
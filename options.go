@@ -0,0 +1,322 @@
+package trimpb
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/desc/protoparse"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// Options describes a single trim. The zero value of every optional field
+// preserves the default behavior, so new settings can be added without
+// breaking existing callers.
+type Options struct {
+	// EntryFiles are the files whose services are trimmed, given relative to
+	// one of the ImportPaths.
+	EntryFiles []string
+	// MethodNames selects the methods to keep. Each name may be a fully
+	// qualified name, Service.Method, a bare method name, a glob in the
+	// method portion or a /regex/. A bare name keeps the method of that exact
+	// name in every service of the entry files. When empty, every method of
+	// the entry files is kept and only unused definitions are removed.
+	MethodNames []string
+	// SubstringMatch makes a bare method name match every method whose name
+	// contains it, so that "Get" also keeps GetUser.
+	SubstringMatch bool
+	// StrictMethodNames accepts only Service.Method and fully-qualified
+	// names in MethodNames, each naming exactly one method: bare names, globs
+	// and regexes fail instead of possibly keeping more than intended, as does
+	// a Service.Method matching services of several packages, and
+	// SubstringMatch has no effect.
+	StrictMethodNames bool
+	// KeepMessages lists fully-qualified message names to keep, with
+	// everything they reference, even when no kept method uses them. Setting
+	// it without MethodNames trims to the seeded messages alone instead of
+	// keeping every method.
+	KeepMessages []string
+	// KeepEnums lists fully-qualified enum names to keep even when no kept
+	// message references them. Like KeepMessages, setting it without
+	// MethodNames keeps no methods.
+	KeepEnums []string
+	// KeepPackages lists packages kept whole: every message, enum, service
+	// method and top-level extension declared in them, among the entry files
+	// and their imports, is kept with what it references, while other packages
+	// are trimmed as usual. Like KeepMessages, setting it without MethodNames
+	// keeps no other methods.
+	KeepPackages []string
+	// KeepRelatedMethods also keeps every method of the entry files whose
+	// input or output message is required by the selected methods or
+	// KeepMessages. It lets a seed message pull in the RPCs that use it. The
+	// messages of those related methods do not relate further methods.
+	KeepRelatedMethods bool
+	// FileGranularity keeps every message and enum of a retained file, along
+	// with what they reference, instead of only the required ones. Unneeded
+	// files and unselected methods are still removed.
+	FileGranularity bool
+	// MaxDepth, when set, limits how many fields are followed from the
+	// selected methods and kept definitions: 0 keeps only the request,
+	// response and kept types, 1 adds the types of their own fields. Fields
+	// of a kept message whose type lies beyond the limit are removed from the
+	// output, their numbers are not reused. Types of custom options and
+	// extensions are always kept in full. Nil keeps the whole transitive
+	// closure.
+	MaxDepth *int
+	// ExcludeTypes lists fully-qualified messages and enums that are never
+	// kept, nor anything nested in them. Trimming fails when one is the
+	// request or response of a kept method, or when a kept message has a
+	// field of an excluded type, unless StripExcludedFields is set.
+	ExcludeTypes []string
+	// StripExcludedFields removes the fields of kept messages whose type is
+	// excluded instead of failing. Remaining fields keep their numbers.
+	StripExcludedFields bool
+	// ExcludeFiles names files, by import name, that are trimmed as usual but
+	// left out of the output, to be provided separately: files importing
+	// them keep the import, as for well-known files. The output does not
+	// compile on its own unless the excluded files are supplied, and they
+	// must define everything the output uses from them. TrimToDescriptorSet
+	// still includes them, to stay self-contained.
+	ExcludeFiles []string
+	// AnyTypes maps the fully-qualified name of a google.protobuf.Any field,
+	// such as pkg.Event.payload, to the messages it is expected to hold.
+	// Whenever the field's message is kept, those messages are kept too,
+	// along with what they reference, as if the field referenced them.
+	AnyTypes map[string][]string
+	// RequireMethods makes the trim fail when it selects no method and no
+	// KeepMessages or KeepEnums, either because MethodNames matched nothing or
+	// because the entry files declare no services. Otherwise a warning is
+	// logged and nothing is kept.
+	RequireMethods bool
+	// NormalizeOutput converts the line endings of every printed file to LF
+	// and strips trailing whitespace from each line, so that output is byte
+	// for byte the same whatever line endings the sources used.
+	NormalizeOutput bool
+	// SortElements prints the elements of every file in canonical order
+	// instead of declaration order: messages, then enums, then services, each
+	// sorted by name, with fields and enum values by number and methods by
+	// name.
+	SortElements bool
+	// CommentScope selects which comments of the source files are kept in the
+	// output. The zero value, CommentScopeAll, keeps them all.
+	CommentScope CommentScope
+	// OmitSourceInfo parses the sources without source code info and drops
+	// any carried by a DescriptorSet or Files, skipping the re-indexing of
+	// comments. The output has no comments and keeps the declaration order
+	// of the descriptors; trimming is faster, especially for large schemas.
+	OmitSourceInfo bool
+	// KeepUnusedImports keeps every original import of a file that is still
+	// emitted, even when no kept definition uses it. Imports of files that
+	// are trimmed away, including files left without any definition, are
+	// removed regardless.
+	KeepUnusedImports bool
+	// Verify parses the printed files again and fails the trim when they do
+	// not compile, instead of returning output that protoc would reject.
+	// TrimEach then prints every file before calling fn.
+	Verify bool
+	// ImportPaths are the roots used to resolve EntryFiles and imports.
+	ImportPaths []string
+	// ProtoContents maps file paths (import path joined with the file's
+	// relative name) to their source.
+	ProtoContents map[string]string
+	// Parser, when set, is copied to parse ProtoContents, carrying settings
+	// such as InterpretOptionsInUnlinkedFiles or an ErrorReporter. Its
+	// Accessor, ImportPaths and IncludeSourceCodeInfo are replaced by the
+	// ones the other options call for.
+	Parser *protoparse.Parser
+	// FileRoots maps the relative name of a file to the import path it was
+	// loaded from, as returned by LoadProtosWithRoots. A name listed here is
+	// read from that root rather than from the first of ImportPaths that
+	// contains it, both when parsing and when naming the returned files.
+	FileRoots map[string]string
+	// DescriptorSet, when set, replaces ProtoContents as the schema source:
+	// EntryFiles name files in the set and ImportPaths are ignored. The set
+	// must contain every file the entry files import.
+	DescriptorSet *descriptorpb.FileDescriptorSet
+	// Files, when set, replaces ProtoContents and DescriptorSet with files
+	// that are already parsed, such as those returned by Parse, so that the
+	// same schema can be trimmed repeatedly without parsing it again.
+	// EntryFiles name files among them; their imports are reached through
+	// their dependencies. ProtoContents and ImportPaths, if also set, are
+	// only used to name the returned files.
+	Files []*desc.FileDescriptor
+	// ImportRewrites relocates the trimmed files: an import name starting
+	// with one of the keys has that prefix replaced by its value, both in the
+	// file's own name and in every import of it. The longest matching prefix
+	// wins, so {"example/": ""} strips a directory. Rewritten files are
+	// returned under their new name, joined with the import path they were
+	// found in.
+	ImportRewrites map[string]string
+	// PackageRenames moves the trimmed files of a package, given as a key, to
+	// the package it maps to, rewriting every reference to their types. The
+	// go_package option of a moved file follows when its import path ends in
+	// the old package, either as directories (project/v1) or as one name
+	// without dots (projectv1). Subpackages are not moved unless listed too.
+	PackageRenames map[string]string
+	// MergedFileName, when set, merges the trimmed files into one file of
+	// that name, as TrimToSingleFile does, which every trim then returns,
+	// streams or writes under that name alone; RequiredFilesWithOptions
+	// returns just the name. TrimToDescriptorSet returns the merged file
+	// with the files it imports. Files that cannot be merged fail the trim.
+	MergedFileName string
+	// MergedPackage sets the package of a merged file, rewriting the
+	// references to its types. By default it keeps the package shared by the
+	// merged files.
+	MergedPackage string
+	// Logger receives progress and warning messages. Nil discards them.
+	Logger Logger
+}
+
+// CommentScope selects the comments kept by a trim.
+type CommentScope int
+
+const (
+	// CommentScopeAll keeps the comments of every emitted element.
+	CommentScopeAll CommentScope = iota
+	// CommentScopeEntryOnly keeps only the comments of the selected methods
+	// and of their request and response messages, including their fields
+	// and nested types.
+	CommentScopeEntryOnly
+	// CommentScopeNone drops every comment.
+	CommentScopeNone
+)
+
+// parse parses the entry files and returns them together with every file
+// they transitively import.
+func (opts Options) parse() ([]*desc.FileDescriptor, []*desc.FileDescriptor, error) {
+	if opts.Files != nil {
+		return opts.parsedFiles()
+	}
+	if opts.DescriptorSet != nil {
+		return opts.parseDescriptorSet()
+	}
+	if len(opts.ProtoContents) == 0 {
+		return nil, nil, fmt.Errorf("no proto files provided, ProtoContents is empty")
+	}
+	if err := opts.checkImportCycles(); err != nil {
+		return nil, nil, err
+	}
+	if err := opts.checkDuplicateContents(); err != nil {
+		return nil, nil, err
+	}
+
+	var parser protoparse.Parser
+	if opts.Parser != nil {
+		parser = *opts.Parser
+	}
+	parser.Accessor = protoparse.FileContentsFromMap(opts.ProtoContents)
+	parser.IncludeSourceCodeInfo = !opts.OmitSourceInfo // Preserve source code info for comments
+	parser.ImportPaths = opts.ImportPaths
+	if len(opts.FileRoots) > 0 {
+		// Resolve names ourselves so that each is read from its own root
+		parser.Accessor = opts.openFile
+		parser.ImportPaths = nil
+	}
+
+	entryFds, err := parser.ParseFiles(opts.EntryFiles...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse proto files from map: %w", err)
+	}
+	return entryFds, collectAllDependencies(entryFds), nil
+}
+
+// openFile is the parser's accessor: it reads the file imported as name from
+// opts.ProtoContents, resolved by resolvePath.
+func (opts Options) openFile(name string) (io.ReadCloser, error) {
+	path, ok := opts.resolvePath(name)
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return io.NopCloser(strings.NewReader(opts.ProtoContents[path])), nil
+}
+
+// resolvePath returns the key in opts.ProtoContents of the file imported as
+// name: the join with its root in opts.FileRoots when listed, otherwise the
+// join with the first of opts.ImportPaths that exists, otherwise name itself.
+func (opts Options) resolvePath(name string) (string, bool) {
+	if root, ok := opts.FileRoots[name]; ok {
+		joinedPath := filepath.Clean(filepath.Join(root, name))
+		if _, ok := opts.ProtoContents[joinedPath]; ok {
+			return joinedPath, true
+		}
+	}
+	for _, importPath := range opts.ImportPaths {
+		joinedPath := filepath.Clean(filepath.Join(importPath, name))
+		if _, ok := opts.ProtoContents[joinedPath]; ok {
+			return joinedPath, true
+		}
+	}
+	if _, ok := opts.ProtoContents[name]; ok {
+		return name, true
+	}
+	return "", false
+}
+
+// realPath is resolvePath falling back to name for files that are not in
+// opts.ProtoContents.
+func (opts Options) realPath(name string) string {
+	if path, ok := opts.resolvePath(name); ok {
+		return path
+	}
+	return name
+}
+
+// Parse parses the entry files of opts and returns them together with every
+// file they transitively import, sorted by name, for reuse as Options.Files.
+func Parse(opts Options) ([]*desc.FileDescriptor, error) {
+	_, allFds, err := opts.parse()
+	return allFds, err
+}
+
+// parsedFiles picks the entry files out of opts.Files.
+func (opts Options) parsedFiles() ([]*desc.FileDescriptor, []*desc.FileDescriptor, error) {
+	byName := make(map[string]*desc.FileDescriptor, len(opts.Files))
+	for _, fd := range opts.Files {
+		byName[fd.GetName()] = fd
+	}
+	entryFds := make([]*desc.FileDescriptor, 0, len(opts.EntryFiles))
+	for _, name := range opts.EntryFiles {
+		fd, ok := byName[name]
+		if !ok {
+			return nil, nil, fmt.Errorf("entry file %s not found in the given files", name)
+		}
+		entryFds = append(entryFds, fd)
+	}
+	return entryFds, collectAllDependencies(entryFds), nil
+}
+
+// parseDescriptorSet builds the descriptors of opts.DescriptorSet and picks
+// out the entry files.
+func (opts Options) parseDescriptorSet() ([]*desc.FileDescriptor, []*desc.FileDescriptor, error) {
+	fds, err := desc.CreateFileDescriptorsFromSet(opts.DescriptorSet)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to build descriptors from descriptor set: %w", err)
+	}
+
+	entryFds := make([]*desc.FileDescriptor, 0, len(opts.EntryFiles))
+	for _, name := range opts.EntryFiles {
+		fd, ok := fds[name]
+		if !ok {
+			return nil, nil, fmt.Errorf("entry file %s not found in descriptor set", name)
+		}
+		entryFds = append(entryFds, fd)
+	}
+	return entryFds, collectAllDependencies(entryFds), nil
+}
+
+// rewriteImport applies the longest matching prefix of opts.ImportRewrites to
+// the import name.
+func (opts Options) rewriteImport(name string) string {
+	longest := -1
+	rewritten := name
+	for prefix, replacement := range opts.ImportRewrites {
+		if strings.HasPrefix(name, prefix) && len(prefix) > longest {
+			longest = len(prefix)
+			rewritten = replacement + strings.TrimPrefix(name, prefix)
+		}
+	}
+	return rewritten
+}
@@ -0,0 +1,1131 @@
+package trimpb
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jhump/protoreflect/desc/protoparse"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+func TestTrimWithOptions(t *testing.T) {
+	opts := Options{
+		EntryFiles:  []string{"project.proto"},
+		MethodNames: []string{"ProjectService.CreateProject"},
+		ImportPaths: []string{"example"},
+		ProtoContents: loadProtoFiles(t, "example",
+			"project.proto",
+			"common.proto",
+			"domain/user.proto",
+		),
+	}
+
+	result, err := TrimWithOptions(opts)
+	require.NoError(t, err)
+	assert.Len(t, result, 3)
+	assert.Contains(t, result["example/project.proto"], "rpc CreateProject")
+	assert.NotContains(t, result["example/project.proto"], "rpc DeleteProject")
+
+	// 位置参数形式的包装函数应与 Options 形式输出一致
+	multi, err := TrimMulti(opts.EntryFiles, opts.MethodNames, opts.ImportPaths, opts.ProtoContents)
+	require.NoError(t, err)
+	assert.Equal(t, result, multi)
+}
+
+func TestTrimWithOptions_CleanupMode(t *testing.T) {
+	result, err := TrimWithOptions(Options{
+		EntryFiles:  []string{"project.proto"},
+		ImportPaths: []string{"example"},
+		ProtoContents: loadProtoFiles(t, "example",
+			"project.proto",
+			"common.proto",
+			"domain/user.proto",
+		),
+	})
+	require.NoError(t, err)
+	assert.Contains(t, result["example/project.proto"], "rpc DeleteProject")
+	assert.NotContains(t, result["example/project.proto"], "message UnrelatedMessage")
+}
+
+func TestTrimWithOptions_ParseError(t *testing.T) {
+	_, err := TrimWithOptions(Options{
+		EntryFiles:    []string{"project.proto"},
+		ImportPaths:   []string{"example"},
+		ProtoContents: loadProtoFiles(t, "example", "project.proto"),
+	})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to parse proto files from map")
+}
+
+func TestTrimWithOptions_EmptyContents(t *testing.T) {
+	// 例如 LoadProtos 的根目录写错时得到空 map
+	for _, contents := range []map[string]string{nil, {}} {
+		_, err := TrimMulti([]string{"project.proto"}, nil, []string{"example"}, contents)
+		assert.EqualError(t, err, "no proto files provided, ProtoContents is empty")
+	}
+	_, err := TrimToDescriptorSet(Options{EntryFiles: []string{"project.proto"}})
+	assert.EqualError(t, err, "no proto files provided, ProtoContents is empty")
+}
+
+func TestTrimToDescriptorSet(t *testing.T) {
+	fileSet, err := TrimToDescriptorSet(Options{
+		EntryFiles:  []string{"project.proto"},
+		MethodNames: []string{"DeleteProject"},
+		ImportPaths: []string{"example"},
+		ProtoContents: loadProtoFiles(t, "example",
+			"project.proto",
+			"common.proto",
+			"domain/user.proto",
+		),
+	})
+	require.NoError(t, err)
+	require.Len(t, fileSet.GetFile(), 1)
+	assert.Equal(t, "project.proto", fileSet.GetFile()[0].GetName())
+}
+
+func TestTrimWithOptions_DescriptorSet(t *testing.T) {
+	parser := protoparse.Parser{
+		Accessor:    protoparse.FileContentsFromMap(loadProtoFiles(t, "example", "project.proto", "common.proto", "domain/user.proto")),
+		ImportPaths: []string{"example"},
+	}
+	fds, err := parser.ParseFiles("common.proto", "domain/user.proto", "project.proto")
+	require.NoError(t, err)
+	fileSet := &descriptorpb.FileDescriptorSet{}
+	for _, fd := range fds {
+		fileSet.File = append(fileSet.File, fd.AsFileDescriptorProto())
+	}
+
+	// 通过 .pb 文件往返一次, 模拟 protoc --descriptor_set_out 的产物
+	data, err := proto.Marshal(fileSet)
+	require.NoError(t, err)
+	setPath := filepath.Join(t.TempDir(), "schema.pb")
+	require.NoError(t, os.WriteFile(setPath, data, 0o644))
+	loaded, err := LoadDescriptorSet(setPath)
+	require.NoError(t, err)
+
+	result, err := TrimWithOptions(Options{
+		EntryFiles:    []string{"project.proto"},
+		MethodNames:   []string{"ProjectService.CreateProject"},
+		DescriptorSet: loaded,
+	})
+	require.NoError(t, err)
+	assert.Len(t, result, 3)
+	assert.Contains(t, result["project.proto"], "rpc CreateProject")
+	assert.NotContains(t, result["project.proto"], "rpc DeleteProject")
+	assert.Contains(t, result["domain/user.proto"], "message User")
+
+	_, err = TrimWithOptions(Options{
+		EntryFiles:    []string{"missing.proto"},
+		DescriptorSet: loaded,
+	})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "entry file missing.proto not found in descriptor set")
+}
+
+func TestTrimWithOptions_ImportRewrites(t *testing.T) {
+	protoContents, err := LoadProtos([]string{"example/muit"})
+	require.NoError(t, err)
+
+	result, err := TrimWithOptions(Options{
+		EntryFiles:     []string{"api/v1/commerce_service.proto"},
+		MethodNames:    []string{"CommerceService.GetUser", "CommerceService.GetOrder"},
+		ImportPaths:    []string{"example/muit"},
+		ProtoContents:  protoContents,
+		ImportRewrites: map[string]string{"services/": "", "services/user/": "people/"},
+	})
+	require.NoError(t, err)
+
+	// 最长前缀优先: services/user/ 改写为 people/, 其余 services/ 前缀被去掉
+	assert.Contains(t, result, "example/muit/people/user.proto")
+	assert.Contains(t, result, "example/muit/people/profile.proto")
+	assert.Contains(t, result, "example/muit/order/order.proto")
+	assert.Contains(t, result, "example/muit/api/v1/commerce_service.proto")
+	assert.NotContains(t, result, "example/muit/services/user/user.proto")
+	assert.Contains(t, result["example/muit/api/v1/commerce_service.proto"], `import "people/user.proto";`)
+	assert.Contains(t, result["example/muit/api/v1/commerce_service.proto"], `import "order/order.proto";`)
+	assert.Contains(t, result["example/muit/order/order.proto"], `import "order/item.proto";`)
+	assert.Contains(t, result["example/muit/people/user.proto"], `import "people/profile.proto";`)
+	assert.Contains(t, result["example/muit/people/user.proto"], `import "common/types/base.proto";`)
+
+	// 结果在新布局下可以重新解析
+	fds := parseTrimmed(t, result, []string{"example/muit"}, "api/v1/commerce_service.proto")
+	assert.NotNil(t, fds[0].FindSymbol("api.v1.CommerceService.GetOrder"))
+
+	_, err = TrimWithOptions(Options{
+		EntryFiles:     []string{"api/v1/commerce_service.proto"},
+		MethodNames:    []string{"CommerceService.GetUser"},
+		ImportPaths:    []string{"example/muit"},
+		ProtoContents:  protoContents,
+		ImportRewrites: map[string]string{"services/user/user.proto": "x.proto", "services/user/profile.proto": "x.proto"},
+	})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "to x.proto")
+}
+
+func TestTrimToDescriptorSet_IndependentResults(t *testing.T) {
+	parser := protoparse.Parser{
+		Accessor:    protoparse.FileContentsFromMap(loadProtoFiles(t, "example", "project.proto", "common.proto", "domain/user.proto")),
+		ImportPaths: []string{"example"},
+	}
+	fds, err := parser.ParseFiles("common.proto", "domain/user.proto", "project.proto")
+	require.NoError(t, err)
+	input := &descriptorpb.FileDescriptorSet{}
+	for _, fd := range fds {
+		input.File = append(input.File, fd.AsFileDescriptorProto())
+	}
+	original := proto.Clone(input)
+
+	opts := Options{
+		EntryFiles:    []string{"project.proto"},
+		MethodNames:   []string{"ProjectService.CreateProject"},
+		DescriptorSet: input,
+	}
+	first, err := TrimToDescriptorSet(opts)
+	require.NoError(t, err)
+	expected := proto.Clone(first)
+
+	// 修改第一次的结果不能影响输入, 也不能影响之后的裁剪
+	for _, fp := range first.GetFile() {
+		for _, msg := range fp.GetMessageType() {
+			msg.Name = proto.String("Mutated" + msg.GetName())
+			msg.Field = nil
+		}
+		for _, svc := range fp.GetService() {
+			for _, method := range svc.GetMethod() {
+				method.InputType = proto.String(".mutated.Input")
+			}
+		}
+	}
+	assert.True(t, proto.Equal(original, input), "输入的描述符集被修改")
+
+	second, err := TrimToDescriptorSet(opts)
+	require.NoError(t, err)
+	assert.True(t, proto.Equal(expected, second), "同一输入的两次裁剪结果不一致")
+}
+
+func TestTrimWithOptions_KeepRelatedMethods(t *testing.T) {
+	protoContents, err := LoadProtos([]string{"example/muit"})
+	require.NoError(t, err)
+	opts := Options{
+		EntryFiles:    []string{"api/v1/commerce_service.proto"},
+		KeepMessages:  []string{"services.product.Product"},
+		ImportPaths:   []string{"example/muit"},
+		ProtoContents: protoContents,
+	}
+
+	// 只保留种子消息时不保留任何方法
+	report, err := Analyze(opts)
+	require.NoError(t, err)
+	assert.Empty(t, report.MatchedMethods)
+	result, err := TrimWithOptions(opts)
+	require.NoError(t, err)
+	assert.Contains(t, result["example/muit/services/product/product.proto"], "message Product")
+	assert.NotContains(t, result, "example/muit/api/v1/commerce_service.proto")
+
+	// 开启后, 两个服务中使用 Product 的方法都被保留, 且不会继续沿 GetRequest 扩散
+	opts.KeepRelatedMethods = true
+	report, err = Analyze(opts)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"api.v1.CommerceService.GetProduct",
+		"api.v1.TestService.TestMethod2",
+	}, report.MatchedMethods)
+	result, err = TrimWithOptions(opts)
+	require.NoError(t, err)
+	content := result["example/muit/api/v1/commerce_service.proto"]
+	assert.Contains(t, content, "rpc GetProduct")
+	assert.Contains(t, content, "service TestService")
+	assert.Contains(t, content, "rpc TestMethod2")
+	assert.NotContains(t, content, "rpc GetUser")
+
+	_, err = TrimWithOptions(Options{
+		EntryFiles:    opts.EntryFiles,
+		KeepMessages:  []string{"services.product.Missing", "api.v1.CommerceService"},
+		ImportPaths:   opts.ImportPaths,
+		ProtoContents: protoContents,
+	})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "message 'services.product.Missing' not found")
+	assert.Contains(t, err.Error(), "'api.v1.CommerceService' is a service in api/v1/commerce_service.proto, not a message")
+}
+
+func TestTrimWithOptions_KeepEnums(t *testing.T) {
+	protoContents := map[string]string{
+		"status/codes.proto": `
+syntax = "proto3";
+package status.v1;
+enum Code { CODE_UNSPECIFIED = 0; CODE_NOT_FOUND = 1; }
+enum Unused { UNUSED_UNSPECIFIED = 0; }
+message Detail {
+  enum Severity { SEVERITY_UNSPECIFIED = 0; SEVERITY_HIGH = 1; }
+  string reason = 1;
+}`,
+		"api/service.proto": `
+syntax = "proto3";
+package api.v1;
+import "status/codes.proto";
+service Api { rpc Ping(PingRequest) returns (PingRequest); }
+message PingRequest { string id = 1; }`,
+	}
+	opts := Options{
+		EntryFiles:    []string{"api/service.proto"},
+		MethodNames:   []string{"Api.Ping"},
+		KeepEnums:     []string{"status.v1.Code", "status.v1.Detail.Severity"},
+		ProtoContents: protoContents,
+	}
+
+	result, err := TrimWithOptions(opts)
+	require.NoError(t, err)
+	// 未被任何消息引用的枚举也会保留, 其所在文件随之保留
+	content := result["status/codes.proto"]
+	assert.Contains(t, content, "enum Code")
+	assert.Contains(t, content, "enum Severity")
+	assert.Contains(t, content, "message Detail")
+	assert.NotContains(t, content, "enum Unused")
+	assert.Contains(t, result["api/service.proto"], "rpc Ping")
+
+	// 只设置 KeepEnums 时不保留任何方法
+	opts.MethodNames = nil
+	result, err = TrimWithOptions(opts)
+	require.NoError(t, err)
+	assert.Contains(t, result["status/codes.proto"], "enum Code")
+	assert.NotContains(t, result, "api/service.proto")
+
+	opts.KeepEnums = []string{"status.v1.Missing", "status.v1.Detail"}
+	_, err = TrimWithOptions(opts)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "enum 'status.v1.Missing' not found")
+	assert.Contains(t, err.Error(), "'status.v1.Detail' is a message in status/codes.proto, not an enum")
+}
+
+func TestTrimWithOptions_FileGranularity(t *testing.T) {
+	protoContents, err := LoadProtos([]string{"example/muit"})
+	require.NoError(t, err)
+	opts := Options{
+		EntryFiles:    []string{"api/v1/commerce_service.proto"},
+		MethodNames:   []string{"CommerceService.GetUser"},
+		ImportPaths:   []string{"example/muit"},
+		ProtoContents: protoContents,
+	}
+
+	count := func(report *TrimReport) (files, definitions int) {
+		for _, file := range report.Files {
+			if !file.Dropped {
+				files++
+			}
+			definitions += len(file.KeptMessages) + len(file.KeptEnums)
+		}
+		return files, definitions
+	}
+	minimal, err := Analyze(opts)
+	require.NoError(t, err)
+	minimalFiles, minimalDefs := count(minimal)
+
+	opts.FileGranularity = true
+	granular, err := Analyze(opts)
+	require.NoError(t, err)
+	granularFiles, granularDefs := count(granular)
+
+	// 按文件粒度保留时定义更多, 且保留文件中不再有被移除的消息或枚举
+	assert.Greater(t, granularDefs, minimalDefs)
+	assert.GreaterOrEqual(t, granularFiles, minimalFiles)
+	for _, file := range granular.Files {
+		if !file.Dropped {
+			assert.Empty(t, file.RemovedMessages, file.Path)
+			assert.Empty(t, file.RemovedEnums, file.Path)
+		}
+	}
+	assert.Equal(t, minimal.MatchedMethods, granular.MatchedMethods)
+
+	result, err := TrimWithOptions(opts)
+	require.NoError(t, err)
+	assert.Contains(t, result["example/muit/api/v1/commerce_service.proto"], "rpc GetUser")
+	assert.NotContains(t, result["example/muit/api/v1/commerce_service.proto"], "rpc GetOrder")
+	parseTrimmed(t, result, []string{"example/muit"}, "api/v1/commerce_service.proto")
+}
+
+func TestTrimWithOptions_KeepUnusedImports(t *testing.T) {
+	protoContents, err := LoadProtos([]string{"example/muit"})
+	require.NoError(t, err)
+	opts := Options{
+		EntryFiles:        []string{"api/v1/commerce_service.proto"},
+		MethodNames:       []string{"api.v1.CommerceService.PlaceOrder"},
+		KeepUnusedImports: true,
+		ImportPaths:       []string{"example/muit"},
+		ProtoContents:     protoContents,
+	}
+
+	result, err := TrimWithOptions(opts)
+	require.NoError(t, err)
+
+	// product.proto 仍被输出, 因此即使不再使用也保留对它的 import
+	require.Contains(t, result, "example/muit/services/product/product.proto")
+	serviceContent := result["example/muit/api/v1/commerce_service.proto"]
+	assert.Contains(t, serviceContent, `import "services/product/product.proto";`)
+	assert.Contains(t, serviceContent, `import "services/order/order.proto";`)
+	// 被整体裁掉的文件不会保留 import
+	assert.NotContains(t, result, "example/muit/services/user/user.proto")
+	assert.NotContains(t, serviceContent, `import "services/user/user.proto";`)
+
+	parseTrimmed(t, result, []string{"example/muit"}, "api/v1/commerce_service.proto")
+}
+
+func TestTrimWithOptions_Files(t *testing.T) {
+	protoContents, err := LoadProtos([]string{"example/muit"})
+	require.NoError(t, err)
+	opts := Options{
+		EntryFiles:    []string{"api/v1/commerce_service.proto"},
+		ImportPaths:   []string{"example/muit"},
+		ProtoContents: protoContents,
+	}
+	files, err := Parse(opts)
+	require.NoError(t, err)
+
+	// 解析一次, 多次裁剪, 结果与每次重新解析一致
+	for _, method := range []string{"CommerceService.GetUser", "CommerceService.GetOrder", "CommerceService.PlaceOrder"} {
+		opts.MethodNames = []string{method}
+		expected, err := TrimWithOptions(opts)
+		require.NoError(t, err)
+
+		parsed := opts
+		parsed.Files = files
+		result, err := TrimWithOptions(parsed)
+		require.NoError(t, err)
+		assert.Equal(t, expected, result, method)
+	}
+
+	_, err = TrimWithOptions(Options{EntryFiles: []string{"missing.proto"}, Files: files})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "entry file missing.proto not found in the given files")
+}
+
+func BenchmarkTrimWithOptions_Reparse(b *testing.B) {
+	opts, methods := benchmarkTrimOptions(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, method := range methods {
+			opts.MethodNames = []string{method}
+			if _, err := TrimWithOptions(opts); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkTrimWithOptions_ParsedFiles(b *testing.B) {
+	opts, methods := benchmarkTrimOptions(b)
+	files, err := Parse(opts)
+	if err != nil {
+		b.Fatal(err)
+	}
+	opts.Files = files
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, method := range methods {
+			opts.MethodNames = []string{method}
+			if _, err := TrimWithOptions(opts); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+// benchmarkTrimOptions returns a synthetic schema and the methods that are
+// trimmed from it one at a time.
+func benchmarkTrimOptions(b *testing.B) (Options, []string) {
+	protoContents, entryFiles := syntheticProtos(50)
+	opts := Options{EntryFiles: entryFiles, ImportPaths: []string{"synthetic"}, ProtoContents: protoContents}
+	methods := make([]string, 0, 10)
+	for i := 0; i < 10; i++ {
+		methods = append(methods, fmt.Sprintf("synthetic.svc%d.Service%d.Get", i, i))
+	}
+	return opts, methods
+}
+
+func TestTrimWithOptions_MaxDepth(t *testing.T) {
+	protoFiles := map[string]string{
+		"depth/detail.proto": `
+syntax = "proto3";
+package depth.v1;
+message Detail { string text = 1; }
+enum Level { LEVEL_UNSPECIFIED = 0; LEVEL_HIGH = 1; }`,
+		"depth/service.proto": `
+syntax = "proto3";
+package depth.v1;
+import "depth/detail.proto";
+
+service Catalog { rpc Get(Request) returns (Response); }
+
+message Request { string id = 1; }
+
+message Response {
+  repeated Item items = 1;
+}
+
+message Item {
+  string name = 1;
+  // 详情
+  Detail detail = 2;
+  map<string, Detail> details = 3;
+  oneof extra {
+    Detail extra_detail = 4;
+  }
+  optional Level level = 5;
+  // 备注
+  string note = 6;
+  oneof kind {
+    Detail kind_detail = 7;
+    string kind_name = 8;
+  }
+}`,
+	}
+	opts := Options{
+		EntryFiles:    []string{"depth/service.proto"},
+		MethodNames:   []string{"Catalog.Get"},
+		ProtoContents: protoFiles,
+	}
+
+	// 不限制深度时保留完整的传递闭包
+	result, err := TrimWithOptions(opts)
+	require.NoError(t, err)
+	assert.Len(t, result, 2)
+	assert.Contains(t, result["depth/service.proto"], "Detail detail = 2;")
+
+	// 深度 1: 只保留请求/响应及其字段直接引用的类型, 更深的字段被移除
+	depth := 1
+	opts.MaxDepth = &depth
+	result, err = TrimWithOptions(opts)
+	require.NoError(t, err)
+	require.Len(t, result, 1, "只被更深层引用的文件应被移除")
+	content := result["depth/service.proto"]
+	assert.NotContains(t, content, "import")
+	assert.NotContains(t, content, "detail")
+	assert.NotContains(t, content, "Detail")
+	assert.NotContains(t, content, "oneof extra")
+	assert.NotContains(t, content, "level")
+	assert.Contains(t, content, "// 备注\n  string note = 6;", "字段注释应随字段重新编号")
+
+	fds := parseTrimmed(t, result, nil, "depth/service.proto")
+	item := fds[0].FindMessage("depth.v1.Item")
+	require.NotNil(t, item)
+	var fields []string
+	for _, field := range item.GetFields() {
+		fields = append(fields, fmt.Sprintf("%s=%d", field.GetName(), field.GetNumber()))
+	}
+	assert.Equal(t, []string{"name=1", "note=6", "kind_name=8"}, fields, "保留的字段不重新编号")
+	require.Len(t, item.GetOneOfs(), 1)
+	assert.Equal(t, "kind", item.GetOneOfs()[0].GetName())
+	assert.Equal(t, "kind", item.FindFieldByName("kind_name").GetOneOf().GetName())
+	assert.Empty(t, item.GetNestedMessageTypes(), "被移除的 map 字段的条目类型也应移除")
+	assert.NotNil(t, fds[0].FindMessage("depth.v1.Response").FindFieldByName("items"))
+
+	// 深度 0: 只保留请求/响应消息本身
+	depth = 0
+	result, err = TrimWithOptions(opts)
+	require.NoError(t, err)
+	fds = parseTrimmed(t, result, nil, "depth/service.proto")
+	assert.NotNil(t, fds[0].FindMessage("depth.v1.Request"))
+	assert.Nil(t, fds[0].FindMessage("depth.v1.Item"))
+	response := fds[0].FindMessage("depth.v1.Response")
+	require.NotNil(t, response)
+	assert.Empty(t, response.GetFields())
+
+	depth = -1
+	_, err = TrimWithOptions(opts)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "MaxDepth must not be negative, got -1")
+}
+
+func TestTrimWithOptions_ExcludeTypes(t *testing.T) {
+	protoFiles := map[string]string{
+		"exclude/service.proto": `
+syntax = "proto3";
+package exclude.v1;
+
+service Users { rpc Get(Request) returns (User); }
+
+message Request { string id = 1; }
+
+message User {
+  string id = 1;
+  Internal internal = 2;
+  map<string, Internal> by_key = 3;
+  // 名称
+  string name = 4;
+}
+
+message Internal {
+  enum Kind { KIND_UNSPECIFIED = 0; }
+  Kind kind = 1;
+  Secret secret = 2;
+}
+
+message Secret { string value = 1; }`,
+	}
+	opts := Options{
+		EntryFiles:    []string{"exclude/service.proto"},
+		MethodNames:   []string{"Users.Get"},
+		ExcludeTypes:  []string{"exclude.v1.Internal"},
+		ProtoContents: protoFiles,
+	}
+
+	// 默认情况下, 引用被排除类型的字段会导致报错, 而不是输出悬空引用
+	_, err := TrimWithOptions(opts)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "field exclude.v1.User.internal references excluded type exclude.v1.Internal, set StripExcludedFields to remove such fields")
+	assert.Contains(t, err.Error(), "field exclude.v1.User.by_key references excluded type exclude.v1.Internal")
+	assert.NotContains(t, err.Error(), "ByKeyEntry")
+
+	// 开启 StripExcludedFields 后移除这些字段, 其余字段保持原编号
+	opts.StripExcludedFields = true
+	result, err := TrimWithOptions(opts)
+	require.NoError(t, err)
+	content := result["exclude/service.proto"]
+	assert.NotContains(t, content, "Internal")
+	assert.NotContains(t, content, "Secret", "只被排除类型引用的消息也应被移除")
+	assert.Contains(t, content, "// 名称\n  string name = 4;")
+
+	fds := parseTrimmed(t, result, nil, "exclude/service.proto")
+	user := fds[0].FindMessage("exclude.v1.User")
+	require.NotNil(t, user)
+	var fields []string
+	for _, field := range user.GetFields() {
+		fields = append(fields, fmt.Sprintf("%s=%d", field.GetName(), field.GetNumber()))
+	}
+	assert.Equal(t, []string{"id=1", "name=4"}, fields)
+
+	opts.ExcludeTypes = []string{"exclude.v1.User"}
+	_, err = TrimWithOptions(opts)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "method exclude.v1.Users.Get uses excluded type exclude.v1.User")
+
+	opts.ExcludeTypes = []string{"exclude.v1.Missing", "exclude.v1.Users"}
+	_, err = TrimWithOptions(opts)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "type 'exclude.v1.Missing' not found")
+	assert.Contains(t, err.Error(), "'exclude.v1.Users' is a service in exclude/service.proto, not a message or enum")
+}
+
+func TestTrimWithOptions_AnyTypes(t *testing.T) {
+	protoFiles := map[string]string{
+		"anys/event.proto": `
+syntax = "proto3";
+package anys.v1;
+import "google/protobuf/any.proto";
+service Events { rpc Publish(Event) returns (Event); }
+message Event {
+  string id = 1;
+  google.protobuf.Any payload = 2;
+}`,
+		"anys/payloads.proto": `
+syntax = "proto3";
+package anys.v1;
+message UserCreated { string user_id = 1; Profile profile = 2; }
+message Profile { string name = 1; }
+message OrderPlaced { string order_id = 1; }`,
+	}
+	opts := Options{
+		EntryFiles:    []string{"anys/event.proto", "anys/payloads.proto"},
+		MethodNames:   []string{"Events.Publish"},
+		ProtoContents: protoFiles,
+	}
+
+	// 未标注时 Any 是不透明的, 具体类型所在文件被整体移除
+	result, err := TrimWithOptions(opts)
+	require.NoError(t, err)
+	assert.NotContains(t, result, "anys/payloads.proto")
+
+	// 标注后具体类型及其依赖随 Any 字段一起保留
+	opts.AnyTypes = map[string][]string{"anys.v1.Event.payload": {"anys.v1.UserCreated"}}
+	result, err = TrimWithOptions(opts)
+	require.NoError(t, err)
+	content := result["anys/payloads.proto"]
+	assert.Contains(t, content, "message UserCreated {")
+	assert.Contains(t, content, "message Profile {")
+	assert.NotContains(t, content, "OrderPlaced")
+
+	graph, err := BuildDependencyGraph(opts)
+	require.NoError(t, err)
+	assert.Contains(t, graph.Edges, GraphEdge{From: "anys.v1.Event", To: "anys.v1.UserCreated"})
+
+	opts.AnyTypes = map[string][]string{
+		"anys.v1.Event.id":      {"anys.v1.UserCreated"},
+		"anys.v1.Event.payload": {"anys.v1.Missing"},
+	}
+	_, err = TrimWithOptions(opts)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "field 'anys.v1.Event.id' is not a google.protobuf.Any")
+	assert.Contains(t, err.Error(), "message 'anys.v1.Missing' not found")
+}
+
+func TestTrimWithOptions_NormalizeOutput(t *testing.T) {
+	source := strings.Join([]string{
+		`syntax = "proto3";`,
+		`package crlf.v1;`,
+		`// 服务注释   `,
+		`service Api { rpc Get(Req) returns (Req); }`,
+		`// 多行注释`,
+		`// 第二行	`,
+		`message Req { string id = 1; }`,
+	}, "\r\n")
+	opts := Options{
+		EntryFiles:    []string{"crlf/service.proto"},
+		ProtoContents: map[string]string{"crlf/service.proto": source},
+	}
+
+	// 未开启时, 注释中的 CR 和行尾空白会原样进入输出
+	result, err := TrimWithOptions(opts)
+	require.NoError(t, err)
+	require.Contains(t, result["crlf/service.proto"], "\r")
+
+	opts.NormalizeOutput = true
+	result, err = TrimWithOptions(opts)
+	require.NoError(t, err)
+	content := result["crlf/service.proto"]
+	assert.NotContains(t, content, "\r")
+	for _, line := range strings.Split(content, "\n") {
+		assert.Equal(t, strings.TrimRight(line, " \t"), line, "行尾不应有空白")
+	}
+	assert.Contains(t, content, "// 服务注释\nservice Api {")
+	assert.Contains(t, content, "// 多行注释\n// 第二行\nmessage Req {")
+
+	// 流式输出与合并输出同样被规范化
+	err = TrimEach(opts, func(path string, r io.Reader) error {
+		streamed, err := io.ReadAll(r)
+		require.NoError(t, err)
+		assert.Equal(t, content, string(streamed))
+		return nil
+	})
+	require.NoError(t, err)
+	merged, err := TrimToSingleFile(opts, "merged.proto")
+	require.NoError(t, err)
+	assert.NotContains(t, merged, "\r")
+}
+
+func TestTrimWithOptions_CommentScope(t *testing.T) {
+	opts := Options{
+		EntryFiles:  []string{"docs/service.proto"},
+		MethodNames: []string{"Api.Get"},
+		ProtoContents: map[string]string{"docs/service.proto": `
+// 文件头注释
+syntax = "proto3";
+package docs.v1;
+
+// 服务注释
+service Api {
+  // 获取资源
+  rpc Get(GetRequest) returns (GetResponse);
+}
+
+// 请求
+message GetRequest {
+  // 资源 ID
+  string id = 1;
+  // 嵌套过滤条件
+  message Filter {
+    // 过滤字段
+    string field = 1;
+  }
+  Filter filter = 2;
+}
+
+// 响应
+message GetResponse {
+  // 资源
+  Resource resource = 1; // 行尾注释
+}
+
+// 资源
+message Resource {
+  // 名称
+  string name = 1;
+  // 状态
+  State state = 2;
+}
+
+// 状态
+enum State {
+  // 未知
+  STATE_UNSPECIFIED = 0;
+}`},
+	}
+	allComments := []string{
+		"// 文件头注释", "// 服务注释", "// 获取资源", "// 请求", "// 资源 ID", "// 嵌套过滤条件",
+		"// 过滤字段", "// 响应", "// 行尾注释", "// 资源\nmessage Resource", "// 名称", "// 状态", "// 未知",
+	}
+
+	// 默认保留全部注释
+	result, err := TrimWithOptions(opts)
+	require.NoError(t, err)
+	for _, comment := range allComments {
+		assert.Contains(t, result["docs/service.proto"], comment)
+	}
+
+	// 只保留入口方法及其请求、响应消息 (含字段与嵌套类型) 的注释
+	opts.CommentScope = CommentScopeEntryOnly
+	result, err = TrimWithOptions(opts)
+	require.NoError(t, err)
+	content := result["docs/service.proto"]
+	for _, comment := range []string{"// 获取资源", "// 请求", "// 资源 ID", "// 嵌套过滤条件", "// 过滤字段", "// 响应", "// 行尾注释"} {
+		assert.Contains(t, content, comment)
+	}
+	for _, comment := range []string{"// 文件头注释", "// 服务注释", "// 资源\nmessage Resource", "// 名称", "// 状态", "// 未知"} {
+		assert.NotContains(t, content, comment)
+	}
+	assert.Contains(t, content, "message Resource")
+	assert.Contains(t, content, "enum State")
+
+	// 丢弃所有注释
+	opts.CommentScope = CommentScopeNone
+	result, err = TrimWithOptions(opts)
+	require.NoError(t, err)
+	content = result["docs/service.proto"]
+	assert.NotContains(t, content, "//")
+	assert.Contains(t, content, "rpc Get ( GetRequest ) returns ( GetResponse );")
+	assert.Contains(t, content, "message Filter")
+}
+
+func TestTrimWithOptions_SortElements(t *testing.T) {
+	opts := Options{
+		EntryFiles: []string{"sorted/service.proto"},
+		ProtoContents: map[string]string{"sorted/service.proto": `
+syntax = "proto3";
+package sorted.v1;
+service Zeta { rpc Get(Beta) returns (Alpha); }
+enum Kind { KIND_UNSPECIFIED = 0; }
+message Beta { Kind kind = 2; string id = 1; }
+service Admin { rpc Put(Alpha) returns (Beta); }
+message Alpha {}`},
+	}
+	order := func(content string, elements ...string) []int {
+		positions := make([]int, len(elements))
+		for i, element := range elements {
+			positions[i] = strings.Index(content, element)
+			require.NotEqual(t, -1, positions[i], element)
+		}
+		return positions
+	}
+
+	// 默认保持声明顺序
+	result, err := TrimWithOptions(opts)
+	require.NoError(t, err)
+	positions := order(result["sorted/service.proto"], "service Zeta", "enum Kind", "message Beta", "service Admin", "message Alpha")
+	assert.IsIncreasing(t, positions)
+
+	// 开启后先消息、再枚举、最后服务, 各自按名称排序, 字段按编号排序
+	opts.SortElements = true
+	result, err = TrimWithOptions(opts)
+	require.NoError(t, err)
+	content := result["sorted/service.proto"]
+	positions = order(content, "message Alpha", "message Beta", "string id = 1;", "Kind kind = 2;", "enum Kind", "service Admin", "service Zeta")
+	assert.IsIncreasing(t, positions)
+
+	merged, err := TrimToSingleFile(opts, "merged.proto")
+	require.NoError(t, err)
+	assert.IsIncreasing(t, order(merged, "message Alpha", "message Beta", "enum Kind", "service Admin", "service Zeta"))
+}
+
+func TestTrimWithOptions_OmitSourceInfo(t *testing.T) {
+	opts := Options{
+		EntryFiles:    []string{"project.proto"},
+		MethodNames:   []string{"ProjectService.CreateProject"},
+		ImportPaths:   []string{"example"},
+		ProtoContents: loadProtoFiles(t, "example", "project.proto", "common.proto", "domain/user.proto"),
+	}
+	withComments, err := TrimWithOptions(opts)
+	require.NoError(t, err)
+	require.Contains(t, withComments["example/project.proto"], "// 我们关心的服务")
+
+	opts.OmitSourceInfo = true
+	result, err := TrimWithOptions(opts)
+	require.NoError(t, err)
+	require.Len(t, result, len(withComments))
+	for path, content := range result {
+		assert.NotContains(t, content, "//", path)
+	}
+	assert.Contains(t, result["example/project.proto"], "rpc CreateProject ( CreateProjectRequest ) returns ( CreateProjectResponse );")
+
+	// 描述符中也不再带有源码信息, 包括来自已解析文件的
+	fileSet, err := TrimToDescriptorSet(opts)
+	require.NoError(t, err)
+	files, err := Parse(Options{EntryFiles: opts.EntryFiles, ImportPaths: opts.ImportPaths, ProtoContents: opts.ProtoContents})
+	require.NoError(t, err)
+	opts.Files = files
+	parsedSet, err := TrimToDescriptorSet(opts)
+	require.NoError(t, err)
+	for _, fp := range append(fileSet.GetFile(), parsedSet.GetFile()...) {
+		assert.Nil(t, fp.GetSourceCodeInfo(), fp.GetName())
+	}
+}
+
+func BenchmarkTrimWithOptions_SourceInfo(b *testing.B) {
+	opts, _ := benchmarkTrimOptions(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := TrimWithOptions(opts); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkTrimWithOptions_OmitSourceInfo(b *testing.B) {
+	opts, _ := benchmarkTrimOptions(b)
+	opts.OmitSourceInfo = true
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := TrimWithOptions(opts); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestTrimWithOptions_KeepPackages(t *testing.T) {
+	opts := Options{
+		EntryFiles:   []string{"api/service.proto"},
+		MethodNames:  []string{"Api.Get"},
+		KeepPackages: []string{"common.v1"},
+		ProtoContents: map[string]string{
+			"common/types.proto": `
+syntax = "proto3";
+package common.v1;
+import "billing/types.proto";
+message Used { string id = 1; }
+message Orphan { billing.v1.Invoice invoice = 1; }
+enum Color { COLOR_UNSPECIFIED = 0; }
+service Health { rpc Check(Used) returns (Used); }`,
+			"common/more.proto": `
+syntax = "proto3";
+package common.v1;
+message Extra {}`,
+			"billing/types.proto": `
+syntax = "proto3";
+package billing.v1;
+message Invoice { string number = 1; }
+message Unused {}`,
+			"api/service.proto": `
+syntax = "proto3";
+package api.v1;
+import "common/types.proto";
+import "common/more.proto";
+import "billing/types.proto";
+service Api {
+  rpc Get(common.v1.Used) returns (common.v1.Used);
+  rpc Bill(billing.v1.Unused) returns (billing.v1.Unused);
+}`,
+		},
+	}
+
+	// 保留的包整体保留, 其他包仍按引用裁剪
+	result, err := TrimWithOptions(opts)
+	require.NoError(t, err)
+	common := result["common/types.proto"]
+	for _, definition := range []string{"message Used", "message Orphan", "enum Color", "service Health", "rpc Check"} {
+		assert.Contains(t, common, definition)
+	}
+	assert.Contains(t, result["common/more.proto"], "message Extra")
+	billing := result["billing/types.proto"]
+	assert.Contains(t, billing, "message Invoice", "被保留包中的消息引用的类型也要保留")
+	assert.NotContains(t, billing, "message Unused")
+	assert.NotContains(t, result["api/service.proto"], "rpc Bill")
+
+	opts.KeepPackages = []string{"missing.v1"}
+	_, err = TrimWithOptions(opts)
+	assert.EqualError(t, err, "package missing.v1 not found in the entry files or their imports")
+}
+
+func TestTrimWithOptions_PackageRenames(t *testing.T) {
+	opts := Options{
+		EntryFiles:     []string{"project.proto"},
+		MethodNames:    []string{"ProjectService.CreateProject", "ProjectService.GetProjectDetails"},
+		ImportPaths:    []string{"example"},
+		ProtoContents:  loadProtoFiles(t, "example", "project.proto", "common.proto", "domain/user.proto"),
+		PackageRenames: map[string]string{"project.v1": "extracted.v1"},
+	}
+	result, err := TrimWithOptions(opts)
+	require.NoError(t, err)
+
+	project := result["example/project.proto"]
+	assert.Contains(t, project, "package extracted.v1;")
+	assert.Contains(t, project, `option go_package = "example/extractedv1";`)
+	assert.Contains(t, result["example/common.proto"], "package extracted.v1;")
+	// 子包不在映射中, 保持原样
+	assert.Contains(t, result["example/domain/user.proto"], "package project.v1.user;")
+	assert.Contains(t, result["example/domain/user.proto"], `option go_package = "example/projectv1/user";`)
+
+	// 重新解析后, 所有类型引用都指向新包中的定义
+	fds := parseTrimmed(t, result, []string{"example"}, "project.proto")
+	service := fds[0].FindService("extracted.v1.ProjectService")
+	require.NotNil(t, service)
+	create := service.FindMethodByName("CreateProject")
+	assert.Equal(t, "extracted.v1.CreateProjectRequest", create.GetInputType().GetFullyQualifiedName())
+	details := service.FindMethodByName("GetProjectDetails")
+	assert.Equal(t, "project.v1.user.PersonalInfo", details.GetInputType().GetFullyQualifiedName())
+	projectMsg := fds[0].FindMessage("extracted.v1.Project")
+	require.NotNil(t, projectMsg)
+	assert.Equal(t, "extracted.v1.Status", projectMsg.FindFieldByName("status").GetEnumType().GetFullyQualifiedName())
+	assert.Equal(t, "project.v1.user.User", projectMsg.FindFieldByName("owner").GetMessageType().GetFullyQualifiedName())
+}
+
+func TestTrimWithOptions_Verify(t *testing.T) {
+	protoContents := loadProtoFiles(t, "example", "project.proto", "common.proto", "domain/user.proto")
+	protoContents["example/audit.proto"] = `
+syntax = "proto3";
+package audit;
+import "google/protobuf/timestamp.proto";
+import "project.proto";
+service AuditService {
+  rpc Record(project.v1.CreateProjectRequest) returns (google.protobuf.Timestamp);
+}`
+	opts := Options{
+		EntryFiles:    []string{"audit.proto", "project.proto"},
+		MethodNames:   []string{"AuditService.Record", "ProjectService.GetProjectDetails"},
+		ImportPaths:   []string{"example"},
+		ProtoContents: protoContents,
+	}
+	want, err := TrimWithOptions(opts)
+	require.NoError(t, err)
+
+	// 校验通过时结果不变，未输出的标准文件由解析器提供
+	opts.Verify = true
+	result, err := TrimWithOptions(opts)
+	require.NoError(t, err)
+	assert.Equal(t, want, result)
+
+	streamed := make(map[string]string)
+	err = TrimEach(opts, func(path string, r io.Reader) error {
+		content, err := io.ReadAll(r)
+		streamed[path] = string(content)
+		return err
+	})
+	require.NoError(t, err)
+	assert.Equal(t, want, streamed)
+
+	// 无法解析的输出会报错
+	err = opts.verifyOutputs(map[string]string{"broken.proto": `syntax = "proto3"; message A { Missing m = 1; }`}, nil)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "trimmed output does not parse")
+	assert.Contains(t, err.Error(), "Missing")
+}
+
+func TestTrimWithOptions_Parser(t *testing.T) {
+	var reported []string
+	opts := Options{
+		EntryFiles: []string{"bad.proto"},
+		ProtoContents: map[string]string{"bad.proto": `
+syntax = "proto3";
+message A { Missing a = 1; }
+message B { AlsoMissing b = 1; }`},
+		Parser: &protoparse.Parser{
+			ErrorReporter: func(err protoparse.ErrorWithPos) error {
+				reported = append(reported, err.Error())
+				return nil // 继续解析以收集全部错误
+			},
+		},
+	}
+	_, err := TrimWithOptions(opts)
+	require.Error(t, err)
+	require.Len(t, reported, 2)
+	assert.Contains(t, reported[0], "Missing")
+	assert.Contains(t, reported[1], "AlsoMissing")
+
+	// 其余设置照常生效，调用方的 Parser 不被修改
+	opts.ProtoContents = map[string]string{"ok.proto": `syntax = "proto3"; service S { rpc Get(Req) returns (Req); } message Req {}`}
+	opts.EntryFiles = []string{"ok.proto"}
+	result, err := TrimWithOptions(opts)
+	require.NoError(t, err)
+	assert.Contains(t, result["ok.proto"], "rpc Get")
+	assert.Nil(t, opts.Parser.Accessor)
+}
+
+func TestTrimWithOptions_ExcludeFiles(t *testing.T) {
+	opts := Options{
+		EntryFiles:    []string{"project.proto"},
+		MethodNames:   []string{"ProjectService.CreateProject"},
+		ImportPaths:   []string{"example"},
+		ProtoContents: loadProtoFiles(t, "example", "project.proto", "common.proto", "domain/user.proto"),
+		ExcludeFiles:  []string{"common.proto"},
+	}
+	result, err := TrimWithOptions(opts)
+	require.NoError(t, err)
+
+	// 被排除的文件不输出, 引用它的文件仍保留 import
+	assert.NotContains(t, result, "example/common.proto")
+	assert.Contains(t, result, "example/domain/user.proto")
+	assert.Contains(t, result["example/project.proto"], `import "common.proto";`)
+	assert.Contains(t, result["example/project.proto"], "Status status")
+
+	files, err := RequiredFilesWithOptions(opts)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"example/domain/user.proto", "example/project.proto"}, files)
+
+	// 描述符集仍包含被排除的文件, 以保持自洽
+	fileSet, err := TrimToDescriptorSet(opts)
+	require.NoError(t, err)
+	var names []string
+	for _, fp := range fileSet.GetFile() {
+		names = append(names, fp.GetName())
+	}
+	assert.Contains(t, names, "common.proto")
+
+	// 与 Verify 同时使用时, 被排除的文件仍可供校验解析
+	opts.Verify = true
+	verified, err := TrimWithOptions(opts)
+	require.NoError(t, err)
+	assert.Equal(t, result, verified)
+	opts.Verify = false
+
+	// 找不到的文件名会报错
+	opts.ExcludeFiles = []string{"missing.proto"}
+	_, err = TrimWithOptions(opts)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "excluded file 'missing.proto' not found")
+}
+
+func TestTrimWithOptions_StrictMethodNames(t *testing.T) {
+	protoFiles := map[string]string{
+		"a/users.proto": `
+syntax = "proto3";
+package a.v1;
+import "b/users.proto";
+service Users { rpc Get(Req) returns (Req); }
+message Req { b.v1.Req other = 1; }`,
+		"b/users.proto": `
+syntax = "proto3";
+package b.v1;
+service Users { rpc Get(Req) returns (Req); }
+message Req {}`,
+	}
+	opts := Options{
+		EntryFiles:    []string{"a/users.proto"},
+		MethodNames:   []string{"Users.Get"},
+		ProtoContents: protoFiles,
+	}
+
+	// 默认情况下优先使用入口文件中的服务
+	result, err := TrimWithOptions(opts)
+	require.NoError(t, err)
+	assert.Contains(t, result["a/users.proto"], "rpc Get")
+	assert.NotContains(t, result["b/users.proto"], "service Users")
+
+	// 严格模式下, 其他包中的同名服务使名称有歧义
+	opts.StrictMethodNames = true
+	_, err = TrimWithOptions(opts)
+	var ambiguous *AmbiguousMethodError
+	require.True(t, errors.As(err, &ambiguous), "%v", err)
+	assert.Equal(t, "Users.Get", ambiguous.Name)
+	assert.Equal(t, []string{"a/users.proto", "b/users.proto"}, ambiguous.Matches)
+
+	// 全限定名仍然唯一
+	opts.MethodNames = []string{"a.v1.Users.Get"}
+	result, err = TrimWithOptions(opts)
+	require.NoError(t, err)
+	assert.Contains(t, result["a/users.proto"], "rpc Get")
+}
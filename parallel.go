@@ -0,0 +1,50 @@
+package trimpb
+
+import (
+	"runtime"
+	"sync"
+)
+
+// forEachParallel calls fn for every index in [0, n) using at most
+// GOMAXPROCS goroutines, and returns the error of the lowest failing index.
+func forEachParallel(n int, fn func(i int) error) error {
+	return forEachParallelN(n, runtime.GOMAXPROCS(0), fn)
+}
+
+// forEachParallelN is forEachParallel with an explicit worker bound; a bound
+// of one runs fn serially in index order.
+func forEachParallelN(n, workers int, fn func(i int) error) error {
+	if workers > n {
+		workers = n
+	}
+	errs := make([]error, n)
+	if workers <= 1 {
+		for i := 0; i < n; i++ {
+			errs[i] = fn(i)
+		}
+	} else {
+		indices := make(chan int)
+		var wg sync.WaitGroup
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := range indices {
+					errs[i] = fn(i)
+				}
+			}()
+		}
+		for i := 0; i < n; i++ {
+			indices <- i
+		}
+		close(indices)
+		wg.Wait()
+	}
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package trimpb
+
+import (
+	"sort"
+
+	"github.com/jhump/protoreflect/desc"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// Field numbers of DescriptorProto used in SourceCodeInfo paths below a
+// message.
+const (
+	messageFieldField      = 2
+	messageNestedTypeField = 3
+	messageEnumTypeField   = 4
+	messageOneofDeclField  = 8
+)
+
+// fieldPruning records what pruneFields removed from a message, by original
+// index, so the paths of its comments can be renumbered.
+type fieldPruning struct {
+	fields []int32 // Fields whose type is not emitted
+	nested []int32 // Excluded nested messages and map entries of removed map fields
+	enums  []int32 // Excluded nested enums
+	oneofs []int32 // Oneofs left without any field
+	kept   map[int32]*fieldPruning
+}
+
+// isEmitted reports whether the message or enum d appears in the output,
+// either because it is required or because it is nested in an emitted
+// message, and is not excluded.
+func (t *trimmer) isEmitted(d desc.Descriptor) bool {
+	if t.isExcluded(d) {
+		return false
+	}
+	switch d := d.(type) {
+	case *desc.MessageDescriptor:
+		if _, ok := t.requiredMessages[d.Unwrap().FullName()]; ok {
+			return true
+		}
+	case *desc.EnumDescriptor:
+		if _, ok := t.requiredEnums[d.Unwrap().FullName()]; ok {
+			return true
+		}
+	}
+	parent, ok := d.GetParent().(*desc.MessageDescriptor)
+	return ok && t.isEmitted(parent)
+}
+
+// isFieldTypeEmitted reports whether the type of field, or the value type of a
+// map field, appears in the output. Scalar fields always do.
+func (t *trimmer) isFieldTypeEmitted(field *desc.FieldDescriptor) bool {
+	typ := fieldType(field)
+	return typ == nil || t.isEmitted(typ)
+}
+
+// pruneFields removes from mp, the copy of md being emitted, the fields whose
+// type was not collected, such as those beyond MaxDepth or of an excluded
+// type, together with the map entries and oneofs they leave unused and the
+// excluded nested types. Remaining fields keep their numbers. It returns nil
+// when nothing was removed.
+func (t *trimmer) pruneFields(md *desc.MessageDescriptor, mp *descriptorpb.DescriptorProto) *fieldPruning {
+	pr := &fieldPruning{kept: make(map[int32]*fieldPruning)}
+	removed := make(map[*desc.FieldDescriptor]struct{})
+	removedEntries := make(map[*desc.MessageDescriptor]struct{})
+	for i, field := range md.GetFields() {
+		if !t.isFieldTypeEmitted(field) {
+			pr.fields = append(pr.fields, int32(i))
+			removed[field] = struct{}{}
+			if field.IsMap() {
+				removedEntries[field.GetMessageType()] = struct{}{}
+			}
+		}
+	}
+	for i, nested := range md.GetNestedMessageTypes() {
+		if _, ok := removedEntries[nested]; ok || t.isExcluded(nested) {
+			pr.nested = append(pr.nested, int32(i))
+		} else if np := t.pruneFields(nested, mp.NestedType[i]); np != nil {
+			pr.kept[int32(i)] = np
+		}
+	}
+	for i, enum := range md.GetNestedEnumTypes() {
+		if t.isExcluded(enum) {
+			pr.enums = append(pr.enums, int32(i))
+		}
+	}
+	for i, oneof := range md.GetOneOfs() {
+		empty := true
+		for _, choice := range oneof.GetChoices() {
+			if _, ok := removed[choice]; !ok {
+				empty = false
+			}
+		}
+		if empty {
+			pr.oneofs = append(pr.oneofs, int32(i))
+		}
+	}
+	if len(pr.fields) == 0 && len(pr.nested) == 0 && len(pr.enums) == 0 && len(pr.oneofs) == 0 && len(pr.kept) == 0 {
+		return nil
+	}
+
+	fields := mp.Field[:0]
+	for i, field := range mp.Field {
+		if _, ok := renumber(pr.fields, int32(i)); !ok {
+			continue
+		}
+		if field.OneofIndex != nil {
+			index, _ := renumber(pr.oneofs, field.GetOneofIndex())
+			field.OneofIndex = &index
+		}
+		fields = append(fields, field)
+	}
+	mp.Field = fields
+	nestedTypes := mp.NestedType[:0]
+	for i, nested := range mp.NestedType {
+		if _, ok := renumber(pr.nested, int32(i)); ok {
+			nestedTypes = append(nestedTypes, nested)
+		}
+	}
+	mp.NestedType = nestedTypes
+	enums := mp.EnumType[:0]
+	for i, enum := range mp.EnumType {
+		if _, ok := renumber(pr.enums, int32(i)); ok {
+			enums = append(enums, enum)
+		}
+	}
+	mp.EnumType = enums
+	oneofs := mp.OneofDecl[:0]
+	for i, oneof := range mp.OneofDecl {
+		if _, ok := renumber(pr.oneofs, int32(i)); ok {
+			oneofs = append(oneofs, oneof)
+		}
+	}
+	mp.OneofDecl = oneofs
+	return pr
+}
+
+// remap renumbers path, relative to the pruned message, in place. It reports
+// false when path belongs to a removed element.
+func (pr *fieldPruning) remap(path []int32) bool {
+	if pr == nil || len(path) < 2 {
+		return true
+	}
+	var ok bool
+	switch path[0] {
+	case messageFieldField:
+		path[1], ok = renumber(pr.fields, path[1])
+		return ok
+	case messageNestedTypeField:
+		nested := pr.kept[path[1]]
+		if path[1], ok = renumber(pr.nested, path[1]); !ok {
+			return false
+		}
+		return nested.remap(path[2:])
+	case messageEnumTypeField:
+		path[1], ok = renumber(pr.enums, path[1])
+		return ok
+	case messageOneofDeclField:
+		path[1], ok = renumber(pr.oneofs, path[1])
+		return ok
+	}
+	return true
+}
+
+// renumber returns the index that index takes once the ascending indexes in
+// removed are gone, or false when index itself was removed.
+func renumber(removed []int32, index int32) (int32, bool) {
+	n := sort.Search(len(removed), func(i int) bool { return removed[i] >= index })
+	if n < len(removed) && removed[n] == index {
+		return 0, false
+	}
+	return index - int32(n), true
+}
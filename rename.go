@@ -0,0 +1,116 @@
+package trimpb
+
+import (
+	"path"
+	"strings"
+
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// renamePackages moves the files whose package is a key of renames to the
+// corresponding package. Every type reference to a definition of a renamed
+// package is rewritten to its new name, as is the go_package option of the
+// renamed files.
+func renamePackages(fileProtos []*descriptorpb.FileDescriptorProto, renames map[string]string) {
+	if len(renames) == 0 {
+		return
+	}
+
+	// The package declaring every type, keyed by its reference name
+	typePackages := make(map[string]string)
+	for _, fp := range fileProtos {
+		var addMessages func(prefix string, mps []*descriptorpb.DescriptorProto)
+		addMessages = func(prefix string, mps []*descriptorpb.DescriptorProto) {
+			for _, mp := range mps {
+				name := prefix + "." + mp.GetName()
+				typePackages[name] = fp.GetPackage()
+				for _, ep := range mp.GetEnumType() {
+					typePackages[name+"."+ep.GetName()] = fp.GetPackage()
+				}
+				addMessages(name, mp.GetNestedType())
+			}
+		}
+		prefix := packagePrefix(fp.GetPackage())
+		addMessages(prefix, fp.GetMessageType())
+		for _, ep := range fp.GetEnumType() {
+			typePackages[prefix+"."+ep.GetName()] = fp.GetPackage()
+		}
+	}
+	rename := func(typeName *string) {
+		pkg, ok := typePackages[*typeName]
+		if !ok {
+			return
+		}
+		if newPkg, ok := renames[pkg]; ok {
+			*typeName = packagePrefix(newPkg) + strings.TrimPrefix(*typeName, packagePrefix(pkg))
+		}
+	}
+	renameFields := func(fields []*descriptorpb.FieldDescriptorProto) {
+		for _, field := range fields {
+			if field.TypeName != nil {
+				rename(field.TypeName)
+			}
+			if field.Extendee != nil {
+				rename(field.Extendee)
+			}
+		}
+	}
+	var renameMessages func(mps []*descriptorpb.DescriptorProto)
+	renameMessages = func(mps []*descriptorpb.DescriptorProto) {
+		for _, mp := range mps {
+			renameFields(mp.GetField())
+			renameFields(mp.GetExtension())
+			renameMessages(mp.GetNestedType())
+		}
+	}
+
+	for _, fp := range fileProtos {
+		renameMessages(fp.GetMessageType())
+		renameFields(fp.GetExtension())
+		for _, sp := range fp.GetService() {
+			for _, mp := range sp.GetMethod() {
+				rename(mp.InputType)
+				rename(mp.OutputType)
+			}
+		}
+		if newPkg, ok := renames[fp.GetPackage()]; ok {
+			if fp.Options != nil && fp.Options.GoPackage != nil {
+				fp.Options.GoPackage = stringPtr(renameGoPackage(fp.Options.GetGoPackage(), fp.GetPackage(), newPkg))
+			}
+			fp.Package = stringPtr(newPkg)
+		}
+	}
+}
+
+// packagePrefix returns the prefix of the reference names of the types
+// declared in pkg, such as ".pkg" for ".pkg.Type".
+func packagePrefix(pkg string) string {
+	if pkg == "" {
+		return ""
+	}
+	return "." + pkg
+}
+
+// renameGoPackage rewrites a go_package option for a file moved from package
+// oldPkg to newPkg. An import path ending in the old package as directories,
+// such as project/v1, or as a single name without dots, such as projectv1,
+// has that suffix replaced by the same form of the new package, and so does
+// an explicit package name after a semicolon. Other values are kept as is.
+func renameGoPackage(goPackage, oldPkg, newPkg string) string {
+	importPath, name, hasName := strings.Cut(goPackage, ";")
+	oldDir, newDir := strings.ReplaceAll(oldPkg, ".", "/"), strings.ReplaceAll(newPkg, ".", "/")
+	oldName, newName := strings.ReplaceAll(oldPkg, ".", ""), strings.ReplaceAll(newPkg, ".", "")
+	switch {
+	case importPath == oldDir || strings.HasSuffix(importPath, "/"+oldDir):
+		importPath = strings.TrimSuffix(importPath, oldDir) + newDir
+	case path.Base(importPath) == oldName:
+		importPath = strings.TrimSuffix(importPath, oldName) + newName
+	}
+	if hasName && name == oldName {
+		name = newName
+	}
+	if hasName {
+		return importPath + ";" + name
+	}
+	return importPath
+}
@@ -0,0 +1,19 @@
+package trimpb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenameGoPackage(t *testing.T) {
+	for goPackage, want := range map[string]string{
+		"example/projectv1":              "example/extractedv1",
+		"example/projectv1;projectv1":    "example/extractedv1;extractedv1",
+		"github.com/acme/gen/project/v1": "github.com/acme/gen/extracted/v1",
+		"project/v1;pb":                  "extracted/v1;pb",
+		"github.com/acme/other":          "github.com/acme/other",
+	} {
+		assert.Equal(t, want, renameGoPackage(goPackage, "project.v1", "extracted.v1"), goPackage)
+	}
+}
@@ -0,0 +1,181 @@
+package trimpb
+
+import (
+	"context"
+	"sort"
+
+	"github.com/jhump/protoreflect/desc"
+)
+
+// TrimReport summarizes what a trim would keep and remove, without producing
+// any output files.
+type TrimReport struct {
+	// MatchedMethods lists the fully-qualified names of the entry-point methods.
+	MatchedMethods []string
+	// Files holds one entry per parsed file, sorted by path.
+	Files []FileReport
+}
+
+// FileReport lists the top-level definitions of one file that a trim keeps
+// and removes, by fully-qualified name.
+type FileReport struct {
+	// Path is the file's key in Options.ProtoContents.
+	Path string
+	// Dropped reports whether the file is left out of the output entirely.
+	Dropped bool
+
+	KeptMessages    []string
+	RemovedMessages []string
+	KeptEnums       []string
+	RemovedEnums    []string
+	KeptMethods     []string
+	RemovedMethods  []string
+}
+
+// Analyze runs the dependency collection for opts and reports, per file, which
+// definitions would be kept or removed. Nothing is printed, which makes it a
+// cheap dry run before a large trim. Files the trim would not return, such as
+// those in ExcludeFiles or well-known files left as external imports, are
+// reported as dropped.
+func Analyze(opts Options) (*TrimReport, error) {
+	entryFds, allFds, err := opts.parse()
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := resolveTrimmer(entryFds, allFds, opts)
+	if err != nil {
+		return nil, err
+	}
+	newFds, err := t.buildFiles()
+	if err != nil {
+		return nil, err
+	}
+	return newTrimReport(t, allFds, opts.isEmittedFile(newFds)), nil
+}
+
+// isEmittedFile returns a function reporting whether the contents of a parsed
+// file are part of the output built from the trimmed files newFds, leaving out
+// the excluded and external files.
+func (opts Options) isEmittedFile(newFds map[string]*desc.FileDescriptor) func(fd *desc.FileDescriptor) bool {
+	emitted := opts.withoutExternalFiles(newFds)
+	return func(fd *desc.FileDescriptor) bool {
+		_, ok := emitted[opts.rewriteImport(fd.GetName())]
+		return ok
+	}
+}
+
+// newTrimReport reports the definitions t keeps and removes in every file of
+// allFds, using kept to tell which files make it into the output.
+func newTrimReport(t *trimmer, allFds []*desc.FileDescriptor, kept func(fd *desc.FileDescriptor) bool) *TrimReport {
+	report := &TrimReport{}
+	keptMethods := make(map[*desc.MethodDescriptor]struct{}, len(t.entryPointMethods))
+	for _, method := range t.entryPointMethods {
+		keptMethods[method] = struct{}{}
+		report.MatchedMethods = append(report.MatchedMethods, method.GetFullyQualifiedName())
+	}
+
+	for _, fd := range allFds {
+		fileReport := FileReport{
+			Path:    t.opts.realPath(fd.GetName()),
+			Dropped: !kept(fd),
+		}
+		for _, msg := range fd.GetMessageTypes() {
+			if _, ok := t.requiredMessages[msg.Unwrap().FullName()]; ok {
+				fileReport.KeptMessages = append(fileReport.KeptMessages, msg.GetFullyQualifiedName())
+			} else {
+				fileReport.RemovedMessages = append(fileReport.RemovedMessages, msg.GetFullyQualifiedName())
+			}
+		}
+		for _, enum := range fd.GetEnumTypes() {
+			if _, ok := t.requiredEnums[enum.Unwrap().FullName()]; ok {
+				fileReport.KeptEnums = append(fileReport.KeptEnums, enum.GetFullyQualifiedName())
+			} else {
+				fileReport.RemovedEnums = append(fileReport.RemovedEnums, enum.GetFullyQualifiedName())
+			}
+		}
+		for _, service := range fd.GetServices() {
+			for _, method := range service.GetMethods() {
+				if _, ok := keptMethods[method]; ok {
+					fileReport.KeptMethods = append(fileReport.KeptMethods, method.GetFullyQualifiedName())
+				} else {
+					fileReport.RemovedMethods = append(fileReport.RemovedMethods, method.GetFullyQualifiedName())
+				}
+			}
+		}
+		report.Files = append(report.Files, fileReport)
+	}
+
+	sort.Slice(report.Files, func(i, j int) bool {
+		return report.Files[i].Path < report.Files[j].Path
+	})
+	return report
+}
+
+// Stats counts what a trim kept and removed.
+type Stats struct {
+	// Files holds one entry per parsed file, sorted by path.
+	Files []FileStats
+	// FilesDropped is the number of parsed files left out of the output.
+	FilesDropped int
+}
+
+// FileStats counts the top-level definitions of one file that a trim kept and
+// removed.
+type FileStats struct {
+	// Path is the file's key in Options.ProtoContents.
+	Path string
+	// Dropped reports whether the file was left out of the output entirely.
+	Dropped bool
+
+	KeptMessages    int
+	RemovedMessages int
+	KeptEnums       int
+	RemovedEnums    int
+	KeptMethods     int
+	RemovedMethods  int
+}
+
+// TrimWithStats is TrimWithOptions that also returns per-file counts of the
+// kept and removed definitions. A file counts as dropped when it is not part of
+// the output: files emptied by the trim, files in ExcludeFiles and well-known
+// files left as external imports.
+func TrimWithStats(opts Options) (map[string]string, *Stats, error) {
+	entryFds, allFds, err := opts.parse()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	t, err := resolveTrimmer(entryFds, allFds, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	newFds, err := t.buildFiles()
+	if err != nil {
+		return nil, nil, err
+	}
+	trimmedResults, err := printOutputs(context.Background(), entryFds, newFds, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	t.logger.Printf("Done!")
+
+	report := newTrimReport(t, allFds, opts.isEmittedFile(newFds))
+	stats := &Stats{Files: make([]FileStats, 0, len(report.Files))}
+	for _, file := range report.Files {
+		if file.Dropped {
+			stats.FilesDropped++
+		}
+		stats.Files = append(stats.Files, FileStats{
+			Path:            file.Path,
+			Dropped:         file.Dropped,
+			KeptMessages:    len(file.KeptMessages),
+			RemovedMessages: len(file.RemovedMessages),
+			KeptEnums:       len(file.KeptEnums),
+			RemovedEnums:    len(file.RemovedEnums),
+			KeptMethods:     len(file.KeptMethods),
+			RemovedMethods:  len(file.RemovedMethods),
+		})
+	}
+	return opts.resultPaths(trimmedResults, allFds), stats, nil
+}
@@ -0,0 +1,177 @@
+package trimpb
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAnalyze(t *testing.T) {
+	opts := Options{
+		EntryFiles:  []string{"api/v1/commerce_service.proto"},
+		MethodNames: []string{"api.v1.CommerceService.GetUser"},
+		ImportPaths: []string{"example/muit"},
+		ProtoContents: loadProtoFiles(t, "example/muit",
+			"api/v1/commerce_service.proto",
+			"api/v1/common_messages.proto",
+			"common/types/base.proto",
+			"common/types/money.proto",
+			"services/order/item.proto",
+			"services/order/order.proto",
+			"services/product/product.proto",
+			"services/product/review.proto",
+			"services/user/profile.proto",
+			"services/user/user.proto",
+		),
+	}
+
+	report, err := Analyze(opts)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"api.v1.CommerceService.GetUser"}, report.MatchedMethods)
+
+	result, err := TrimWithOptions(opts)
+	require.NoError(t, err)
+
+	// 报告中保留的文件必须与实际裁剪输出一致
+	var keptFiles []string
+	for _, file := range report.Files {
+		if !file.Dropped {
+			keptFiles = append(keptFiles, file.Path)
+		}
+	}
+	var resultFiles []string
+	for path := range result {
+		resultFiles = append(resultFiles, path)
+	}
+	assert.ElementsMatch(t, resultFiles, keptFiles)
+
+	// 报告中保留/移除的符号必须与实际输出内容一致
+	for _, file := range report.Files {
+		content := result[file.Path]
+		for _, name := range file.KeptMessages {
+			assert.Contains(t, content, "message "+simpleName(name), "文件 %s 应该保留 %s", file.Path, name)
+		}
+		for _, name := range file.RemovedMessages {
+			assert.NotContains(t, content, "message "+simpleName(name)+" {", "文件 %s 不应该保留 %s", file.Path, name)
+		}
+		for _, name := range file.KeptMethods {
+			assert.Contains(t, content, "rpc "+simpleName(name)+" (", "文件 %s 应该保留 %s", file.Path, name)
+		}
+		for _, name := range file.RemovedMethods {
+			assert.NotContains(t, content, "rpc "+simpleName(name)+" (", "文件 %s 不应该保留 %s", file.Path, name)
+		}
+	}
+
+	dropped := make(map[string]bool)
+	for _, file := range report.Files {
+		dropped[file.Path] = file.Dropped
+	}
+	assert.True(t, dropped["example/muit/services/order/order.proto"])
+	assert.False(t, dropped["example/muit/services/user/profile.proto"])
+}
+
+func TestAnalyze_ExcludedFiles(t *testing.T) {
+	opts := Options{
+		EntryFiles:  []string{"project.proto"},
+		MethodNames: []string{"ProjectService.CreateProject"},
+		ImportPaths: []string{"example"},
+		ProtoContents: map[string]string{
+			"example/project.proto": `
+syntax = "proto3";
+package project.v1;
+import "common.proto";
+import "google/protobuf/timestamp.proto";
+service ProjectService { rpc CreateProject(Request) returns (Response); }
+message Request { google.protobuf.Timestamp at = 1; }
+message Response { Status status = 1; }`,
+			"example/common.proto": `
+syntax = "proto3";
+package project.v1;
+enum Status { STATUS_UNSPECIFIED = 0; }`,
+		},
+		ExcludeFiles: []string{"common.proto"},
+	}
+
+	report, err := Analyze(opts)
+	require.NoError(t, err)
+	result, err := TrimWithOptions(opts)
+	require.NoError(t, err)
+
+	// 被排除的文件和未提供内容的知名类型文件都不在输出中, 应报告为丢弃
+	dropped := make(map[string]bool)
+	for _, file := range report.Files {
+		dropped[file.Path] = file.Dropped
+		_, emitted := result[file.Path]
+		assert.Equal(t, emitted, !file.Dropped, "文件 %s", file.Path)
+	}
+	assert.True(t, dropped["example/common.proto"])
+	assert.True(t, dropped["google/protobuf/timestamp.proto"])
+	assert.False(t, dropped["example/project.proto"])
+}
+
+func simpleName(fullName string) string {
+	return fullName[strings.LastIndex(fullName, ".")+1:]
+}
+
+func TestTrimWithStats(t *testing.T) {
+	opts := Options{
+		EntryFiles:  []string{"project.proto"},
+		MethodNames: []string{"ProjectService.CreateProject"},
+		ImportPaths: []string{"example"},
+		ProtoContents: loadProtoFiles(t, "example",
+			"project.proto",
+			"common.proto",
+			"domain/user.proto",
+		),
+	}
+
+	result, stats, err := TrimWithStats(opts)
+	require.NoError(t, err)
+	expected, err := TrimWithOptions(opts)
+	require.NoError(t, err)
+	assert.Equal(t, expected, result)
+
+	// project.proto: 保留 Project、CreateProjectRequest、CreateProjectResponse 和 CreateProject,
+	// 移除 UnrelatedMessage、DeleteProjectRequest、DeleteProjectResponse 以及另外两个方法
+	assert.Equal(t, &Stats{
+		Files: []FileStats{
+			{Path: "example/common.proto", KeptEnums: 1},
+			{Path: "example/domain/user.proto", KeptMessages: 1, RemovedMessages: 1},
+			{Path: "example/project.proto", KeptMessages: 3, RemovedMessages: 3, KeptMethods: 1, RemovedMethods: 2},
+		},
+	}, stats)
+
+	// 仅保留 DeleteProject 时 common.proto 和 domain/user.proto 整体被丢弃
+	opts.MethodNames = []string{"ProjectService.DeleteProject"}
+	_, stats, err = TrimWithStats(opts)
+	require.NoError(t, err)
+	assert.Equal(t, 2, stats.FilesDropped)
+	assert.True(t, stats.Files[0].Dropped)
+	assert.Equal(t, 1, stats.Files[0].RemovedEnums)
+	assert.True(t, stats.Files[1].Dropped)
+	assert.False(t, stats.Files[2].Dropped)
+}
+
+func TestTrimWithStats_ExcludeFiles(t *testing.T) {
+	opts := Options{
+		EntryFiles:    []string{"project.proto"},
+		MethodNames:   []string{"ProjectService.CreateProject"},
+		ImportPaths:   []string{"example"},
+		ProtoContents: loadProtoFiles(t, "example", "project.proto", "common.proto", "domain/user.proto"),
+		ExcludeFiles:  []string{"common.proto"},
+	}
+
+	result, stats, err := TrimWithStats(opts)
+	require.NoError(t, err)
+	assert.NotContains(t, result, "example/common.proto")
+
+	// 被排除的文件不输出, 计为丢弃
+	assert.Equal(t, 1, stats.FilesDropped)
+	require.Len(t, stats.Files, 3)
+	assert.Equal(t, "example/common.proto", stats.Files[0].Path)
+	assert.True(t, stats.Files[0].Dropped)
+	assert.False(t, stats.Files[1].Dropped)
+	assert.False(t, stats.Files[2].Dropped)
+}
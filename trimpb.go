@@ -1,214 +1,1517 @@
 package trimpb
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"os"
+	"path"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
 	"strings"
 
 	"github.com/jhump/protoreflect/desc"
 	"github.com/jhump/protoreflect/desc/protoparse"
 	"github.com/jhump/protoreflect/desc/protoprint"
+	"google.golang.org/protobuf/encoding/protowire"
 	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/reflect/protoreflect"
 	"google.golang.org/protobuf/types/descriptorpb"
 )
 
 type trimmer struct {
+	opts              Options
+	logger            Logger
 	requiredMessages  map[protoreflect.FullName]struct{}
 	requiredEnums     map[protoreflect.FullName]struct{}
+	requiredExts      map[protoreflect.FullName]struct{} // Top-level extensions set in kept options
+	depths            map[protoreflect.FullName]int      // Fewest steps each message and enum was reached in, with MaxDepth
+	excludedTypes     map[protoreflect.FullName]struct{}
+	excludedRefs      map[string]string                    // Fields of kept messages referencing an excluded type, to that type
+	anyTypes          map[string][]*desc.MessageDescriptor // Resolved Options.AnyTypes
 	entryPointMethods []*desc.MethodDescriptor
+	methodFiles       map[string]struct{} // Files declaring an entry-point method
 	filesToTrim       map[string]*desc.FileDescriptor
 }
 
-func newTrimmer() *trimmer {
+func newTrimmer(opts Options) *trimmer {
 	return &trimmer{
+		opts:             opts,
+		logger:           opts.logger(),
 		requiredMessages: make(map[protoreflect.FullName]struct{}),
 		requiredEnums:    make(map[protoreflect.FullName]struct{}),
+		requiredExts:     make(map[protoreflect.FullName]struct{}),
+		depths:           make(map[protoreflect.FullName]int),
+		excludedTypes:    make(map[protoreflect.FullName]struct{}),
+		excludedRefs:     make(map[string]string),
+		anyTypes:         make(map[string][]*desc.MessageDescriptor),
+		methodFiles:      make(map[string]struct{}),
 		filesToTrim:      make(map[string]*desc.FileDescriptor),
 	}
 }
 
+// TrimWithOptions trims the schema described by opts and returns the printed
+// files keyed by their path in opts.ProtoContents.
+func TrimWithOptions(opts Options) (map[string]string, error) {
+	return TrimContext(context.Background(), opts)
+}
+
+// TrimContext is TrimWithOptions with cancellation: ctx is checked between
+// parsing, dependency collection and the printing of each file, and its error
+// is returned as soon as it is done.
+func TrimContext(ctx context.Context, opts Options) (map[string]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	entryFds, allFds, err := opts.parse()
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	trimmedResults, err := runTrim(ctx, entryFds, allFds, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return opts.resultPaths(trimmedResults, allFds), nil
+}
+
+// resultPaths re-keys the printed files, named by their (rewritten) import
+// name, by their path in opts.ProtoContents.
+func (opts Options) resultPaths(trimmedResults map[string]string, allFds []*desc.FileDescriptor) map[string]string {
+	resultPath := opts.resultPathFunc(allFds)
+	finalResults := make(map[string]string)
+	for trimmedPath, content := range trimmedResults {
+		finalResults[resultPath(trimmedPath)] = content
+	}
+	return finalResults
+}
+
+// resultPathFunc returns the function mapping the (rewritten) import name of
+// a trimmed file to its path in opts.ProtoContents.
+func (opts Options) resultPathFunc(allFds []*desc.FileDescriptor) func(string) string {
+	originalNames := make(map[string]string, len(allFds))
+	for _, fd := range allFds {
+		originalNames[opts.rewriteImport(fd.GetName())] = fd.GetName()
+	}
+	return func(trimmedPath string) string {
+		originalName, ok := originalNames[trimmedPath]
+		if !ok {
+			return trimmedPath // A merged file has no source
+		}
+		realPath := opts.realPath(originalName)
+		// Keep the import path the file was found in, under its rewritten name
+		return strings.TrimSuffix(realPath, originalName) + trimmedPath
+	}
+}
+
+// TrimEach performs the same trim as TrimWithOptions but, instead of
+// collecting every printed file, calls fn for each in path order with a
+// reader streaming its source as it is printed. Only one file is printed at a
+// time, so memory stays bounded for very large schemas. fn need not read r to
+// the end; r is only valid until fn returns. The first error returned by fn
+// stops the trim and is returned as is. With Verify or MergedFileName set,
+// everything is printed before fn is first called.
+func TrimEach(opts Options, fn func(path string, r io.Reader) error) error {
+	entryFds, allFds, err := opts.parse()
+	if err != nil {
+		return err
+	}
+	newFds, err := buildTrimmedFiles(entryFds, allFds, opts)
+	if err != nil {
+		return err
+	}
+	resultPath := opts.resultPathFunc(allFds)
+	if opts.Verify || opts.MergedFileName != "" {
+		// Every file must be printed before any is handed out
+		result, err := printOutputs(context.Background(), entryFds, newFds, opts)
+		if err != nil {
+			return err
+		}
+		paths := make(map[string]string, len(result))
+		names := make([]string, 0, len(result))
+		for name := range result {
+			paths[name] = resultPath(name)
+			names = append(names, name)
+		}
+		sort.Slice(names, func(i, j int) bool { return paths[names[i]] < paths[names[j]] })
+		for _, name := range names {
+			if err := fn(paths[name], strings.NewReader(result[name])); err != nil {
+				return err
+			}
+		}
+		opts.logger().Printf("Done!")
+		return nil
+	}
+
+	newFds = opts.withoutExternalFiles(newFds)
+	paths := make(map[string]string, len(newFds))
+	names := make([]string, 0, len(newFds))
+	for name := range newFds {
+		paths[name] = resultPath(name)
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return paths[names[i]] < paths[names[j]] })
+	for _, name := range names {
+		if opts.NormalizeOutput {
+			// Normalization needs whole lines, so such files are printed first
+			content, err := opts.printer().PrintProtoToString(newFds[name])
+			if err != nil {
+				return fmt.Errorf("failed to print new proto file %s: %w", name, err)
+			}
+			if err := fn(paths[name], strings.NewReader(normalizeSource(content))); err != nil {
+				return err
+			}
+			continue
+		}
+		pr, pw := io.Pipe()
+		printed := make(chan error, 1)
+		go func(fd *desc.FileDescriptor) {
+			err := opts.printer().PrintProtoFile(fd, pw)
+			pw.CloseWithError(err)
+			printed <- err
+		}(newFds[name])
+
+		err := fn(paths[name], pr)
+		pr.Close() // Unblocks the printer when fn stopped reading early
+		printErr := <-printed
+		if err != nil {
+			return err
+		}
+		if printErr != nil && !errors.Is(printErr, io.ErrClosedPipe) {
+			return fmt.Errorf("failed to print new proto file %s: %w", name, printErr)
+		}
+	}
+
+	opts.logger().Printf("Done!")
+	return nil
+}
+
+// TrimToDir performs the same trim as TrimWithOptions and writes every file
+// under outDir at its import name, creating directories as needed. Files are
+// written in name order and the first failing write is returned.
+func TrimToDir(opts Options, outDir string) error {
+	entryFds, allFds, err := opts.parse()
+	if err != nil {
+		return err
+	}
+	trimmedResults, err := runTrim(context.Background(), entryFds, allFds, opts)
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(trimmedResults))
+	for name := range trimmedResults {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		outPath := filepath.Join(outDir, filepath.FromSlash(name))
+		opts.logger().Printf("Writing trimmed file to: %s", outPath)
+		if err := os.MkdirAll(filepath.Dir(outPath), 0o755); err != nil {
+			return fmt.Errorf("failed to write trimmed file %s: %w", outPath, err)
+		}
+		if err := os.WriteFile(outPath, []byte(trimmedResults[name]), 0o644); err != nil {
+			return fmt.Errorf("failed to write trimmed file %s: %w", outPath, err)
+		}
+	}
+	return nil
+}
+
+// TrimToDescriptorSet performs the same trim as TrimWithOptions but returns
+// the trimmed descriptors as a FileDescriptorSet instead of printed source.
+// Files are named by their import path and ordered so that every file follows
+// its dependencies, which keeps the set self-consistent for protoreflect
+// tooling. With MergedFileName set, the set holds the merged file and the
+// files it imports.
+func TrimToDescriptorSet(opts Options) (*descriptorpb.FileDescriptorSet, error) {
+	entryFds, allFds, err := opts.parse()
+	if err != nil {
+		return nil, err
+	}
+
+	newFds, err := buildTrimmedFiles(entryFds, allFds, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.MergedFileName != "" {
+		merged, err := buildMerged(entryFds, newFds, opts.MergedFileName, opts)
+		if err != nil {
+			return nil, err
+		}
+		newFds = make(map[string]*desc.FileDescriptor)
+		for _, fd := range collectAllDependencies([]*desc.FileDescriptor{merged}) {
+			newFds[fd.GetName()] = fd
+		}
+	}
+
+	fileSet := &descriptorpb.FileDescriptorSet{}
+	for _, fd := range sortFilesTopologically(newFds) {
+		fileSet.File = append(fileSet.File, fd.AsFileDescriptorProto())
+	}
+	return fileSet, nil
+}
+
+// RequiredFilesWithOptions performs the same trim as TrimWithOptions without
+// printing anything and returns, sorted, the paths that TrimWithOptions would
+// return, for build-graph tooling and diagnostics.
+func RequiredFilesWithOptions(opts Options) ([]string, error) {
+	entryFds, allFds, err := opts.parse()
+	if err != nil {
+		return nil, err
+	}
+	newFds, err := buildTrimmedFiles(entryFds, allFds, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.MergedFileName != "" {
+		if _, err := buildMerged(entryFds, newFds, opts.MergedFileName, opts); err != nil {
+			return nil, err
+		}
+		return []string{opts.MergedFileName}, nil
+	}
+
+	resultPath := opts.resultPathFunc(allFds)
+	var paths []string
+	for name := range opts.withoutExternalFiles(newFds) {
+		paths = append(paths, resultPath(name))
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// RequiredFiles is the positional form of RequiredFilesWithOptions, for entry
+// files and imports named by their keys in protoContents.
+func RequiredFiles(entryFiles []string, methodNames []string, protoContents map[string]string) ([]string, error) {
+	return RequiredFilesWithOptions(Options{
+		EntryFiles:    entryFiles,
+		MethodNames:   methodNames,
+		ProtoContents: protoContents,
+	})
+}
+
+// Trim trims a single entry file. It is the positional form of TrimWithOptions
+// for the common one-entry case.
+func Trim(entryProtoFile string, methodNames []string, importPaths []string, protoContents map[string]string) (map[string]string, error) {
+	return TrimMulti([]string{entryProtoFile}, methodNames, importPaths, protoContents)
+}
+
+// TrimMulti is the positional form of TrimWithOptions.
 func TrimMulti(entryProtoFiles []string, methodNames []string, importPaths []string, protoContents map[string]string) (map[string]string, error) {
-	parser := protoparse.Parser{
-		Accessor:              protoparse.FileContentsFromMap(protoContents),
-		IncludeSourceCodeInfo: true, // Preserve source code info for comments
-		ImportPaths:           importPaths,
+	return TrimWithOptions(Options{
+		EntryFiles:    entryProtoFiles,
+		MethodNames:   methodNames,
+		ImportPaths:   importPaths,
+		ProtoContents: protoContents,
+	})
+}
+
+// TrimMultiToDescriptorSet is the positional form of TrimToDescriptorSet.
+func TrimMultiToDescriptorSet(entryProtoFiles []string, methodNames []string, importPaths []string, protoContents map[string]string) (*descriptorpb.FileDescriptorSet, error) {
+	return TrimToDescriptorSet(Options{
+		EntryFiles:    entryProtoFiles,
+		MethodNames:   methodNames,
+		ImportPaths:   importPaths,
+		ProtoContents: protoContents,
+	})
+}
+
+func collectAllDependencies(entryFds []*desc.FileDescriptor) []*desc.FileDescriptor {
+	allFdsMap := make(map[string]*desc.FileDescriptor)
+	queue := make([]*desc.FileDescriptor, len(entryFds))
+	copy(queue, entryFds)
+
+	for len(queue) > 0 {
+		fd := queue[0]
+		queue = queue[1:]
+
+		if _, visited := allFdsMap[fd.GetName()]; visited {
+			continue
+		}
+		allFdsMap[fd.GetName()] = fd
+
+		for _, dep := range fd.GetDependencies() {
+			queue = append(queue, dep)
+		}
+	}
+
+	result := make([]*desc.FileDescriptor, 0, len(allFdsMap))
+	for _, fd := range allFdsMap {
+		result = append(result, fd)
+	}
+	// Sort by name so that every lookup over the result is deterministic
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].GetName() < result[j].GetName()
+	})
+	return result
+}
+
+// sortFilesTopologically orders fds by name, moving each file after the
+// files it imports.
+func sortFilesTopologically(fds map[string]*desc.FileDescriptor) []*desc.FileDescriptor {
+	names := make([]string, 0, len(fds))
+	for name := range fds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	visited := make(map[string]struct{}, len(fds))
+	sorted := make([]*desc.FileDescriptor, 0, len(fds))
+	var visit func(fd *desc.FileDescriptor)
+	visit = func(fd *desc.FileDescriptor) {
+		if _, ok := visited[fd.GetName()]; ok {
+			return
+		}
+		visited[fd.GetName()] = struct{}{}
+		for _, dep := range fd.GetDependencies() {
+			if depFd, ok := fds[dep.GetName()]; ok {
+				visit(depFd)
+			}
+		}
+		sorted = append(sorted, fd)
+	}
+	for _, name := range names {
+		visit(fds[name])
+	}
+	return sorted
+}
+
+func runTrim(ctx context.Context, entryFileDescs []*desc.FileDescriptor, fds []*desc.FileDescriptor, opts Options) (map[string]string, error) {
+	newFds, err := buildTrimmedFiles(entryFileDescs, fds, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	result, err := printOutputs(ctx, entryFileDescs, newFds, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	opts.logger().Printf("Done!")
+	return result, nil
+}
+
+// printOutputs prints the trimmed files newFds as they are returned, keyed by
+// import name: every emitted file, or the single merged file when
+// opts.MergedFileName is set, normalized and verified as opts asks.
+func printOutputs(ctx context.Context, entryFileDescs []*desc.FileDescriptor, newFds map[string]*desc.FileDescriptor, opts Options) (map[string]string, error) {
+	var result map[string]string
+	if opts.MergedFileName != "" {
+		str, err := printMerged(entryFileDescs, newFds, opts.MergedFileName, opts)
+		if err != nil {
+			return nil, err
+		}
+		result = map[string]string{opts.MergedFileName: str}
+	} else {
+		var err error
+		result, err = printFiles(ctx, opts.withoutExternalFiles(newFds), opts.printer(), runtime.GOMAXPROCS(0))
+		if err != nil {
+			return nil, err
+		}
+	}
+	opts.normalizeOutputs(result)
+	if err := opts.verifyOutputs(result, newFds); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// printFiles prints every descriptor back to proto source with printer using
+// up to workers goroutines, stopping once ctx is done.
+func printFiles(ctx context.Context, newFds map[string]*desc.FileDescriptor, printer *protoprint.Printer, workers int) (map[string]string, error) {
+	paths := make([]string, 0, len(newFds))
+	for path := range newFds {
+		paths = append(paths, path)
+	}
+	contents := make([]string, len(paths))
+	err := forEachParallelN(len(paths), workers, func(i int) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		p := *printer // Each worker prints with its own copy
+		str, err := p.PrintProtoToString(newFds[paths[i]])
+		if err != nil {
+			return fmt.Errorf("failed to print new proto file %s: %w", paths[i], err)
+		}
+		contents[i] = str
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]string, len(paths))
+	for i, path := range paths {
+		result[path] = contents[i]
+	}
+	return result, nil
+}
+
+// printer returns the printer configured by opts.
+func (opts Options) printer() *protoprint.Printer {
+	return &protoprint.Printer{SortElements: opts.SortElements}
+}
+
+// withoutExternalFiles returns newFds without the files of opts.ExcludeFiles
+// and the well-known files under google/protobuf/ that are missing from
+// opts.ProtoContents. Those were supplied by the parser, so they are left to
+// the protobuf compiler and stay imports instead of being printed. Vendored
+// copies are trimmed like any other file, as is every file of a
+// DescriptorSet, or of Files given without the ProtoContents they were parsed
+// from.
+func (opts Options) withoutExternalFiles(newFds map[string]*desc.FileDescriptor) map[string]*desc.FileDescriptor {
+	excluded := opts.excludedFiles()
+	checkWellKnown := opts.DescriptorSet == nil && opts.ProtoContents != nil
+	printed := make(map[string]*desc.FileDescriptor, len(newFds))
+	for name, fd := range newFds {
+		if _, ok := excluded[name]; ok {
+			continue
+		}
+		if checkWellKnown && strings.HasPrefix(name, wellKnownPrefix) {
+			if _, ok := opts.resolvePath(name); !ok {
+				continue
+			}
+		}
+		printed[name] = fd
+	}
+	return printed
+}
+
+// excludedFiles returns the (rewritten) import names of opts.ExcludeFiles.
+func (opts Options) excludedFiles() map[string]struct{} {
+	excluded := make(map[string]struct{}, len(opts.ExcludeFiles))
+	for _, name := range opts.ExcludeFiles {
+		excluded[opts.rewriteImport(name)] = struct{}{}
 	}
+	return excluded
+}
+
+// normalizeOutputs applies normalizeSource to every printed file when
+// opts.NormalizeOutput is set.
+func (opts Options) normalizeOutputs(result map[string]string) {
+	if !opts.NormalizeOutput {
+		return
+	}
+	for path, content := range result {
+		result[path] = normalizeSource(content)
+	}
+}
 
-	entryFds, err := parser.ParseFiles(entryProtoFiles...)
+// verifyOutputs parses the printed files, keyed by import name, when
+// opts.Verify is set. Files of opts.ExcludeFiles they import are printed from
+// the trimmed files newFds, as they stay imports; well-known files left out of
+// the output are supplied by the parser, as they are by protoc.
+func (opts Options) verifyOutputs(result map[string]string, newFds map[string]*desc.FileDescriptor) error {
+	if !opts.Verify {
+		return nil
+	}
+	names := make([]string, 0, len(result))
+	for name := range result {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	contents := make(map[string]string, len(result))
+	for name, content := range result {
+		contents[name] = content
+	}
+	for name := range opts.excludedFiles() {
+		if fd, ok := newFds[name]; ok {
+			str, err := opts.printer().PrintProtoToString(fd)
+			if err != nil {
+				return fmt.Errorf("failed to print excluded proto file %s: %w", name, err)
+			}
+			contents[name] = str
+		}
+	}
+	parser := protoparse.Parser{Accessor: protoparse.FileContentsFromMap(contents)}
+	if _, err := parser.ParseFiles(names...); err != nil {
+		return fmt.Errorf("trimmed output does not parse: %w", err)
+	}
+	return nil
+}
+
+// normalizeSource converts CRLF and lone CR line endings to LF and strips the
+// trailing whitespace of every line.
+func normalizeSource(content string) string {
+	content = strings.ReplaceAll(content, "\r\n", "\n")
+	content = strings.ReplaceAll(content, "\r", "\n")
+	lines := strings.Split(content, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, " \t")
+	}
+	return strings.Join(lines, "\n")
+}
+
+// buildTrimmedFiles resolves the entry-point methods, collects everything they
+// depend on and rebuilds the filtered files as linked descriptors keyed by name.
+func buildTrimmedFiles(entryFileDescs []*desc.FileDescriptor, fds []*desc.FileDescriptor, opts Options) (map[string]*desc.FileDescriptor, error) {
+	t, err := resolveTrimmer(entryFileDescs, fds, opts)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse proto files from map: %w", err)
+		return nil, err
+	}
+	return t.buildFiles()
+}
+
+// buildFiles rebuilds the files selected by t as linked descriptors keyed by
+// name.
+func (t *trimmer) buildFiles() (map[string]*desc.FileDescriptor, error) {
+	if len(t.filesToTrim) == 0 {
+		return make(map[string]*desc.FileDescriptor), nil
+	}
+
+	// Filter in name order so that nothing downstream depends on map order
+	names := make([]string, 0, len(t.filesToTrim))
+	for name := range t.filesToTrim {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var filteredFileProtos []*descriptorpb.FileDescriptorProto
+	for _, name := range names {
+		newProto := t.filterFileDescriptor(t.filesToTrim[name])
+		filteredFileProtos = append(filteredFileProtos, newProto)
+	}
+
+	filteredFileProtos = dropEmptyFiles(filteredFileProtos)
+	if len(filteredFileProtos) == 0 {
+		return make(map[string]*desc.FileDescriptor), nil
+	}
+	if err := rewriteImports(filteredFileProtos, t.opts); err != nil {
+		return nil, err
+	}
+	renamePackages(filteredFileProtos, t.opts.PackageRenames)
+
+	fileSet := &descriptorpb.FileDescriptorSet{File: filteredFileProtos}
+	newFds, err := desc.CreateFileDescriptorsFromSet(fileSet)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create new descriptors from filtered set: %w", err)
+	}
+	return newFds, nil
+}
+
+// rewriteImports renames the files and their imports according to
+// opts.ImportRewrites.
+func rewriteImports(fileProtos []*descriptorpb.FileDescriptorProto, opts Options) error {
+	if len(opts.ImportRewrites) == 0 {
+		return nil
+	}
+	renamedFrom := make(map[string]string, len(fileProtos))
+	for _, fp := range fileProtos {
+		newName := opts.rewriteImport(fp.GetName())
+		if other, ok := renamedFrom[newName]; ok {
+			return fmt.Errorf("import rewrites map both %s and %s to %s", other, fp.GetName(), newName)
+		}
+		renamedFrom[newName] = fp.GetName()
+		fp.Name = stringPtr(newName)
+		for i, dep := range fp.GetDependency() {
+			fp.Dependency[i] = opts.rewriteImport(dep)
+		}
+	}
+	return nil
+}
+
+// dropEmptyFiles removes the files left without any message, enum, service or
+// extension after filtering, along with every import of them.
+func dropEmptyFiles(fileProtos []*descriptorpb.FileDescriptorProto) []*descriptorpb.FileDescriptorProto {
+	empty := make(map[string]struct{})
+	kept := make([]*descriptorpb.FileDescriptorProto, 0, len(fileProtos))
+	for _, fp := range fileProtos {
+		if len(fp.GetMessageType()) == 0 && len(fp.GetEnumType()) == 0 && len(fp.GetService()) == 0 && len(fp.GetExtension()) == 0 &&
+			len(fp.GetPublicDependency()) == 0 { // A file may exist only to re-export others
+			empty[fp.GetName()] = struct{}{}
+			continue
+		}
+		kept = append(kept, fp)
+	}
+	if len(empty) == 0 {
+		return kept
+	}
+
+	for _, fp := range kept {
+		removeDependencies(fp, empty)
+	}
+	return kept
+}
+
+// removeDependencies deletes the named imports from fp, re-indexing its public
+// and weak dependency lists against the remaining imports.
+func removeDependencies(fp *descriptorpb.FileDescriptorProto, names map[string]struct{}) {
+	newIndex := make(map[int32]int32, len(fp.GetDependency()))
+	var deps []string
+	for i, dep := range fp.GetDependency() {
+		if _, ok := names[dep]; ok {
+			continue
+		}
+		newIndex[int32(i)] = int32(len(deps))
+		deps = append(deps, dep)
+	}
+	reindex := func(indices []int32) []int32 {
+		var result []int32
+		for _, idx := range indices {
+			if n, ok := newIndex[idx]; ok {
+				result = append(result, n)
+			}
+		}
+		return result
+	}
+	fp.Dependency = deps
+	fp.PublicDependency = reindex(fp.GetPublicDependency())
+	fp.WeakDependency = reindex(fp.GetWeakDependency())
+}
+
+// resolveTrimmer resolves the entry-point methods and collects the messages,
+// enums and files they depend on, without building any output.
+func resolveTrimmer(entryFileDescs []*desc.FileDescriptor, fds []*desc.FileDescriptor, opts Options) (*trimmer, error) {
+	if len(entryFileDescs) == 0 {
+		return nil, fmt.Errorf("no entry proto files were parsed successfully")
+	}
+
+	if opts.MaxDepth != nil && *opts.MaxDepth < 0 {
+		return nil, fmt.Errorf("MaxDepth must not be negative, got %d", *opts.MaxDepth)
+	}
+
+	t := newTrimmer(opts)
+
+	var excludeErrs []error
+	for _, typeName := range opts.ExcludeTypes {
+		d, err := findTypeByFullName(typeName, fds)
+		if err != nil {
+			excludeErrs = append(excludeErrs, err)
+			continue
+		}
+		t.excludedTypes[protoreflect.FullName(d.GetFullyQualifiedName())] = struct{}{}
+	}
+	fileNames := make(map[string]struct{}, len(fds))
+	for _, fd := range fds {
+		fileNames[fd.GetName()] = struct{}{}
+	}
+	for _, name := range opts.ExcludeFiles {
+		if _, ok := fileNames[name]; !ok {
+			excludeErrs = append(excludeErrs, fmt.Errorf("excluded file '%s' not found among the entry files or their imports", name))
+		}
+	}
+	if len(excludeErrs) > 0 {
+		return nil, errors.Join(excludeErrs...)
+	}
+	if err := t.resolveAnyTypes(fds); err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]struct{})
+	addMethod := func(method *desc.MethodDescriptor) {
+		// The same method may be requested under several names
+		if _, ok := seen[method.GetFullyQualifiedName()]; ok {
+			return
+		}
+		seen[method.GetFullyQualifiedName()] = struct{}{}
+		t.entryPointMethods = append(t.entryPointMethods, method)
+		t.methodFiles[method.GetFile().GetName()] = struct{}{}
+		t.collectDependencies(method.GetInputType(), 0)
+		t.collectDependencies(method.GetOutputType(), 0)
+		t.collectOptionDependencies(method.GetFile(), method.GetService().GetServiceOptions())
+		t.collectOptionDependencies(method.GetFile(), method.GetMethodOptions())
+	}
+
+	if len(opts.MethodNames) == 0 && len(opts.KeepMessages) == 0 && len(opts.KeepEnums) == 0 && len(opts.KeepPackages) == 0 {
+		for _, fd := range entryFileDescs {
+			for _, service := range fd.GetServices() {
+				for _, method := range service.GetMethods() {
+					addMethod(method)
+				}
+			}
+		}
+	} else {
+		// Resolve every name before failing so that all problems are reported at once
+		var errs []error
+		for _, methodName := range opts.MethodNames {
+			methods, err := t.findMethods(methodName, entryFileDescs, fds)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			for _, method := range methods {
+				addMethod(method)
+			}
+		}
+		for _, messageName := range opts.KeepMessages {
+			md, err := findMessageByFullName(messageName, fds)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			t.collectDependencies(md, 0)
+		}
+		for _, enumName := range opts.KeepEnums {
+			ed, err := findEnumByFullName(enumName, fds)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			t.collectEnum(ed, 0)
+		}
+		for _, pkg := range opts.KeepPackages {
+			if err := t.keepPackage(pkg, fds, addMethod); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		if len(errs) > 0 {
+			return nil, errors.Join(errs...)
+		}
+	}
+
+	if opts.KeepRelatedMethods {
+		// Decide on every related method before adding any, so that the
+		// messages they require do not relate further methods
+		var related []*desc.MethodDescriptor
+		for _, fd := range entryFileDescs {
+			for _, service := range fd.GetServices() {
+				for _, method := range service.GetMethods() {
+					if t.usesRequiredMessage(method) {
+						related = append(related, method)
+					}
+				}
+			}
+		}
+		for _, method := range related {
+			addMethod(method)
+		}
+	}
+
+	if len(t.entryPointMethods) == 0 && len(t.requiredMessages) == 0 && len(t.requiredEnums) == 0 {
+		if len(opts.MethodNames) > 0 {
+			if opts.RequireMethods {
+				return nil, fmt.Errorf("no methods matched the given names")
+			}
+			t.logger.Printf("Warning: No methods matched the given names, no files will be trimmed.")
+			return t, nil
+		}
+		names := make([]string, 0, len(entryFileDescs))
+		for _, fd := range entryFileDescs {
+			names = append(names, fd.GetName())
+		}
+		if opts.RequireMethods {
+			return nil, fmt.Errorf("no methods to keep, the entry files declare no services: %s", strings.Join(names, ", "))
+		}
+		t.logger.Printf("Warning: The entry files declare no services (%s), no files will be trimmed.", strings.Join(names, ", "))
+		return t, nil
+	}
+	if err := t.checkExcludedTypes(); err != nil {
+		return nil, err
+	}
+
+	t.collectFiles(fds)
+	t.logger.Printf("Found %d files containing required definitions.", len(t.filesToTrim))
+	return t, nil
+}
+
+func (t *trimmer) findMethods(methodName string, entryFiles []*desc.FileDescriptor, allFiles []*desc.FileDescriptor) ([]*desc.MethodDescriptor, error) {
+	if t.opts.StrictMethodNames {
+		if err := checkStrictMethodName(methodName); err != nil {
+			return nil, err
+		}
+	}
+	if len(methodName) > 2 && strings.HasPrefix(methodName, "/") && strings.HasSuffix(methodName, "/") { // Regex (e.g., /List.*Request$/)
+		return t.findMethodsByRegex(methodName[1:len(methodName)-1], entryFiles)
+	}
+
+	dotCount := strings.Count(methodName, ".")
+
+	if dotCount >= 2 { // Fully qualified name (e.g., package.Service.Method)
+		if idx := strings.LastIndex(methodName, "."); isGlobPattern(methodName[idx+1:]) { // package.Service.Create*
+			serviceName, pattern := methodName[:idx], methodName[idx+1:]
+			for _, fd := range allFiles {
+				if sd, ok := fd.FindSymbol(serviceName).(*desc.ServiceDescriptor); ok {
+					methods, err := t.matchMethodGlob(methodName, sd, pattern)
+					if err != nil || len(methods) > 0 {
+						return methods, err
+					}
+					break
+				}
+			}
+		} else {
+			return findMethodByFullName(methodName, allFiles)
+		}
+	} else if dotCount == 1 { // Service.Method, preferring services declared in the entry files
+		parts := strings.Split(methodName, ".")
+		serviceName, simpleMethodName := parts[0], parts[1]
+		candidates := [][]*desc.FileDescriptor{entryFiles, allFiles}
+		if t.opts.StrictMethodNames {
+			// Every file counts, so a same-named service elsewhere is ambiguous
+			candidates = [][]*desc.FileDescriptor{allFiles}
+		}
+		for _, files := range candidates {
+			methods, err := t.findServiceMethods(methodName, serviceName, simpleMethodName, files)
+			if err != nil || len(methods) > 0 {
+				return methods, err
+			}
+		}
+	} else { // Bare method name, matched exactly or as a substring in every entry service
+		var foundMethods []*desc.MethodDescriptor
+		for _, entryFile := range entryFiles {
+			for _, service := range entryFile.GetServices() {
+				for _, method := range service.GetMethods() {
+					if method.GetName() == methodName || t.opts.SubstringMatch && strings.Contains(method.GetName(), methodName) {
+						foundMethods = append(foundMethods, method)
+					}
+				}
+			}
+		}
+		if len(foundMethods) > 0 {
+			t.logger.Printf("Found %d methods matching '%s'", len(foundMethods), methodName)
+			return foundMethods, nil
+		}
+	}
+
+	return nil, newMethodNotFoundError(methodName, allFiles)
+}
+
+// checkStrictMethodName fails unless methodName is a Service.Method or fully
+// qualified name without a glob, as Options.StrictMethodNames requires.
+func checkStrictMethodName(methodName string) error {
+	idx := strings.LastIndex(methodName, ".")
+	switch {
+	case strings.HasPrefix(methodName, "/") && strings.HasSuffix(methodName, "/") && len(methodName) > 2:
+		return fmt.Errorf("method name '%s' is a regex, which strict matching does not allow", methodName)
+	case idx < 0:
+		return fmt.Errorf("method name '%s' is not qualified by its service, strict matching requires Service.Method or a fully-qualified name", methodName)
+	case isGlobPattern(methodName[idx+1:]):
+		return fmt.Errorf("method name '%s' is a glob, which strict matching does not allow", methodName)
+	}
+	return nil
+}
+
+// findServiceMethods resolves Service.Method (the method portion may be a
+// glob) against the services named serviceName declared in files. The first
+// service declaring the method wins, unless Options.StrictMethodNames is set,
+// in which case a method declared by several such services is ambiguous.
+func (t *trimmer) findServiceMethods(methodName, serviceName, simpleMethodName string, files []*desc.FileDescriptor) ([]*desc.MethodDescriptor, error) {
+	var foundMethods []*desc.MethodDescriptor
+	seen := make(map[*desc.MethodDescriptor]struct{})
+	for _, fd := range files {
+		for _, service := range fd.GetServices() {
+			if service.GetName() != serviceName {
+				continue
+			}
+			if isGlobPattern(simpleMethodName) { // Service.Create*
+				methods, err := t.matchMethodGlob(methodName, service, simpleMethodName)
+				if err != nil {
+					return nil, err
+				}
+				foundMethods = append(foundMethods, methods...)
+			} else if method := service.FindMethodByName(simpleMethodName); method != nil {
+				if !t.opts.StrictMethodNames {
+					return []*desc.MethodDescriptor{method}, nil
+				}
+				if _, ok := seen[method]; !ok {
+					seen[method] = struct{}{}
+					foundMethods = append(foundMethods, method)
+				}
+			}
+		}
+	}
+	if t.opts.StrictMethodNames && len(foundMethods) > 1 {
+		files := make([]string, 0, len(foundMethods))
+		for _, method := range foundMethods {
+			files = append(files, method.GetFile().GetName())
+		}
+		return nil, &AmbiguousMethodError{Name: methodName, Matches: files}
+	}
+	return foundMethods, nil
+}
+
+// findMethodByFullName looks methodName up in every file. It fails when the
+// symbol is declared by several files or names something other than a method.
+func findMethodByFullName(methodName string, allFiles []*desc.FileDescriptor) ([]*desc.MethodDescriptor, error) {
+	var found []*desc.MethodDescriptor
+	var other desc.Descriptor
+	seen := make(map[desc.Descriptor]struct{})
+	for _, fd := range allFiles {
+		d := fd.FindSymbol(methodName)
+		if d == nil {
+			continue
+		}
+		if _, ok := seen[d]; ok { // Reached again through a public import
+			continue
+		}
+		seen[d] = struct{}{}
+		if md, ok := d.(*desc.MethodDescriptor); ok {
+			found = append(found, md)
+		} else if other == nil {
+			other = d
+		}
 	}
 
-	allFds := collectAllDependencies(entryFds)
+	switch {
+	case len(found) == 1:
+		return found, nil
+	case len(found) > 1:
+		files := make([]string, 0, len(found))
+		for _, md := range found {
+			files = append(files, md.GetFile().GetName())
+		}
+		return nil, &AmbiguousMethodError{Name: methodName, Matches: files}
+	case other != nil:
+		return nil, fmt.Errorf("'%s' is a %s in %s, not a method", methodName, descriptorKind(other), other.GetFile().GetName())
+	}
+	return nil, newMethodNotFoundError(methodName, allFiles)
+}
 
-	trimmedResults, err := runTrim(entryFds, methodNames, allFds)
-	if err != nil {
-		return nil, err
+// keepPackage requires every definition that the files of fds declaring
+// package pkg contain, passing their methods to addMethod.
+func (t *trimmer) keepPackage(pkg string, fds []*desc.FileDescriptor, addMethod func(*desc.MethodDescriptor)) error {
+	found := false
+	for _, fd := range fds {
+		if fd.GetPackage() != pkg {
+			continue
+		}
+		found = true
+		for _, md := range fd.GetMessageTypes() {
+			t.collectDependencies(md, 0)
+		}
+		for _, ed := range fd.GetEnumTypes() {
+			t.collectEnum(ed, 0)
+		}
+		for _, service := range fd.GetServices() {
+			for _, method := range service.GetMethods() {
+				addMethod(method)
+			}
+		}
+		for _, ext := range fd.GetExtensions() {
+			t.requiredExts[ext.Unwrap().FullName()] = struct{}{}
+			t.collectExtension(ext)
+		}
+	}
+	if !found {
+		return fmt.Errorf("package %s not found in the entry files or their imports", pkg)
 	}
+	return nil
+}
 
-	finalResults := make(map[string]string)
-	for trimmedPath, content := range trimmedResults {
-		realPath := findRealPath(trimmedPath, importPaths, protoContents)
-		finalResults[realPath] = content
+// findMessageByFullName looks up a message by its fully-qualified name.
+func findMessageByFullName(messageName string, allFiles []*desc.FileDescriptor) (*desc.MessageDescriptor, error) {
+	for _, fd := range allFiles {
+		switch d := fd.FindSymbol(messageName).(type) {
+		case nil:
+			continue
+		case *desc.MessageDescriptor:
+			return d, nil
+		default:
+			return nil, fmt.Errorf("'%s' is a %s in %s, not a message", messageName, descriptorKind(d), d.GetFile().GetName())
+		}
 	}
+	return nil, fmt.Errorf("message '%s' not found in any of the provided entry files or their imports", messageName)
+}
 
-	return finalResults, nil
+// findEnumByFullName looks up an enum by its fully-qualified name.
+func findEnumByFullName(enumName string, allFiles []*desc.FileDescriptor) (*desc.EnumDescriptor, error) {
+	for _, fd := range allFiles {
+		switch d := fd.FindSymbol(enumName).(type) {
+		case nil:
+			continue
+		case *desc.EnumDescriptor:
+			return d, nil
+		default:
+			return nil, fmt.Errorf("'%s' is a %s in %s, not an enum", enumName, descriptorKind(d), d.GetFile().GetName())
+		}
+	}
+	return nil, fmt.Errorf("enum '%s' not found in any of the provided entry files or their imports", enumName)
 }
 
-func collectAllDependencies(entryFds []*desc.FileDescriptor) []*desc.FileDescriptor {
-	allFdsMap := make(map[string]*desc.FileDescriptor)
-	queue := make([]*desc.FileDescriptor, len(entryFds))
-	copy(queue, entryFds)
+// resolveAnyTypes looks up the fields and messages named in
+// Options.AnyTypes. Every field must hold a google.protobuf.Any.
+func (t *trimmer) resolveAnyTypes(fds []*desc.FileDescriptor) error {
+	fieldNames := make([]string, 0, len(t.opts.AnyTypes))
+	for fieldName := range t.opts.AnyTypes {
+		fieldNames = append(fieldNames, fieldName)
+	}
+	sort.Strings(fieldNames)
 
-	for len(queue) > 0 {
-		fd := queue[0]
-		queue = queue[1:]
+	var errs []error
+	for _, fieldName := range fieldNames {
+		field, err := findFieldByFullName(fieldName, fds)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if mt := field.GetMessageType(); mt == nil || mt.GetFullyQualifiedName() != "google.protobuf.Any" {
+			errs = append(errs, fmt.Errorf("field '%s' is not a google.protobuf.Any", fieldName))
+			continue
+		}
+		for _, messageName := range t.opts.AnyTypes[fieldName] {
+			md, err := findMessageByFullName(messageName, fds)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			t.anyTypes[fieldName] = append(t.anyTypes[fieldName], md)
+		}
+	}
+	return errors.Join(errs...)
+}
 
-		if _, visited := allFdsMap[fd.GetName()]; visited {
+// findFieldByFullName looks up a field by its fully-qualified name.
+func findFieldByFullName(fieldName string, allFiles []*desc.FileDescriptor) (*desc.FieldDescriptor, error) {
+	for _, fd := range allFiles {
+		switch d := fd.FindSymbol(fieldName).(type) {
+		case nil:
 			continue
+		case *desc.FieldDescriptor:
+			return d, nil
+		default:
+			return nil, fmt.Errorf("'%s' is a %s in %s, not a field", fieldName, descriptorKind(d), d.GetFile().GetName())
 		}
-		allFdsMap[fd.GetName()] = fd
+	}
+	return nil, fmt.Errorf("field '%s' not found in any of the provided entry files or their imports", fieldName)
+}
 
-		for _, dep := range fd.GetDependencies() {
-			queue = append(queue, dep)
+// findTypeByFullName looks up a message or enum by its fully-qualified name.
+func findTypeByFullName(typeName string, allFiles []*desc.FileDescriptor) (desc.Descriptor, error) {
+	for _, fd := range allFiles {
+		switch d := fd.FindSymbol(typeName).(type) {
+		case nil:
+			continue
+		case *desc.MessageDescriptor, *desc.EnumDescriptor:
+			return d, nil
+		default:
+			return nil, fmt.Errorf("'%s' is a %s in %s, not a message or enum", typeName, descriptorKind(d), d.GetFile().GetName())
 		}
 	}
+	return nil, fmt.Errorf("type '%s' not found in any of the provided entry files or their imports", typeName)
+}
 
-	result := make([]*desc.FileDescriptor, 0, len(allFdsMap))
-	for _, fd := range allFdsMap {
-		result = append(result, fd)
+// descriptorKind names the kind of element d describes, for error messages.
+func descriptorKind(d desc.Descriptor) string {
+	switch d.(type) {
+	case *desc.MessageDescriptor:
+		return "message"
+	case *desc.FieldDescriptor:
+		return "field"
+	case *desc.OneOfDescriptor:
+		return "oneof"
+	case *desc.EnumDescriptor:
+		return "enum"
+	case *desc.EnumValueDescriptor:
+		return "enum value"
+	case *desc.ServiceDescriptor:
+		return "service"
+	default:
+		return "symbol"
 	}
-	return result
 }
 
-func runTrim(entryFileDescs []*desc.FileDescriptor, methodNames []string, fds []*desc.FileDescriptor) (map[string]string, error) {
-	if len(entryFileDescs) == 0 {
-		return nil, fmt.Errorf("no entry proto files were parsed successfully")
+// isGlobPattern reports whether name contains shell-style wildcards.
+func isGlobPattern(name string) bool {
+	return strings.ContainsAny(name, "*?[")
+}
+
+// matchMethodGlob returns the methods of service whose simple name matches
+// the shell-style pattern, as understood by path.Match.
+func (t *trimmer) matchMethodGlob(methodName string, service *desc.ServiceDescriptor, pattern string) ([]*desc.MethodDescriptor, error) {
+	var foundMethods []*desc.MethodDescriptor
+	for _, method := range service.GetMethods() {
+		matched, err := path.Match(pattern, method.GetName())
+		if err != nil {
+			return nil, fmt.Errorf("invalid method pattern '%s': %w", methodName, err)
+		}
+		if matched {
+			foundMethods = append(foundMethods, method)
+		}
 	}
+	if len(foundMethods) > 0 {
+		t.logger.Printf("Found %d methods matching '%s'", len(foundMethods), methodName)
+	}
+	return foundMethods, nil
+}
 
-	t := newTrimmer()
+// findMethodsByRegex selects every method of the entry files' services whose
+// simple name matches pattern. An empty match set only produces a warning.
+func (t *trimmer) findMethodsByRegex(pattern string, entryFiles []*desc.FileDescriptor) ([]*desc.MethodDescriptor, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid method regex '%s': %w", pattern, err)
+	}
 
-	if len(methodNames) == 0 {
-		for _, fd := range entryFileDescs {
-			for _, service := range fd.GetServices() {
-				t.entryPointMethods = append(t.entryPointMethods, service.GetMethods()...)
+	var foundMethods []*desc.MethodDescriptor
+	for _, entryFile := range entryFiles {
+		for _, service := range entryFile.GetServices() {
+			for _, method := range service.GetMethods() {
+				if re.MatchString(method.GetName()) {
+					foundMethods = append(foundMethods, method)
+				}
 			}
 		}
-	} else {
-		for _, methodName := range methodNames {
-			methods, err := findMethods(methodName, entryFileDescs, fds)
-			if err != nil {
-				return nil, err
+	}
+	if len(foundMethods) == 0 {
+		t.logger.Printf("Warning: No methods matched the regex '%s'.", pattern)
+		return nil, nil
+	}
+	t.logger.Printf("Found %d methods matching regex '%s'", len(foundMethods), pattern)
+	return foundMethods, nil
+}
+
+// unlimitedDepth is the depth at which definitions are collected regardless of
+// MaxDepth, such as the types of custom options, which cannot be cut short.
+const unlimitedDepth = -1
+
+// visit marks name as required at depth and reports whether its dependencies
+// still need collecting: it was not required yet, or MaxDepth is set and it is
+// now reached in fewer steps.
+func (t *trimmer) visit(required map[protoreflect.FullName]struct{}, name protoreflect.FullName, depth int) bool {
+	if _, ok := required[name]; ok {
+		if prev, ok := t.depths[name]; !ok || prev <= depth {
+			return false
+		}
+	}
+	required[name] = struct{}{}
+	if t.opts.MaxDepth != nil {
+		t.depths[name] = depth
+	}
+	return true
+}
+
+// collectDependencies marks md as required, together with the types it
+// references. depth counts the fields followed to reach md; with MaxDepth the
+// types of its fields are only collected while depth is below it.
+func (t *trimmer) collectDependencies(md *desc.MessageDescriptor, depth int) {
+	if t.isExcluded(md) || !t.visit(t.requiredMessages, md.Unwrap().FullName(), depth) {
+		return
+	}
+	// Nested types, such as proto2 groups, are emitted as part of their
+	// enclosing message, so that message is needed too.
+	if parent, ok := md.GetParent().(*desc.MessageDescriptor); ok {
+		t.collectDependencies(parent, depth)
+	}
+	// Nested messages are emitted with md, so whatever they reference is
+	// needed as well.
+	for _, nested := range md.GetNestedMessageTypes() {
+		t.collectDependencies(nested, depth)
+	}
+	if depth == unlimitedDepth || t.opts.MaxDepth == nil || depth < *t.opts.MaxDepth {
+		next := depth
+		if depth != unlimitedDepth {
+			next++
+		}
+		for _, field := range md.GetFields() {
+			if typ := fieldType(field); typ != nil && t.isExcluded(typ) {
+				if !md.IsMapEntry() { // Reported on the map field itself
+					t.excludedRefs[field.GetFullyQualifiedName()] = typ.GetFullyQualifiedName()
+				}
+				continue
+			}
+			t.collectFieldType(field, next)
+			for _, concrete := range t.anyTypes[field.GetFullyQualifiedName()] {
+				t.collectDependencies(concrete, next)
 			}
-			t.entryPointMethods = append(t.entryPointMethods, methods...)
 		}
 	}
+	// Options set on the emitted fields, oneofs, extension ranges and nested
+	// enums reference extensions that may live in files imported only by md's
+	// file
+	t.collectOptionDependencies(md.GetFile(), md.GetMessageOptions())
+	for _, field := range md.GetFields() {
+		if typ := fieldType(field); typ == nil || !t.isExcluded(typ) {
+			t.collectOptionDependencies(md.GetFile(), field.GetFieldOptions())
+		}
+	}
+	for _, oneof := range md.GetOneOfs() {
+		t.collectOptionDependencies(md.GetFile(), oneof.GetOneOfOptions())
+	}
+	for _, extRange := range md.AsDescriptorProto().GetExtensionRange() {
+		t.collectOptionDependencies(md.GetFile(), extRange.GetOptions())
+	}
+	for _, enum := range md.GetNestedEnumTypes() {
+		t.collectEnumOptionDependencies(enum)
+	}
+	// Nested extensions are emitted with md as well
+	for _, ext := range md.GetNestedExtensions() {
+		t.collectExtension(ext)
+	}
+}
 
-	for _, method := range t.entryPointMethods {
-		t.collectDependencies(method.GetInputType())
-		t.collectDependencies(method.GetOutputType())
+// collectFieldType collects the message or enum type of field, if any.
+func (t *trimmer) collectFieldType(field *desc.FieldDescriptor, depth int) {
+	if field.GetMessageType() != nil {
+		t.collectDependencies(field.GetMessageType(), depth)
+	}
+	if field.GetEnumType() != nil {
+		t.collectEnum(field.GetEnumType(), depth)
 	}
+}
+
+// collectExtension collects the type of ext and the message it extends.
+func (t *trimmer) collectExtension(ext *desc.FieldDescriptor) {
+	t.collectDependencies(ext.GetOwner(), unlimitedDepth)
+	t.collectFieldType(ext, unlimitedDepth)
+	t.collectOptionDependencies(ext.GetFile(), ext.GetFieldOptions())
+}
 
-	if len(t.entryPointMethods) == 0 && len(methodNames) > 0 {
-		fmt.Println("Warning: No methods matched the given names, no files will be trimmed.")
-		return make(map[string]string), nil
+// collectEnum marks ed as required, together with its enclosing message when
+// it is nested.
+func (t *trimmer) collectEnum(ed *desc.EnumDescriptor, depth int) {
+	if t.isExcluded(ed) || !t.visit(t.requiredEnums, ed.Unwrap().FullName(), depth) {
+		return
 	}
+	if parent, ok := ed.GetParent().(*desc.MessageDescriptor); ok {
+		t.collectDependencies(parent, depth) // Nested enums are emitted with their message
+	}
+	t.collectEnumOptionDependencies(ed)
+}
 
-	for _, fd := range fds {
-		if t.isFileRequired(fd) {
-			t.filesToTrim[fd.GetName()] = fd
-		}
+// collectEnumOptionDependencies keeps the custom options set on ed and on its
+// values.
+func (t *trimmer) collectEnumOptionDependencies(ed *desc.EnumDescriptor) {
+	t.collectOptionDependencies(ed.GetFile(), ed.GetEnumOptions())
+	for _, value := range ed.GetValues() {
+		t.collectOptionDependencies(ed.GetFile(), value.GetEnumValueOptions())
 	}
-	fmt.Printf("Found %d files containing required definitions.\n", len(t.filesToTrim))
+}
 
-	var filteredFileProtos []*descriptorpb.FileDescriptorProto
-	for _, originalFd := range t.filesToTrim {
-		newProto := t.filterFileDescriptor(originalFd)
-		filteredFileProtos = append(filteredFileProtos, newProto)
+// isExcluded reports whether the message or enum d is listed in
+// ExcludeTypes or nested in an excluded message.
+func (t *trimmer) isExcluded(d desc.Descriptor) bool {
+	if _, ok := t.excludedTypes[protoreflect.FullName(d.GetFullyQualifiedName())]; ok {
+		return true
 	}
+	parent, ok := d.GetParent().(*desc.MessageDescriptor)
+	return ok && t.isExcluded(parent)
+}
 
-	fileSet := &descriptorpb.FileDescriptorSet{File: filteredFileProtos}
-	newFds, err := desc.CreateFileDescriptorsFromSet(fileSet)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create new descriptors from filtered set: %w", err)
+// fieldType returns the message or enum type of field, or the value type of a
+// map field, or nil for scalars.
+func fieldType(field *desc.FieldDescriptor) desc.Descriptor {
+	if field.IsMap() {
+		field = field.GetMapValueType()
 	}
+	if field.GetMessageType() != nil {
+		return field.GetMessageType()
+	}
+	if field.GetEnumType() != nil {
+		return field.GetEnumType()
+	}
+	return nil
+}
 
-	p := &protoprint.Printer{}
-	result := make(map[string]string)
-	for path, newFd := range newFds {
-		str, err := p.PrintProtoToString(newFd)
-		if err != nil {
-			return nil, fmt.Errorf("failed to print new proto file %s: %w", path, err)
+// checkExcludedTypes fails when an excluded type is the request or response
+// of a kept method, or, unless StripExcludedFields is set, when a kept
+// message has a field of an excluded type.
+func (t *trimmer) checkExcludedTypes() error {
+	var errs []error
+	for _, method := range t.entryPointMethods {
+		for _, md := range []*desc.MessageDescriptor{method.GetInputType(), method.GetOutputType()} {
+			if t.isExcluded(md) {
+				errs = append(errs, fmt.Errorf("method %s uses excluded type %s", method.GetFullyQualifiedName(), md.GetFullyQualifiedName()))
+			}
+		}
+	}
+	if !t.opts.StripExcludedFields {
+		fields := make([]string, 0, len(t.excludedRefs))
+		for field := range t.excludedRefs {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+		for _, field := range fields {
+			errs = append(errs, fmt.Errorf("field %s references excluded type %s, set StripExcludedFields to remove such fields", field, t.excludedRefs[field]))
 		}
-		result[path] = str
 	}
+	return errors.Join(errs...)
+}
 
-	fmt.Println("\nDone!")
-	return result, nil
+// collectOptionDependencies keeps the custom options set in opts, such as
+// google.api.http on a method, together with the types of their values and
+// the options message they extend.
+func (t *trimmer) collectOptionDependencies(fd *desc.FileDescriptor, opts proto.Message) {
+	for _, ext := range optionExtensions(fd, opts) {
+		if parent, ok := ext.GetParent().(*desc.MessageDescriptor); ok {
+			t.collectDependencies(parent, unlimitedDepth) // Nested extensions are emitted with their message
+		} else {
+			t.requiredExts[ext.Unwrap().FullName()] = struct{}{}
+		}
+		t.collectExtension(ext)
+	}
+	for _, md := range optionAnyTypes(fd, opts) {
+		t.collectDependencies(md, unlimitedDepth)
+	}
 }
 
-func findMethods(methodName string, entryFiles []*desc.FileDescriptor, allFiles []*desc.FileDescriptor) ([]*desc.MethodDescriptor, error) {
-	dotCount := strings.Count(methodName, ".")
+// optionExtensions returns the extensions set in opts, looked up among fd and
+// the files it transitively imports. The parser leaves custom options as
+// unknown fields, so they are matched by extendee and field number.
+func optionExtensions(fd *desc.FileDescriptor, opts proto.Message) []*desc.FieldDescriptor {
+	if opts == nil || !opts.ProtoReflect().IsValid() {
+		return nil
+	}
+	numbers := make(map[protowire.Number]struct{})
+	opts.ProtoReflect().Range(func(field protoreflect.FieldDescriptor, _ protoreflect.Value) bool {
+		if field.IsExtension() {
+			numbers[field.Number()] = struct{}{}
+		}
+		return true
+	})
+	for unknown := opts.ProtoReflect().GetUnknown(); len(unknown) > 0; {
+		number, typ, n := protowire.ConsumeTag(unknown)
+		if n < 0 {
+			break
+		}
+		m := protowire.ConsumeFieldValue(number, typ, unknown[n:])
+		if m < 0 {
+			break
+		}
+		numbers[number] = struct{}{}
+		unknown = unknown[n+m:]
+	}
+	if len(numbers) == 0 {
+		return nil
+	}
 
-	if dotCount >= 2 { // Fully qualified name (e.g., package.Service.Method)
-		for _, fd := range allFiles {
-			if d := fd.FindSymbol(methodName); d != nil {
-				if md, ok := d.(*desc.MethodDescriptor); ok {
-					return []*desc.MethodDescriptor{md}, nil
-				}
+	extendee := string(opts.ProtoReflect().Descriptor().FullName())
+	var exts []*desc.FieldDescriptor
+	visited := make(map[string]struct{})
+	var visit func(f *desc.FileDescriptor)
+	visit = func(f *desc.FileDescriptor) {
+		if _, ok := visited[f.GetName()]; ok {
+			return
+		}
+		visited[f.GetName()] = struct{}{}
+		for _, ext := range fileExtensions(f) {
+			if _, ok := numbers[protowire.Number(ext.GetNumber())]; ok && ext.GetOwner().GetFullyQualifiedName() == extendee {
+				exts = append(exts, ext)
 			}
 		}
-	} else if dotCount == 1 { // Service.Method
-		parts := strings.Split(methodName, ".")
-		serviceName, simpleMethodName := parts[0], parts[1]
-		for _, entryFile := range entryFiles {
-			for _, service := range entryFile.GetServices() {
-				if service.GetName() == serviceName {
-					if method := service.FindMethodByName(simpleMethodName); method != nil {
-						return []*desc.MethodDescriptor{method}, nil
-					}
+		for _, dep := range f.GetDependencies() {
+			visit(dep)
+		}
+	}
+	visit(fd)
+	return exts
+}
+
+// optionAnyTypes returns the messages packed in the google.protobuf.Any values
+// of the custom options set in opts, such as
+// { [type.googleapis.com/pkg.Detail]: { ... } } in a message literal. Their
+// types are named only by the type URL, so they are not reached through the
+// fields of the option types. Types that cannot be found among fd and its
+// imports are skipped.
+func optionAnyTypes(fd *desc.FileDescriptor, opts proto.Message) []*desc.MessageDescriptor {
+	exts := optionExtensions(fd, opts)
+	byNumber := make(map[protowire.Number]*desc.MessageDescriptor, len(exts))
+	for _, ext := range exts {
+		if ext.GetMessageType() != nil {
+			byNumber[protowire.Number(ext.GetNumber())] = ext.GetMessageType()
+		}
+	}
+	if len(byNumber) == 0 {
+		return nil
+	}
+	data, err := proto.MarshalOptions{Deterministic: true}.Marshal(opts)
+	if err != nil {
+		return nil
+	}
+
+	var packed []*desc.MessageDescriptor
+	var walk func(md *desc.MessageDescriptor, b []byte)
+	walk = func(md *desc.MessageDescriptor, b []byte) {
+		var typeURL string
+		var value []byte
+		for len(b) > 0 {
+			number, typ, n := protowire.ConsumeTag(b)
+			if n < 0 {
+				return
+			}
+			m := protowire.ConsumeFieldValue(number, typ, b[n:])
+			if m < 0 {
+				return
+			}
+			field := b[n : n+m]
+			b = b[n+m:]
+			if typ != protowire.BytesType {
+				continue
+			}
+			content, _ := protowire.ConsumeBytes(field)
+			if md == nil {
+				if mt, ok := byNumber[number]; ok {
+					walk(mt, content)
 				}
+				continue
 			}
-		}
-	} else { // Partial method name match
-		var foundMethods []*desc.MethodDescriptor
-		for _, entryFile := range entryFiles {
-			for _, service := range entryFile.GetServices() {
-				for _, method := range service.GetMethods() {
-					if strings.Contains(method.GetName(), methodName) {
-						foundMethods = append(foundMethods, method)
-					}
+			if md.GetFullyQualifiedName() == "google.protobuf.Any" {
+				switch number {
+				case 1:
+					typeURL = string(content)
+				case 2:
+					value = content
 				}
+				continue
+			}
+			if f := md.FindFieldByNumber(int32(number)); f != nil && f.GetMessageType() != nil {
+				walk(f.GetMessageType(), content)
 			}
 		}
-		if len(foundMethods) > 0 {
-			fmt.Printf("Found %d methods matching '%s'\n", len(foundMethods), methodName)
-			return foundMethods, nil
+		if typeURL == "" {
+			return
+		}
+		name := typeURL[strings.LastIndex(typeURL, "/")+1:]
+		if mt, err := findMessageByFullName(name, collectAllDependencies([]*desc.FileDescriptor{fd})); err == nil {
+			packed = append(packed, mt)
+			walk(mt, value)
 		}
 	}
-
-	return nil, fmt.Errorf("method matching '%s' not found in any of the provided entry files or their imports", methodName)
+	walk(nil, data)
+	return packed
 }
 
-func (t *trimmer) collectDependencies(md *desc.MessageDescriptor) {
-	if _, ok := t.requiredMessages[md.Unwrap().FullName()]; ok {
-		return
-	}
-	t.requiredMessages[md.Unwrap().FullName()] = struct{}{}
-	for _, field := range md.GetFields() {
-		if field.GetMessageType() != nil {
-			t.collectDependencies(field.GetMessageType())
+// fileExtensions lists the top-level and nested extensions declared in fd.
+func fileExtensions(fd *desc.FileDescriptor) []*desc.FieldDescriptor {
+	exts := append([]*desc.FieldDescriptor(nil), fd.GetExtensions()...)
+	var addNested func(md *desc.MessageDescriptor)
+	addNested = func(md *desc.MessageDescriptor) {
+		exts = append(exts, md.GetNestedExtensions()...)
+		for _, nested := range md.GetNestedMessageTypes() {
+			addNested(nested)
 		}
-		if field.GetEnumType() != nil {
-			t.requiredEnums[field.GetEnumType().Unwrap().FullName()] = struct{}{}
+	}
+	for _, md := range fd.GetMessageTypes() {
+		addNested(md)
+	}
+	return exts
+}
+
+// methodIndex returns the position of method within its service.
+func methodIndex(method *desc.MethodDescriptor) int {
+	for i, m := range method.GetService().GetMethods() {
+		if m == method {
+			return i
 		}
 	}
+	return -1
+}
+
+// usesRequiredMessage reports whether the input or output of method is
+// already required.
+func (t *trimmer) usesRequiredMessage(method *desc.MethodDescriptor) bool {
+	_, input := t.requiredMessages[method.GetInputType().Unwrap().FullName()]
+	_, output := t.requiredMessages[method.GetOutputType().Unwrap().FullName()]
+	return input || output
 }
 
+// isFileRequired reports whether fd declares an entry method or a required
+// top-level definition. Nested types need no check of their own, since
+// requiring one requires its enclosing message as well.
 func (t *trimmer) isFileRequired(fd *desc.FileDescriptor) bool {
-	for _, m := range t.entryPointMethods {
-		if fd.GetFile().GetName() == m.GetFile().GetName() {
+	if _, ok := t.methodFiles[fd.GetName()]; ok {
+		return true
+	}
+	for _, ext := range fd.GetExtensions() {
+		if _, ok := t.requiredExts[ext.Unwrap().FullName()]; ok {
 			return true
 		}
 	}
@@ -225,14 +1528,96 @@ func (t *trimmer) isFileRequired(fd *desc.FileDescriptor) bool {
 	return false
 }
 
+// collectFiles selects the files of fds that declare a required definition.
+// The custom options set on a selected file, and with FileGranularity all of
+// its definitions, can require definitions of further files, so selection
+// repeats until no file is added.
+func (t *trimmer) collectFiles(fds []*desc.FileDescriptor) {
+	optionsCollected := make(map[string]struct{})
+	for {
+		for _, fd := range fds {
+			if t.isFileRequired(fd) {
+				t.filesToTrim[fd.GetName()] = fd
+			}
+		}
+		t.keepPublicReexports()
+		if len(optionsCollected) == len(t.filesToTrim) {
+			return
+		}
+		for name, fd := range t.filesToTrim {
+			if _, ok := optionsCollected[name]; !ok {
+				optionsCollected[name] = struct{}{}
+				t.collectOptionDependencies(fd, fd.GetFileOptions())
+				if t.opts.FileGranularity {
+					for _, md := range fd.GetMessageTypes() {
+						t.collectDependencies(md, 0)
+					}
+					for _, ed := range fd.GetEnumTypes() {
+						t.collectEnum(ed, 0)
+					}
+				}
+			}
+		}
+	}
+}
+
+// keepPublicReexports adds the files through which a kept file reaches a
+// required file via `import public`, so the re-exported symbols still resolve
+// in the trimmed output.
+func (t *trimmer) keepPublicReexports() {
+	for changed := true; changed; {
+		changed = false
+		for _, fd := range t.filesToTrim {
+			for _, dep := range fd.GetDependencies() {
+				if _, ok := t.filesToTrim[dep.GetName()]; ok {
+					continue
+				}
+				for _, exported := range publicClosure(dep) {
+					if _, ok := t.filesToTrim[exported.GetName()]; ok {
+						t.filesToTrim[dep.GetName()] = dep
+						changed = true
+						break
+					}
+				}
+			}
+		}
+	}
+}
+
+// publicClosure returns the files fd re-exports through `import public`,
+// following chains of public imports.
+func publicClosure(fd *desc.FileDescriptor) []*desc.FileDescriptor {
+	var closure []*desc.FileDescriptor
+	seen := make(map[string]struct{})
+	queue := fd.GetPublicDependencies()
+	for len(queue) > 0 {
+		dep := queue[0]
+		queue = queue[1:]
+		if _, ok := seen[dep.GetName()]; ok {
+			continue
+		}
+		seen[dep.GetName()] = struct{}{}
+		closure = append(closure, dep)
+		queue = append(queue, dep.GetPublicDependencies()...)
+	}
+	return closure
+}
+
+// filterFileDescriptor builds the trimmed copy of originalFd. Every descriptor
+// proto is cloned, since the originals are shared with the parser (or with the
+// caller's Options.DescriptorSet) and the result may be mutated downstream.
 func (t *trimmer) filterFileDescriptor(originalFd *desc.FileDescriptor) *descriptorpb.FileDescriptorProto {
 	newProto := &descriptorpb.FileDescriptorProto{
 		Name:    stringPtr(originalFd.GetName()),
 		Package: stringPtr(originalFd.GetPackage()),
-		Options: originalFd.GetFileOptions(),
+		Options: cloneOptions(originalFd.GetFileOptions()),
 	}
 
-	if originalFd.IsProto3() {
+	if originalFileProto := originalFd.AsFileDescriptorProto(); originalFileProto.GetSyntax() == "editions" {
+		// Editions files carry their semantics in the edition and feature options
+		newProto.Syntax = stringPtr("editions")
+		newProto.Edition = originalFileProto.Edition
+	} else if originalFd.IsProto3() {
 		newProto.Syntax = stringPtr("proto3")
 	} else {
 		newProto.Syntax = stringPtr("proto2")
@@ -240,6 +1625,7 @@ func (t *trimmer) filterFileDescriptor(originalFd *desc.FileDescriptor) *descrip
 
 	// Maps: original desc.Descriptor -> new Proto file index
 	origMsgToNewIndex := make(map[*desc.MessageDescriptor]int)
+	msgPrunings := make(map[*desc.MessageDescriptor]*fieldPruning)
 	origEnumToNewIndex := make(map[*desc.EnumDescriptor]int)
 	origServiceToNewIndex := make(map[*desc.ServiceDescriptor]int)
 	origMethodToNewIndex := make(map[*desc.ServiceDescriptor]map[*desc.MethodDescriptor]int)
@@ -248,7 +1634,9 @@ func (t *trimmer) filterFileDescriptor(originalFd *desc.FileDescriptor) *descrip
 	for _, msg := range originalFd.GetMessageTypes() {
 		if _, ok := t.requiredMessages[msg.Unwrap().FullName()]; ok {
 			origMsgToNewIndex[msg] = len(newProto.MessageType)
-			newProto.MessageType = append(newProto.MessageType, msg.AsDescriptorProto())
+			msgProto := proto.Clone(msg.AsDescriptorProto()).(*descriptorpb.DescriptorProto)
+			msgPrunings[msg] = t.pruneFields(msg, msgProto)
+			newProto.MessageType = append(newProto.MessageType, msgProto)
 		}
 	}
 
@@ -256,7 +1644,14 @@ func (t *trimmer) filterFileDescriptor(originalFd *desc.FileDescriptor) *descrip
 	for _, enum := range originalFd.GetEnumTypes() {
 		if _, ok := t.requiredEnums[enum.Unwrap().FullName()]; ok {
 			origEnumToNewIndex[enum] = len(newProto.EnumType)
-			newProto.EnumType = append(newProto.EnumType, enum.AsEnumDescriptorProto())
+			newProto.EnumType = append(newProto.EnumType, proto.Clone(enum.AsEnumDescriptorProto()).(*descriptorpb.EnumDescriptorProto))
+		}
+	}
+
+	// Keep the top-level extensions used by kept options
+	for _, ext := range originalFd.GetExtensions() {
+		if _, ok := t.requiredExts[ext.Unwrap().FullName()]; ok {
+			newProto.Extension = append(newProto.Extension, proto.Clone(ext.AsFieldDescriptorProto()).(*descriptorpb.FieldDescriptorProto))
 		}
 	}
 
@@ -274,30 +1669,85 @@ func (t *trimmer) filterFileDescriptor(originalFd *desc.FileDescriptor) *descrip
 			origServiceToNewIndex[svc] = len(newProto.Service)
 			newSvcProto := &descriptorpb.ServiceDescriptorProto{
 				Name:    stringPtr(svc.GetName()),
-				Options: svc.GetServiceOptions(),
+				Options: cloneOptions(svc.GetServiceOptions()),
 			}
+			// Emit methods in declaration order rather than the order they were selected in
+			sort.SliceStable(methods, func(i, j int) bool {
+				return methodIndex(methods[i]) < methodIndex(methods[j])
+			})
 			methodMap := make(map[*desc.MethodDescriptor]int)
 			for _, method := range methods {
 				methodMap[method] = len(newSvcProto.Method)
-				newSvcProto.Method = append(newSvcProto.Method, method.AsMethodDescriptorProto())
+				newSvcProto.Method = append(newSvcProto.Method, proto.Clone(method.AsMethodDescriptorProto()).(*descriptorpb.MethodDescriptorProto))
 			}
 			newProto.Service = append(newProto.Service, newSvcProto)
 			origMethodToNewIndex[svc] = methodMap
 		}
 	}
 
-	// Process dependencies
+	// Process dependencies, keeping only the imports the kept definitions use
+	referenced := make(map[string]struct{})
+	for msg := range origMsgToNewIndex {
+		t.addMessageReferences(referenced, msg)
+	}
+	for _, methods := range methodsByService {
+		for _, method := range methods {
+			referenced[method.GetInputType().GetFile().GetName()] = struct{}{}
+			referenced[method.GetOutputType().GetFile().GetName()] = struct{}{}
+			addOptionReferences(referenced, originalFd, method.GetMethodOptions())
+		}
+	}
+	addOptionReferences(referenced, originalFd, originalFd.GetFileOptions())
+	for svc := range origServiceToNewIndex {
+		addOptionReferences(referenced, originalFd, svc.GetServiceOptions())
+	}
+	for enum := range origEnumToNewIndex {
+		addEnumOptionReferences(referenced, enum)
+	}
+	for _, ext := range originalFd.GetExtensions() {
+		if _, ok := t.requiredExts[ext.Unwrap().FullName()]; !ok {
+			continue
+		}
+		referenced[ext.GetOwner().GetFile().GetName()] = struct{}{}
+		addOptionReferences(referenced, originalFd, ext.GetFieldOptions())
+		if ext.GetMessageType() != nil {
+			referenced[ext.GetMessageType().GetFile().GetName()] = struct{}{}
+		}
+		if ext.GetEnumType() != nil {
+			referenced[ext.GetEnumType().GetFile().GetName()] = struct{}{}
+		}
+	}
+	publicDeps := make(map[string]struct{})
+	for _, dep := range originalFd.GetPublicDependencies() {
+		publicDeps[dep.GetName()] = struct{}{}
+	}
 	for _, dep := range originalFd.GetDependencies() {
-		if _, ok := t.filesToTrim[dep.GetName()]; ok {
+		if _, ok := t.filesToTrim[dep.GetName()]; !ok {
+			continue
+		}
+		_, used := referenced[dep.GetName()]
+		for _, exported := range publicClosure(dep) {
+			if _, ok := referenced[exported.GetName()]; ok {
+				used = true
+			}
+		}
+		_, public := publicDeps[dep.GetName()]
+		// Keep imports still referenced, public imports for the files relying
+		// on the re-export, and every import with KeepUnusedImports
+		if used || public || t.opts.KeepUnusedImports {
+			if public {
+				newProto.PublicDependency = append(newProto.PublicDependency, int32(len(newProto.Dependency)))
+			}
 			newProto.Dependency = append(newProto.Dependency, dep.GetName())
 		}
 	}
 
 	// Rebuild SourceCodeInfo and re-index paths
 	originalFileProto := originalFd.AsFileDescriptorProto()
-	if originalFileProto != nil && originalFileProto.GetSourceCodeInfo() != nil {
+	if originalFileProto != nil && originalFileProto.GetSourceCodeInfo() != nil && !t.opts.OmitSourceInfo {
 		newSourceCodeInfo := &descriptorpb.SourceCodeInfo{}
 		originalLocations := originalFileProto.GetSourceCodeInfo().GetLocation()
+		entryMessages := t.entryMessages()
 
 		for _, loc := range originalLocations {
 			path := loc.GetPath()
@@ -316,7 +1766,7 @@ func (t *trimmer) filterFileDescriptor(originalFd *desc.FileDescriptor) *descrip
 							originalMsg := originalFd.GetMessageTypes()[originalMsgIndex]
 							if newIndex, ok := origMsgToNewIndex[originalMsg]; ok {
 								newPath[1] = int32(newIndex)
-								kept = true // Keep message-level comments and potentially nested elements if complex logic is added
+								kept = msgPrunings[originalMsg].remap(newPath[2:]) // Drop the comments of pruned fields
 							}
 						}
 					}
@@ -355,7 +1805,7 @@ func (t *trimmer) filterFileDescriptor(originalFd *desc.FileDescriptor) *descrip
 							}
 						}
 					}
-				case 1: // Package declaration
+				case 2, 8, 12, 14: // Package, file options, syntax and edition, which carry the file header
 					kept = true
 				}
 			}
@@ -363,6 +1813,12 @@ func (t *trimmer) filterFileDescriptor(originalFd *desc.FileDescriptor) *descrip
 			if kept {
 				newLoc := proto.Clone(loc).(*descriptorpb.SourceCodeInfo_Location)
 				newLoc.Path = newPath
+				if !t.keepsComments(originalFd, path, entryMessages) {
+					// Keep the span, which orders the printed elements
+					newLoc.LeadingComments = nil
+					newLoc.TrailingComments = nil
+					newLoc.LeadingDetachedComments = nil
+				}
 				newSourceCodeInfo.Location = append(newSourceCodeInfo.Location, newLoc)
 			}
 		}
@@ -372,17 +1828,112 @@ func (t *trimmer) filterFileDescriptor(originalFd *desc.FileDescriptor) *descrip
 	return newProto
 }
 
-func findRealPath(path string, importPaths []string, protoContents map[string]string) string {
-	for _, importPath := range importPaths {
-		joinedPath := filepath.Clean(filepath.Join(importPath, path))
-		if _, ok := protoContents[joinedPath]; ok {
-			return joinedPath
+// entryMessages returns the request and response messages of the selected
+// methods.
+func (t *trimmer) entryMessages() map[*desc.MessageDescriptor]struct{} {
+	messages := make(map[*desc.MessageDescriptor]struct{})
+	for _, method := range t.entryPointMethods {
+		messages[method.GetInputType()] = struct{}{}
+		messages[method.GetOutputType()] = struct{}{}
+	}
+	return messages
+}
+
+// keepsComments reports whether the comments at path, a SourceCodeInfo path
+// of fd, are within opts.CommentScope.
+func (t *trimmer) keepsComments(fd *desc.FileDescriptor, path []int32, entryMessages map[*desc.MessageDescriptor]struct{}) bool {
+	switch t.opts.CommentScope {
+	case CommentScopeNone:
+		return false
+	case CommentScopeEntryOnly:
+	default:
+		return true
+	}
+	switch {
+	case len(path) >= 4 && path[0] == 6 && path[2] == 2: // Method inside service
+		method := fd.GetServices()[path[1]].GetMethods()[path[3]]
+		for _, entry := range t.entryPointMethods {
+			if entry == method {
+				return true
+			}
+		}
+	case len(path) >= 2 && path[0] == 4: // Message, or something inside it
+		md := fd.GetMessageTypes()[path[1]]
+		for rest := path[2:]; ; rest = rest[2:] {
+			if _, ok := entryMessages[md]; ok {
+				return true
+			}
+			if len(rest) < 2 || rest[0] != messageNestedTypeField {
+				break
+			}
+			md = md.GetNestedMessageTypes()[rest[1]]
+		}
+	}
+	return false
+}
+
+// cloneOptions deep-copies an options message, keeping nil as nil.
+func cloneOptions[T proto.Message](opts T) T {
+	if !opts.ProtoReflect().IsValid() {
+		return opts
+	}
+	return proto.Clone(opts).(T)
+}
+
+// addMessageReferences records in files the names of the files declaring the
+// types used by md's emitted fields, nested messages and nested extensions.
+func (t *trimmer) addMessageReferences(files map[string]struct{}, md *desc.MessageDescriptor) {
+	fields := make([]*desc.FieldDescriptor, 0, len(md.GetFields())+len(md.GetNestedExtensions()))
+	fields = append(fields, md.GetFields()...)
+	fields = append(fields, md.GetNestedExtensions()...)
+	for _, field := range fields {
+		if !t.isFieldTypeEmitted(field) {
+			continue // Pruned
+		}
+		if field.GetMessageType() != nil {
+			files[field.GetMessageType().GetFile().GetName()] = struct{}{}
+		}
+		if field.GetEnumType() != nil {
+			files[field.GetEnumType().GetFile().GetName()] = struct{}{}
+		}
+		if field.IsExtension() {
+			files[field.GetOwner().GetFile().GetName()] = struct{}{}
 		}
+		addOptionReferences(files, md.GetFile(), field.GetFieldOptions())
+	}
+	addOptionReferences(files, md.GetFile(), md.GetMessageOptions())
+	for _, oneof := range md.GetOneOfs() {
+		addOptionReferences(files, md.GetFile(), oneof.GetOneOfOptions())
+	}
+	for _, extRange := range md.AsDescriptorProto().GetExtensionRange() {
+		addOptionReferences(files, md.GetFile(), extRange.GetOptions())
 	}
-	if _, ok := protoContents[path]; ok {
-		return path
+	for _, enum := range md.GetNestedEnumTypes() {
+		addEnumOptionReferences(files, enum)
+	}
+	for _, nested := range md.GetNestedMessageTypes() {
+		t.addMessageReferences(files, nested)
+	}
+}
+
+// addOptionReferences records the files declaring the custom options set in
+// opts.
+func addOptionReferences(files map[string]struct{}, fd *desc.FileDescriptor, opts proto.Message) {
+	for _, ext := range optionExtensions(fd, opts) {
+		files[ext.GetFile().GetName()] = struct{}{}
+	}
+	for _, md := range optionAnyTypes(fd, opts) {
+		files[md.GetFile().GetName()] = struct{}{}
+	}
+}
+
+// addEnumOptionReferences records the files declaring the custom options set
+// on ed and on its values.
+func addEnumOptionReferences(files map[string]struct{}, ed *desc.EnumDescriptor) {
+	addOptionReferences(files, ed.GetFile(), ed.GetEnumOptions())
+	for _, value := range ed.GetValues() {
+		addOptionReferences(files, ed.GetFile(), value.GetEnumValueOptions())
 	}
-	return path
 }
 
 func stringPtr(s string) *string {
@@ -1,13 +1,24 @@
 package trimpb
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
 	"testing"
 
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/desc/protoparse"
+	"github.com/jhump/protoreflect/desc/protoprint"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
 )
 
 func loadProtoFiles(t *testing.T, rootDir string, relativeFiles ...string) map[string]string {
@@ -143,6 +154,89 @@ func TestTrimMulti(t *testing.T) {
 				},
 			},
 		},
+		{
+			name:            "正则选择 - 锚定模式",
+			entryProtoFiles: []string{"project.proto"},
+			methodNames:     []string{"/^(Create|Delete)Project$/"},
+			importPaths:     []string{"example"},
+			protoContents: loadProtoFiles(t, "example",
+				"project.proto",
+				"common.proto",
+				"domain/user.proto",
+			),
+			expectedOutputKeys: []string{
+				"example/project.proto",
+				"example/common.proto",
+				"example/domain/user.proto",
+			},
+			expectedContains: map[string][]string{
+				"example/project.proto": {
+					`rpc CreateProject`,
+					`rpc DeleteProject`,
+					`message DeleteProjectResponse`,
+				},
+			},
+			expectedNotContains: map[string][]string{
+				"example/project.proto": {
+					`rpc GetProjectDetails`,
+				},
+			},
+		},
+		{
+			name:            "正则选择 - 非锚定模式",
+			entryProtoFiles: []string{"project.proto"},
+			methodNames:     []string{"/Details/"},
+			importPaths:     []string{"example"},
+			protoContents: loadProtoFiles(t, "example",
+				"project.proto",
+				"common.proto",
+				"domain/user.proto",
+			),
+			expectedOutputKeys: []string{
+				"example/project.proto",
+				"example/domain/user.proto",
+			},
+			expectedContains: map[string][]string{
+				"example/project.proto": {
+					`rpc GetProjectDetails`,
+					`message DeleteProjectRequest`,
+				},
+				"example/domain/user.proto": {
+					`message PersonalInfo`,
+				},
+			},
+			expectedNotContains: map[string][]string{
+				"example/project.proto": {
+					`rpc CreateProject`,
+					`rpc DeleteProject`,
+				},
+			},
+		},
+		{
+			name:            "正则选择 - 无匹配时不输出任何文件",
+			entryProtoFiles: []string{"project.proto"},
+			methodNames:     []string{"/^List/"},
+			importPaths:     []string{"example"},
+			protoContents: loadProtoFiles(t, "example",
+				"project.proto",
+				"common.proto",
+				"domain/user.proto",
+			),
+			expectedOutputKeys: []string{},
+		},
+		{
+			name:            "错误 - 非法正则",
+			entryProtoFiles: []string{"project.proto"},
+			methodNames:     []string{"/Create(/"},
+			importPaths:     []string{"example"},
+			protoContents: loadProtoFiles(t, "example",
+				"project.proto",
+				"common.proto",
+				"domain/user.proto",
+			),
+			expectError:   true,
+			errorContains: `invalid method regex 'Create('`,
+		},
 		{
 			name:            "同级目录导入裁剪 - Thrift 示例",
 			entryProtoFiles: []string{"turing/question_search/qs_service.proto"},
@@ -274,16 +368,8 @@ func TestTrimMulti(t *testing.T) {
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			// 在测试期间抑制函数中的标准输出
-			rescueStdout := os.Stdout
-			_, w, _ := os.Pipe()
-			os.Stdout = w
-
 			trimmedResult, err := TrimMulti(tc.entryProtoFiles, tc.methodNames, tc.importPaths, tc.protoContents)
 
-			w.Close()
-			os.Stdout = rescueStdout
-
 			if tc.expectError {
 				require.Error(t, err)
 				if tc.errorContains != "" {
@@ -321,3 +407,2022 @@ func TestTrimMulti(t *testing.T) {
 		})
 	}
 }
+
+func Test_TrimMulti_MethodGlob(t *testing.T) {
+	protoFiles := loadProtoFiles(t, "example/muit",
+		"api/v1/commerce_service.proto",
+		"api/v1/common_messages.proto",
+		"common/types/base.proto",
+		"common/types/money.proto",
+		"services/order/item.proto",
+		"services/order/order.proto",
+		"services/product/product.proto",
+		"services/product/review.proto",
+		"services/user/profile.proto",
+		"services/user/user.proto",
+	)
+	serviceFile := "example/muit/api/v1/commerce_service.proto"
+
+	testCases := []struct {
+		name           string
+		methodName     string
+		expectedRPCs   []string
+		unexpectedRPCs []string
+		errorContains  string
+	}{
+		{
+			name:           "星号匹配同一服务下的多个方法",
+			methodName:     "CommerceService.Get*",
+			expectedRPCs:   []string{"rpc GetUser", "rpc GetProduct", "rpc GetOrder"},
+			unexpectedRPCs: []string{"rpc CreateUser", "rpc ListProducts", "rpc PlaceOrder", "service TestService"},
+		},
+		{
+			name:           "问号匹配单个字符",
+			methodName:     "TestService.TestMethod?",
+			expectedRPCs:   []string{"rpc TestMethod2", "rpc TestMethod3"},
+			unexpectedRPCs: []string{"rpc TestMethod (", "service CommerceService"},
+		},
+		{
+			name:           "字符类匹配",
+			methodName:     "CommerceService.[CP]*",
+			expectedRPCs:   []string{"rpc CreateUser", "rpc PlaceOrder"},
+			unexpectedRPCs: []string{"rpc GetUser", "rpc GetOrder"},
+		},
+		{
+			name:           "全限定名中的通配符",
+			methodName:     "api.v1.CommerceService.*Order",
+			expectedRPCs:   []string{"rpc GetOrder", "rpc PlaceOrder"},
+			unexpectedRPCs: []string{"rpc GetUser", "rpc GetProduct"},
+		},
+		{
+			name:          "无匹配方法时报错",
+			methodName:    "CommerceService.Delete*",
+			errorContains: "method matching 'CommerceService.Delete*' not found",
+		},
+		{
+			name:          "非法通配符",
+			methodName:    "CommerceService.[",
+			errorContains: "invalid method pattern 'CommerceService.['",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result, err := TrimMulti([]string{"api/v1/commerce_service.proto"}, []string{tc.methodName}, []string{"example/muit"}, protoFiles)
+			if tc.errorContains != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tc.errorContains)
+				return
+			}
+			require.NoError(t, err)
+			for _, rpc := range tc.expectedRPCs {
+				assert.Contains(t, result[serviceFile], rpc)
+			}
+			for _, rpc := range tc.unexpectedRPCs {
+				assert.NotContains(t, result[serviceFile], rpc)
+			}
+		})
+	}
+}
+
+func TestTrimMultiToDescriptorSet(t *testing.T) {
+	protoFiles := loadProtoFiles(t, "example",
+		"project.proto",
+		"common.proto",
+		"domain/user.proto",
+	)
+	fileSet, err := TrimMultiToDescriptorSet([]string{"project.proto"}, []string{"ProjectService.CreateProject"}, []string{"example"}, protoFiles)
+	require.NoError(t, err)
+
+	// 依赖文件必须排在引用它的文件之前
+	var names []string
+	for _, fd := range fileSet.GetFile() {
+		names = append(names, fd.GetName())
+	}
+	require.Len(t, names, 3)
+	assert.Equal(t, "project.proto", names[2], "入口文件应该排在其依赖之后")
+
+	fds, err := desc.CreateFileDescriptorsFromSet(fileSet)
+	require.NoError(t, err)
+	projectFd, ok := fds["project.proto"]
+	require.True(t, ok, "描述符集合中缺少 project.proto")
+
+	assert.NotNil(t, projectFd.FindSymbol("project.v1.ProjectService.CreateProject"))
+	assert.NotNil(t, projectFd.FindSymbol("project.v1.CreateProjectResponse"))
+	assert.NotNil(t, fds["domain/user.proto"].FindSymbol("project.v1.user.User"))
+	assert.Nil(t, projectFd.FindSymbol("project.v1.ProjectService.DeleteProject"))
+	assert.Nil(t, projectFd.FindSymbol("project.v1.UnrelatedMessage"))
+	assert.Nil(t, fds["domain/user.proto"].FindSymbol("project.v1.user.PersonalInfo"))
+}
+
+func ExampleTrim() {
+	protoContents := map[string]string{
+		"protos/common.proto": `
+syntax = "proto3";
+package common.v1;
+message Status { int32 code = 1; }`,
+		"protos/project.proto": `
+syntax = "proto3";
+package project.v1;
+import "common.proto";
+service ProjectService {
+  rpc CreateProject(CreateProjectRequest) returns (common.v1.Status);
+  rpc DeleteProject(DeleteProjectRequest) returns (common.v1.Status);
+}
+message CreateProjectRequest { string name = 1; }
+message DeleteProjectRequest { string id = 1; }`,
+	}
+
+	result, err := Trim("project.proto", []string{"ProjectService.CreateProject"}, []string{"protos"}, protoContents)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(result["protos/project.proto"])
+	// Output:
+	// syntax = "proto3";
+	//
+	// package project.v1;
+	//
+	// import "common.proto";
+	//
+	// service ProjectService {
+	//   rpc CreateProject ( CreateProjectRequest ) returns ( common.v1.Status );
+	// }
+	//
+	// message CreateProjectRequest {
+	//   string name = 1;
+	// }
+}
+
+func TestTrim(t *testing.T) {
+	protoFiles := loadProtoFiles(t, "example",
+		"project.proto",
+		"common.proto",
+		"domain/user.proto",
+	)
+	result, err := Trim("project.proto", []string{"ProjectService.CreateProject"}, []string{"example"}, protoFiles)
+	require.NoError(t, err)
+
+	multi, err := TrimMulti([]string{"project.proto"}, []string{"ProjectService.CreateProject"}, []string{"example"}, protoFiles)
+	require.NoError(t, err)
+	assert.Equal(t, multi, result)
+}
+
+func Test_TrimMulti_PrunesUnusedImports(t *testing.T) {
+	protoFiles := loadProtoFiles(t, "example/muit",
+		"api/v1/commerce_service.proto",
+		"api/v1/common_messages.proto",
+		"common/types/base.proto",
+		"common/types/money.proto",
+		"services/order/item.proto",
+		"services/order/order.proto",
+		"services/product/product.proto",
+		"services/product/review.proto",
+		"services/user/profile.proto",
+		"services/user/user.proto",
+	)
+	result, err := TrimMulti([]string{"api/v1/commerce_service.proto"}, []string{"api.v1.CommerceService.PlaceOrder"}, []string{"example/muit"}, protoFiles)
+	require.NoError(t, err)
+
+	// product.proto 因 item.proto 的引用而被保留, 但裁剪后的 commerce_service.proto 不再使用它
+	require.Contains(t, result, "example/muit/services/product/product.proto")
+	serviceContent := result["example/muit/api/v1/commerce_service.proto"]
+	assert.NotContains(t, serviceContent, `import "services/product/product.proto";`)
+	assert.Contains(t, serviceContent, `import "services/order/order.proto";`)
+
+	assert.Contains(t, result["example/muit/services/order/item.proto"], `import "services/product/product.proto";`)
+}
+
+func Test_dropEmptyFiles(t *testing.T) {
+	fileProtos := []*descriptorpb.FileDescriptorProto{
+		{
+			Name:             proto.String("service.proto"),
+			Package:          proto.String("svc.v1"),
+			Dependency:       []string{"empty.proto", "types.proto"},
+			PublicDependency: []int32{1},
+			MessageType:      []*descriptorpb.DescriptorProto{{Name: proto.String("Request")}},
+		},
+		{
+			Name:    proto.String("empty.proto"),
+			Package: proto.String("svc.v1"),
+		},
+		{
+			Name:     proto.String("types.proto"),
+			Package:  proto.String("svc.v1"),
+			EnumType: []*descriptorpb.EnumDescriptorProto{{Name: proto.String("Kind")}},
+		},
+	}
+
+	kept := dropEmptyFiles(fileProtos)
+	require.Len(t, kept, 2)
+	assert.Equal(t, "service.proto", kept[0].GetName())
+	assert.Equal(t, "types.proto", kept[1].GetName())
+	assert.Equal(t, []string{"types.proto"}, kept[0].GetDependency(), "对空文件的导入应该被移除")
+	assert.Equal(t, []int32{0}, kept[0].GetPublicDependency(), "import public 的下标应该重新编号")
+}
+
+func Test_TrimMulti_PublicImport(t *testing.T) {
+	protoFiles := loadProtoFiles(t, "example",
+		"publicimport/entry.proto",
+		"publicimport/reexport.proto",
+		"publicimport/types.proto",
+	)
+	result, err := TrimMulti([]string{"publicimport/entry.proto"}, []string{"LookupService.Lookup"}, []string{"example"}, protoFiles)
+	require.NoError(t, err)
+	require.Len(t, result, 3, "仅用于 import public 转发的文件也必须保留")
+
+	reexport := result["example/publicimport/reexport.proto"]
+	assert.Contains(t, reexport, `import public "publicimport/types.proto";`)
+	assert.NotContains(t, reexport, "message UnusedLocal")
+	assert.Contains(t, result["example/publicimport/entry.proto"], `import "publicimport/reexport.proto";`)
+	assert.NotContains(t, result["example/publicimport/types.proto"], "message UnusedType")
+
+	// 裁剪结果重新解析后, 通过 import public 转发的符号仍然可以解析
+	parser := protoparse.Parser{
+		Accessor:    protoparse.FileContentsFromMap(result),
+		ImportPaths: []string{"example"},
+	}
+	fds, err := parser.ParseFiles("publicimport/entry.proto")
+	require.NoError(t, err)
+	method := fds[0].FindSymbol("publicimport.entry.LookupService.Lookup").(*desc.MethodDescriptor)
+	assert.Equal(t, "publicimport.types.LookupRequest", method.GetInputType().GetFullyQualifiedName())
+}
+
+// syntheticProtos 生成一个包含 n 个服务文件的入口 schema, 每个文件导入一个公共类型文件
+func syntheticProtos(n int) (map[string]string, []string) {
+	contents := map[string]string{
+		"synthetic/common.proto": `
+syntax = "proto3";
+package synthetic.common;
+message Meta { string id = 1; int64 created_at = 2; }
+enum Level { LEVEL_UNSPECIFIED = 0; LEVEL_HIGH = 1; }`,
+	}
+	entryFiles := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("svc%d.proto", i)
+		contents["synthetic/"+name] = fmt.Sprintf(`
+syntax = "proto3";
+package synthetic.svc%[1]d;
+import "common.proto";
+// Service%[1]d 的注释
+service Service%[1]d {
+  rpc Get(GetRequest) returns (GetResponse);
+  rpc List(GetRequest) returns (GetResponse);
+}
+message GetRequest { string id = 1; synthetic.common.Meta meta = 2; }
+message GetResponse { repeated string items = 1; synthetic.common.Level level = 2; }
+message Unused { bool flag = 1; }`, i)
+		entryFiles = append(entryFiles, name)
+	}
+	return contents, entryFiles
+}
+
+func trimmedDescriptors(b testing.TB, n int) map[string]*desc.FileDescriptor {
+	contents, entryFiles := syntheticProtos(n)
+	opts := Options{EntryFiles: entryFiles, ImportPaths: []string{"synthetic"}, ProtoContents: contents}
+	entryFds, allFds, err := opts.parse()
+	require.NoError(b, err)
+	newFds, err := buildTrimmedFiles(entryFds, allFds, opts)
+	require.NoError(b, err)
+	return newFds
+}
+
+func BenchmarkResolveTrimmer(b *testing.B) {
+	contents, entryFiles := syntheticProtos(500)
+	opts := Options{EntryFiles: entryFiles, ImportPaths: []string{"synthetic"}, ProtoContents: contents}
+	entryFds, allFds, err := opts.parse()
+	require.NoError(b, err)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := resolveTrimmer(entryFds, allFds, opts); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func Test_printFiles_ParallelMatchesSerial(t *testing.T) {
+	newFds := trimmedDescriptors(t, 50)
+
+	serial, err := printFiles(context.Background(), newFds, &protoprint.Printer{}, 1)
+	require.NoError(t, err)
+	parallel, err := printFiles(context.Background(), newFds, &protoprint.Printer{}, 8)
+	require.NoError(t, err)
+	assert.Len(t, serial, 51)
+	assert.Equal(t, serial, parallel)
+}
+
+func BenchmarkPrintFiles(b *testing.B) {
+	newFds := trimmedDescriptors(b, 500)
+	for name, workers := range map[string]int{"serial": 1, "parallel": runtime.GOMAXPROCS(0)} {
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := printFiles(context.Background(), newFds, &protoprint.Printer{}, workers); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func Test_TrimMulti_DeduplicatesMethods(t *testing.T) {
+	protoFiles := loadProtoFiles(t, "example",
+		"project.proto",
+		"common.proto",
+		"domain/user.proto",
+	)
+	methodNames := []string{
+		"ProjectService.CreateProject",
+		"project.v1.ProjectService.CreateProject",
+		"CreateProject",
+	}
+	result, err := TrimMulti([]string{"project.proto"}, methodNames, []string{"example"}, protoFiles)
+	require.NoError(t, err)
+	assert.Equal(t, 1, strings.Count(result["example/project.proto"], "rpc CreateProject"), "同一方法以不同写法指定时只应输出一次")
+}
+
+func Test_TrimMulti_FullyQualifiedNonMethod(t *testing.T) {
+	protoFiles := loadProtoFiles(t, "example",
+		"project.proto",
+		"common.proto",
+		"domain/user.proto",
+	)
+	_, err := TrimMulti([]string{"project.proto"}, []string{"project.v1.CreateProjectRequest"}, []string{"example"}, protoFiles)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "'project.v1.CreateProjectRequest' is a message in project.proto, not a method")
+
+	_, err = TrimMulti([]string{"project.proto"}, []string{"project.v1.ProjectService"}, []string{"example"}, protoFiles)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "'project.v1.ProjectService' is a service in project.proto, not a method")
+}
+
+func Test_TrimMulti_ReportsAllUnresolvedMethods(t *testing.T) {
+	protoFiles := loadProtoFiles(t, "example",
+		"project.proto",
+		"common.proto",
+		"domain/user.proto",
+	)
+	methodNames := []string{
+		"ProjectService.CreateProjct",
+		"ProjectService.CreateProject",
+		"project.v1.ProjectService.DeleteProjct",
+	}
+	_, err := TrimMulti([]string{"project.proto"}, methodNames, []string{"example"}, protoFiles)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "ProjectService.CreateProjct")
+	assert.Contains(t, err.Error(), "project.v1.ProjectService.DeleteProjct")
+	assert.Len(t, err.(interface{ Unwrap() []error }).Unwrap(), 2, "每个无法解析的名字对应一个错误")
+}
+
+func Test_findMethodByFullName_Ambiguous(t *testing.T) {
+	// 重叠的 import 根目录可能让两个文件声明同一个全限定方法名
+	newFile := func(name string) *desc.FileDescriptor {
+		fd, err := desc.CreateFileDescriptor(&descriptorpb.FileDescriptorProto{
+			Name:        proto.String(name),
+			Package:     proto.String("dup.v1"),
+			Syntax:      proto.String("proto3"),
+			MessageType: []*descriptorpb.DescriptorProto{{Name: proto.String("Empty")}},
+			Service: []*descriptorpb.ServiceDescriptorProto{{
+				Name: proto.String("DupService"),
+				Method: []*descriptorpb.MethodDescriptorProto{{
+					Name:       proto.String("Call"),
+					InputType:  proto.String(".dup.v1.Empty"),
+					OutputType: proto.String(".dup.v1.Empty"),
+				}},
+			}},
+		})
+		require.NoError(t, err)
+		return fd
+	}
+	first, second := newFile("a/dup.proto"), newFile("b/dup.proto")
+
+	methods, err := findMethodByFullName("dup.v1.DupService.Call", []*desc.FileDescriptor{first})
+	require.NoError(t, err)
+	require.Len(t, methods, 1)
+
+	_, err = findMethodByFullName("dup.v1.DupService.Call", []*desc.FileDescriptor{first, second})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "method 'dup.v1.DupService.Call' is ambiguous, it is defined in a/dup.proto, b/dup.proto")
+	var ambiguous *AmbiguousMethodError
+	require.True(t, errors.As(err, &ambiguous))
+	assert.Equal(t, "dup.v1.DupService.Call", ambiguous.Name)
+	assert.Equal(t, []string{"a/dup.proto", "b/dup.proto"}, ambiguous.Matches)
+}
+
+func Test_TrimMulti_ServiceInImportedFile(t *testing.T) {
+	protoFiles := loadProtoFiles(t, "example",
+		"importedservice/entry.proto",
+		"importedservice/shared.proto",
+	)
+
+	// SharedService.Ping 只在被导入的 shared.proto 中声明
+	result, err := TrimMulti([]string{"importedservice/entry.proto"}, []string{"SharedService.Ping"}, []string{"example"}, protoFiles)
+	require.NoError(t, err)
+	require.Len(t, result, 1)
+	shared := result["example/importedservice/shared.proto"]
+	assert.Contains(t, shared, "service SharedService")
+	assert.Contains(t, shared, "rpc Ping (")
+	assert.NotContains(t, shared, "rpc Audit (")
+	assert.NotContains(t, shared, "message AuditRequest")
+
+	// 同名服务同时存在于入口文件和导入文件时, 优先使用入口文件中的
+	result, err = TrimMulti([]string{"importedservice/entry.proto"}, []string{"SharedService.Audit"}, []string{"example"}, protoFiles)
+	require.NoError(t, err)
+	entry := result["example/importedservice/entry.proto"]
+	assert.Contains(t, entry, "service SharedService")
+	assert.Contains(t, entry, "rpc Audit (")
+	assert.NotContains(t, entry, "service EntryService")
+	assert.NotContains(t, result["example/importedservice/shared.proto"], "service SharedService")
+}
+
+// parseTrimmed 重新解析裁剪结果, 确保输出是合法的 proto 文件
+func parseTrimmed(t *testing.T, result map[string]string, importPaths []string, files ...string) []*desc.FileDescriptor {
+	t.Helper()
+	parser := protoparse.Parser{
+		Accessor:    protoparse.FileContentsFromMap(result),
+		ImportPaths: importPaths,
+	}
+	fds, err := parser.ParseFiles(files...)
+	require.NoError(t, err, "裁剪结果无法重新解析")
+	return fds
+}
+
+func Test_TrimMulti_Proto2Group(t *testing.T) {
+	protoFiles := loadProtoFiles(t, "example", "proto2/search.proto")
+
+	for _, method := range []string{"SearchService.Search", "SearchService.Digest"} {
+		t.Run(method, func(t *testing.T) {
+			result, err := TrimMulti([]string{"proto2/search.proto"}, []string{method}, []string{"example"}, protoFiles)
+			require.NoError(t, err)
+
+			content := result["example/proto2/search.proto"]
+			assert.Contains(t, content, `syntax = "proto2";`)
+			assert.Contains(t, content, "repeated group Result = 1 {")
+			assert.Contains(t, content, "message Snippet")
+			assert.NotContains(t, content, "message UnusedMessage")
+
+			fds := parseTrimmed(t, result, []string{"example"}, "proto2/search.proto")
+			group := fds[0].FindMessage("proto2.search.SearchResponse.Result")
+			require.NotNil(t, group, "group 生成的嵌套消息应该被保留")
+			assert.NotNil(t, group.FindFieldByName("snippet"))
+		})
+	}
+}
+
+func Test_TrimMulti_Editions(t *testing.T) {
+	protoFiles := loadProtoFiles(t, "example", "editions/catalog.proto")
+	result, err := TrimMulti([]string{"editions/catalog.proto"}, []string{"CatalogService.GetItem"}, []string{"example"}, protoFiles)
+	require.NoError(t, err)
+
+	content := result["example/editions/catalog.proto"]
+	assert.Contains(t, content, `edition = "2023";`)
+	assert.NotContains(t, content, "syntax =")
+	assert.NotContains(t, content, "optional ", "editions 文件不应被改写为 proto2 的 optional 字段")
+	assert.Contains(t, content, "option features = { field_presence: IMPLICIT };")
+	assert.Contains(t, content, "[features = { field_presence: EXPLICIT }]")
+	assert.Contains(t, content, "option features = { enum_type: CLOSED };")
+	assert.NotContains(t, content, "message UnusedMessage")
+
+	// 重新解析后字段存在性语义保持不变
+	fds := parseTrimmed(t, result, []string{"example"}, "editions/catalog.proto")
+	request := fds[0].FindMessage("editions.catalog.GetItemRequest").UnwrapMessage()
+	assert.False(t, request.Fields().ByName("id").HasPresence())
+	assert.True(t, request.Fields().ByName("revision").HasPresence())
+}
+
+// cancelingLogger cancels the trim once dependency collection has finished.
+type cancelingLogger struct {
+	cancel   context.CancelFunc
+	messages []string
+}
+
+func (l *cancelingLogger) Printf(format string, v ...any) {
+	l.messages = append(l.messages, fmt.Sprintf(format, v...))
+	if strings.HasPrefix(format, "Found %d files") {
+		l.cancel()
+	}
+}
+
+func TestTrimContext(t *testing.T) {
+	opts := Options{
+		EntryFiles:  []string{"project.proto"},
+		MethodNames: []string{"ProjectService.CreateProject"},
+		ImportPaths: []string{"example"},
+		ProtoContents: loadProtoFiles(t, "example",
+			"project.proto",
+			"common.proto",
+			"domain/user.proto",
+		),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	result, err := TrimContext(ctx, opts)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Nil(t, result)
+
+	// 依赖收集完成后取消, 不应再打印任何文件
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	logger := &cancelingLogger{cancel: cancel}
+	opts.Logger = logger
+	result, err = TrimContext(ctx, opts)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Nil(t, result)
+	assert.NotContains(t, logger.messages, "Done!")
+
+	result, err = TrimContext(context.Background(), Options{
+		EntryFiles:    opts.EntryFiles,
+		MethodNames:   opts.MethodNames,
+		ImportPaths:   opts.ImportPaths,
+		ProtoContents: opts.ProtoContents,
+	})
+	require.NoError(t, err)
+	assert.Contains(t, result["example/project.proto"], "rpc CreateProject")
+}
+
+func Test_TrimMultiToDescriptorSet_PreservesFieldAttributes(t *testing.T) {
+	protoFiles := map[string]string{
+		"fields/attrs.proto": `
+syntax = "proto3";
+package fields.v1;
+service AttrService {
+  rpc Get(Request) returns (Response);
+}
+message Request {
+  string user_id = 1 [json_name = "uid"];
+  repeated int32 scores = 2 [packed = false];
+  repeated int64 ids = 3 [packed = true, deprecated = true];
+  optional string nickname = 4;
+  string legacy = 5 [deprecated = true];
+}
+message Response {}`,
+	}
+	fileSet, err := TrimMultiToDescriptorSet([]string{"fields/attrs.proto"}, []string{"AttrService.Get"}, nil, protoFiles)
+	require.NoError(t, err)
+	require.Len(t, fileSet.GetFile(), 1)
+
+	parser := protoparse.Parser{Accessor: protoparse.FileContentsFromMap(protoFiles)}
+	fds, err := parser.ParseFiles("fields/attrs.proto")
+	require.NoError(t, err)
+	original := fds[0].FindMessage("fields.v1.Request").AsDescriptorProto()
+
+	var trimmed *descriptorpb.DescriptorProto
+	for _, msg := range fileSet.GetFile()[0].GetMessageType() {
+		if msg.GetName() == "Request" {
+			trimmed = msg
+		}
+	}
+	require.NotNil(t, trimmed)
+	require.Len(t, trimmed.GetField(), len(original.GetField()))
+	for i, field := range trimmed.GetField() {
+		want, err := proto.MarshalOptions{Deterministic: true}.Marshal(original.GetField()[i])
+		require.NoError(t, err)
+		got, err := proto.MarshalOptions{Deterministic: true}.Marshal(field)
+		require.NoError(t, err)
+		assert.Equal(t, want, got, "字段 %s 的属性在裁剪后发生了变化", field.GetName())
+	}
+	assert.Equal(t, "uid", trimmed.GetField()[0].GetJsonName())
+	assert.False(t, trimmed.GetField()[1].GetOptions().GetPacked())
+	assert.True(t, trimmed.GetField()[2].GetOptions().GetDeprecated())
+	assert.True(t, trimmed.GetField()[3].GetProto3Optional())
+	// proto3 optional 字段依赖的合成 oneof 也必须保留
+	require.Len(t, trimmed.GetOneofDecl(), 1)
+	assert.Equal(t, "_nickname", trimmed.GetOneofDecl()[0].GetName())
+
+	// 打印后的源码同样保留这些属性
+	result, err := TrimMulti([]string{"fields/attrs.proto"}, []string{"AttrService.Get"}, nil, protoFiles)
+	require.NoError(t, err)
+	content := result["fields/attrs.proto"]
+	assert.Contains(t, content, `json_name = "uid"`)
+	assert.Contains(t, content, "packed = false")
+	assert.Contains(t, content, "optional string nickname = 4;")
+	assert.Contains(t, content, "deprecated = true")
+}
+
+func Test_TrimMulti_StreamingMethods(t *testing.T) {
+	protoFiles := map[string]string{
+		"stream/watch.proto": `
+syntax = "proto3";
+package stream.v1;
+service WatchService {
+  rpc Get(WatchRequest) returns (Event);
+  rpc Watch(WatchRequest) returns (stream Event);
+  rpc Upload(stream Event) returns (WatchRequest);
+  rpc Chat(stream Event) returns (stream Event);
+}
+message WatchRequest { string topic = 1; }
+message Event { string payload = 1; }`,
+	}
+	methodNames := []string{"WatchService.Watch", "WatchService.Upload", "WatchService.Chat"}
+
+	fileSet, err := TrimMultiToDescriptorSet([]string{"stream/watch.proto"}, methodNames, nil, protoFiles)
+	require.NoError(t, err)
+	require.Len(t, fileSet.GetFile(), 1)
+	require.Len(t, fileSet.GetFile()[0].GetService(), 1)
+
+	streaming := make(map[string][2]bool)
+	for _, method := range fileSet.GetFile()[0].GetService()[0].GetMethod() {
+		streaming[method.GetName()] = [2]bool{method.GetClientStreaming(), method.GetServerStreaming()}
+	}
+	assert.Equal(t, map[string][2]bool{
+		"Watch":  {false, true},
+		"Upload": {true, false},
+		"Chat":   {true, true},
+	}, streaming)
+
+	result, err := TrimMulti([]string{"stream/watch.proto"}, methodNames, nil, protoFiles)
+	require.NoError(t, err)
+	content := result["stream/watch.proto"]
+	assert.Contains(t, content, "rpc Watch ( WatchRequest ) returns ( stream Event );")
+	assert.Contains(t, content, "rpc Upload ( stream Event ) returns ( WatchRequest );")
+	assert.Contains(t, content, "rpc Chat ( stream Event ) returns ( stream Event );")
+	assert.NotContains(t, content, "rpc Get ")
+}
+
+func Test_TrimMulti_MethodOptions(t *testing.T) {
+	protoFiles := map[string]string{
+		"google/api/http.proto": `
+syntax = "proto3";
+package google.api;
+message HttpRule {
+  string selector = 1;
+  oneof pattern {
+    string get = 2;
+    string post = 4;
+  }
+  string body = 7;
+}`,
+		"google/api/annotations.proto": `
+syntax = "proto3";
+package google.api;
+import "google/api/http.proto";
+import "google/protobuf/descriptor.proto";
+extend google.protobuf.MethodOptions { HttpRule http = 72295728; }`,
+		"api/v1/service.proto": `
+syntax = "proto3";
+package api.v1;
+import "google/api/annotations.proto";
+service UserService {
+  rpc GetUser(GetUserRequest) returns (User) {
+    option (google.api.http) = { get: "/v1/users/{id}" };
+  }
+}
+message GetUserRequest { string id = 1; }
+message User { string name = 1; }`,
+	}
+
+	result, err := TrimMulti([]string{"api/v1/service.proto"}, []string{"UserService.GetUser"}, nil, protoFiles)
+	require.NoError(t, err)
+
+	content := result["api/v1/service.proto"]
+	assert.Contains(t, content, `import "google/api/annotations.proto";`)
+	assert.Contains(t, content, `option (google.api.http) = { get: "/v1/users/{id}" };`)
+
+	require.Contains(t, result, "google/api/annotations.proto")
+	assert.Contains(t, result["google/api/annotations.proto"], "HttpRule http = 72295728;")
+	require.Contains(t, result, "google/api/http.proto")
+	assert.Contains(t, result["google/api/http.proto"], "message HttpRule")
+}
+
+func Test_TrimMulti_OptionValueTypes(t *testing.T) {
+	protoFiles := map[string]string{
+		"policy/policy.proto": `
+syntax = "proto3";
+package policy;
+import "google/protobuf/any.proto";
+import "google/protobuf/descriptor.proto";
+message Policy {
+  Rule rule = 1;
+  google.protobuf.Any detail = 2;
+}
+message Rule { Level level = 1; }
+enum Level { LEVEL_UNSPECIFIED = 0; LEVEL_HIGH = 1; }
+message Unused { string name = 1; }
+extend google.protobuf.MethodOptions { Policy policy = 50001; }
+extend google.protobuf.ServiceOptions { Level service_level = 50002; }`,
+		"policy/detail.proto": `
+syntax = "proto3";
+package policy;
+message Detail { string reason = 1; }
+message Unused2 { string name = 1; }`,
+		"api/service.proto": `
+syntax = "proto3";
+package api;
+import "policy/detail.proto";
+import "policy/policy.proto";
+service Service {
+  option (policy.service_level) = LEVEL_HIGH;
+  rpc Get(GetRequest) returns (GetResponse) {
+    option (policy.policy) = {
+      rule: { level: LEVEL_HIGH }
+      detail: { [type.googleapis.com/policy.Detail]: { reason: "audit" } }
+    };
+  }
+}
+message GetRequest {}
+message GetResponse {}`,
+	}
+
+	result, err := TrimMulti([]string{"api/service.proto"}, []string{"Service.Get"}, nil, protoFiles)
+	require.NoError(t, err)
+
+	// 选项值的消息类型及其依赖被保留
+	policy := result["policy/policy.proto"]
+	assert.Contains(t, policy, "message Policy")
+	assert.Contains(t, policy, "message Rule")
+	assert.Contains(t, policy, "enum Level")
+	assert.NotContains(t, policy, "message Unused")
+
+	// 仅通过 Any 的类型 URL 引用的消息也被保留，文件的 import 随之保留
+	require.Contains(t, result, "policy/detail.proto")
+	assert.Contains(t, result["policy/detail.proto"], "message Detail")
+	assert.NotContains(t, result["policy/detail.proto"], "message Unused2")
+	assert.Contains(t, result["api/service.proto"], `import "policy/detail.proto";`)
+	assert.Contains(t, result["api/service.proto"], "[type.googleapis.com/policy.Detail]")
+
+	// 裁剪结果可以重新解析
+	_, err = TrimMulti([]string{"api/service.proto"}, nil, nil, result)
+	require.NoError(t, err)
+}
+
+func Test_TrimMulti_Traversal(t *testing.T) {
+	protoFiles := loadProtoFiles(t, "example", "traversal/catalog.proto", "traversal/types.proto")
+
+	result, err := TrimMulti([]string{"traversal/catalog.proto"}, []string{"CatalogService.GetCatalog"}, []string{"example"}, protoFiles)
+	require.NoError(t, err)
+	require.Len(t, result, 2)
+
+	fds := parseTrimmed(t, result, []string{"example"}, "traversal/catalog.proto")
+	symbols := make(map[string]struct{})
+	var addMessage func(md *desc.MessageDescriptor)
+	addMessage = func(md *desc.MessageDescriptor) {
+		if md.IsMapEntry() {
+			return
+		}
+		symbols[md.GetFullyQualifiedName()] = struct{}{}
+		for _, nested := range md.GetNestedMessageTypes() {
+			addMessage(nested)
+		}
+		for _, enum := range md.GetNestedEnumTypes() {
+			symbols[enum.GetFullyQualifiedName()] = struct{}{}
+		}
+	}
+	for _, fd := range append(fds, fds[0].GetDependencies()...) {
+		for _, md := range fd.GetMessageTypes() {
+			addMessage(md)
+		}
+		for _, enum := range fd.GetEnumTypes() {
+			symbols[enum.GetFullyQualifiedName()] = struct{}{}
+		}
+	}
+
+	expected := map[string]struct{}{}
+	for _, name := range []string{
+		"traversal.catalog.GetCatalogRequest",
+		"traversal.catalog.Catalog",
+		"traversal.catalog.Section",
+		"traversal.catalog.Entry",
+		"traversal.catalog.Entry.Price",
+		"traversal.catalog.Entry.Tier",
+		"traversal.catalog.Text",
+		"traversal.catalog.Image",
+		"traversal.catalog.Caption",
+		"traversal.types.Attribute",
+		"traversal.types.Level",
+		"traversal.types.Level.Kind",
+		"traversal.types.Money",
+		"traversal.types.Unit",
+	} {
+		expected[name] = struct{}{}
+	}
+	assert.Equal(t, expected, symbols)
+	assert.NotContains(t, result["example/traversal/catalog.proto"], "rpc ListUnused")
+}
+
+func Test_TrimMulti_FileOptions(t *testing.T) {
+	protoFiles := map[string]string{
+		"acme/options.proto": `
+syntax = "proto3";
+package acme;
+import "google/protobuf/descriptor.proto";
+message Ownership {
+  string team = 1;
+  Tier tier = 2;
+}
+enum Tier { TIER_UNSPECIFIED = 0; TIER_CRITICAL = 1; }
+message Unused { string value = 1; }
+extend google.protobuf.FileOptions { Ownership owner = 50001; }`,
+		"api/v1/service.proto": `
+syntax = "proto3";
+package api.v1;
+import "acme/options.proto";
+option (acme.owner) = { team: "platform", tier: TIER_CRITICAL };
+option go_package = "example.com/api/v1";
+service Api { rpc Ping(PingRequest) returns (PingRequest); }
+message PingRequest { string id = 1; }`,
+	}
+
+	result, err := TrimMulti([]string{"api/v1/service.proto"}, []string{"Api.Ping"}, nil, protoFiles)
+	require.NoError(t, err)
+
+	content := result["api/v1/service.proto"]
+	assert.Contains(t, content, `import "acme/options.proto";`)
+	assert.Contains(t, content, "option (acme.owner) = {")
+	assert.Contains(t, content, `option go_package = "example.com/api/v1";`)
+
+	options := result["acme/options.proto"]
+	assert.Contains(t, options, "Ownership owner = 50001;")
+	assert.Contains(t, options, "message Ownership")
+	assert.Contains(t, options, "enum Tier")
+	assert.NotContains(t, options, "message Unused")
+
+	fds := parseTrimmed(t, result, nil, "api/v1/service.proto")
+	assert.NotNil(t, fds[0].FindSymbol("api.v1.Api.Ping"))
+}
+
+func Test_TrimMulti_StableOutput(t *testing.T) {
+	protoContents, err := LoadProtos([]string{"example/muit"})
+	require.NoError(t, err)
+	entryFiles := []string{"api/v1/commerce_service.proto"}
+	methodNames := []string{"CommerceService.GetOrder", "CommerceService.GetProduct", "CommerceService.GetUser"}
+
+	first, err := TrimMulti(entryFiles, methodNames, []string{"example/muit"}, protoContents)
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		again, err := TrimMulti(entryFiles, methodNames, []string{"example/muit"}, protoContents)
+		require.NoError(t, err)
+		assert.Equal(t, first, again, "同一输入的两次裁剪结果不一致")
+	}
+
+	// 方法按声明顺序输出, 与选择的顺序无关
+	reversed, err := TrimMulti(entryFiles, []string{"CommerceService.GetUser", "CommerceService.GetProduct", "CommerceService.GetOrder"}, []string{"example/muit"}, protoContents)
+	require.NoError(t, err)
+	assert.Equal(t, first, reversed)
+
+	fileSet, err := TrimMultiToDescriptorSet(entryFiles, []string{"CommerceService.GetOrder", "CommerceService.GetUser"}, []string{"example/muit"}, protoContents)
+	require.NoError(t, err)
+	var methods []string
+	for _, fd := range fileSet.GetFile() {
+		for _, svc := range fd.GetService() {
+			for _, method := range svc.GetMethod() {
+				methods = append(methods, method.GetName())
+			}
+		}
+	}
+	assert.Equal(t, []string{"GetUser", "GetOrder"}, methods)
+}
+
+func Test_TrimMulti_NestedExtensionTypes(t *testing.T) {
+	protoFiles := map[string]string{
+		"ext/base.proto": `
+syntax = "proto2";
+package ext;
+message Foo {
+  optional string id = 1;
+  extensions 100 to 200;
+}
+message Unused { optional string value = 1; }`,
+		"ext/holder.proto": `
+syntax = "proto2";
+package ext;
+import "ext/base.proto";
+message Holder {
+  optional string name = 1;
+  extend Foo { repeated Bar baz = 100; }
+}
+message Bar { optional Baz inner = 1; }
+message Baz { optional Kind kind = 1; }
+enum Kind { KIND_UNSPECIFIED = 0; }
+message Other { optional string value = 1; }
+service HolderService { rpc Get(Holder) returns (Holder); }`,
+	}
+
+	result, err := TrimMulti([]string{"ext/holder.proto"}, []string{"HolderService.Get"}, nil, protoFiles)
+	require.NoError(t, err)
+
+	content := result["ext/holder.proto"]
+	assert.Contains(t, content, "repeated Bar baz = 100;")
+	assert.Contains(t, content, "message Bar")
+	assert.Contains(t, content, "message Baz")
+	assert.Contains(t, content, "enum Kind")
+	assert.NotContains(t, content, "message Other")
+	assert.Contains(t, result["ext/base.proto"], "message Foo")
+	assert.NotContains(t, result["ext/base.proto"], "message Unused")
+
+	fds := parseTrimmed(t, result, nil, "ext/holder.proto")
+	ext := fds[0].FindSymbol("ext.Holder.baz")
+	require.NotNil(t, ext, "嵌套扩展应随 Holder 一起保留")
+}
+
+func TestTrimToDir(t *testing.T) {
+	outDir := t.TempDir()
+	opts := Options{
+		EntryFiles:  []string{"project.proto"},
+		MethodNames: []string{"ProjectService.CreateProject"},
+		ImportPaths: []string{"example"},
+		ProtoContents: loadProtoFiles(t, "example",
+			"project.proto",
+			"common.proto",
+			"domain/user.proto",
+		),
+	}
+	require.NoError(t, TrimToDir(opts, outDir))
+
+	// 文件按相对于 import 路径的位置写出, 内容与 TrimWithOptions 一致
+	result, err := TrimWithOptions(opts)
+	require.NoError(t, err)
+	for _, name := range []string{"project.proto", "common.proto", "domain/user.proto"} {
+		content, err := os.ReadFile(filepath.Join(outDir, filepath.FromSlash(name)))
+		require.NoError(t, err, name)
+		assert.Equal(t, result["example/"+name], string(content))
+	}
+
+	blocked := filepath.Join(t.TempDir(), "file")
+	require.NoError(t, os.WriteFile(blocked, nil, 0o644))
+	err = TrimToDir(opts, blocked)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to write trimmed file")
+}
+
+func Test_TrimMulti_BareMethodName(t *testing.T) {
+	protoFiles := map[string]string{
+		"bare/service.proto": `
+syntax = "proto3";
+package bare.v1;
+service UserService {
+  rpc Get(Request) returns (Response);
+  rpc GetUser(Request) returns (Response);
+  rpc ForgetThing(Request) returns (Response);
+}
+service OrderService {
+  rpc Get(Request) returns (Response);
+  rpc List(Request) returns (Response);
+}
+message Request {}
+message Response {}`,
+	}
+	opts := Options{
+		EntryFiles:    []string{"bare/service.proto"},
+		MethodNames:   []string{"Get"},
+		ProtoContents: protoFiles,
+	}
+
+	// 默认精确匹配: 保留所有服务中名为 Get 的方法
+	report, err := Analyze(opts)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"bare.v1.UserService.Get", "bare.v1.OrderService.Get"}, report.MatchedMethods)
+
+	// 子串匹配: 名称包含 Get 的方法都被保留
+	opts.SubstringMatch = true
+	report, err = Analyze(opts)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"bare.v1.UserService.Get",
+		"bare.v1.UserService.GetUser",
+		"bare.v1.OrderService.Get",
+	}, report.MatchedMethods)
+
+	opts.SubstringMatch = false
+	opts.MethodNames = []string{"get"}
+	_, err = Analyze(opts)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "method matching 'get' not found")
+}
+
+func Test_TrimMulti_MessageAndEnumOptions(t *testing.T) {
+	protoFiles := map[string]string{
+		"acme/annotations.proto": `
+syntax = "proto3";
+package acme;
+import "google/protobuf/descriptor.proto";
+message Table { string name = 1; }
+extend google.protobuf.MessageOptions { Table table = 50100; }
+extend google.protobuf.EnumOptions { string prefix = 50101; }
+extend google.protobuf.FieldOptions { bool secret = 50102; }`,
+		"api/v1/service.proto": `
+syntax = "proto3";
+package api.v1;
+import "acme/annotations.proto";
+service Api { rpc Get(Request) returns (Legacy); }
+message Request {
+  string id = 1;
+}
+message Legacy {
+  option deprecated = true;
+  option (acme.table) = { name: "legacy" };
+  State state = 1;
+}
+enum State {
+  option (acme.prefix) = "STATE_";
+  option allow_alias = true;
+  STATE_UNSPECIFIED = 0;
+  STATE_DEFAULT = 0;
+}`,
+	}
+
+	result, err := TrimMulti([]string{"api/v1/service.proto"}, []string{"Api.Get"}, nil, protoFiles)
+	require.NoError(t, err)
+
+	content := result["api/v1/service.proto"]
+	assert.Contains(t, content, `import "acme/annotations.proto";`)
+	assert.Contains(t, content, "option deprecated = true;")
+	assert.Contains(t, content, `option (acme.table) = { name: "legacy" };`)
+	assert.Contains(t, content, `option (acme.prefix) = "STATE_";`)
+	assert.Contains(t, content, "option allow_alias = true;")
+
+	annotations := result["acme/annotations.proto"]
+	assert.Contains(t, annotations, "Table table = 50100;")
+	assert.Contains(t, annotations, "string prefix = 50101;")
+	assert.Contains(t, annotations, "message Table")
+	assert.NotContains(t, annotations, "secret")
+
+	fds := parseTrimmed(t, result, nil, "api/v1/service.proto")
+	legacy := fds[0].FindMessage("api.v1.Legacy")
+	require.NotNil(t, legacy)
+	assert.True(t, legacy.GetMessageOptions().GetDeprecated())
+}
+
+func Test_TrimMulti_RecursiveMessages(t *testing.T) {
+	protoFiles := map[string]string{
+		"tree/tree.proto": `
+syntax = "proto3";
+package tree.v1;
+message Tree {
+  Tree left = 1;
+  Tree right = 2;
+  repeated Tree children = 3;
+}
+message A {
+  B b = 1;
+  string name = 2;
+}
+message B {
+  A a = 1;
+  repeated A siblings = 2;
+}
+message Request {
+  Tree tree = 1;
+  A a = 2;
+}
+service TreeService { rpc Walk(Request) returns (B); }`,
+	}
+
+	fileSet, err := TrimMultiToDescriptorSet([]string{"tree/tree.proto"}, []string{"TreeService.Walk"}, nil, protoFiles)
+	require.NoError(t, err)
+	require.Len(t, fileSet.GetFile(), 1)
+
+	fields := make(map[string][]string)
+	for _, msg := range fileSet.GetFile()[0].GetMessageType() {
+		for _, field := range msg.GetField() {
+			fields[msg.GetName()] = append(fields[msg.GetName()], field.GetName())
+		}
+	}
+	assert.Equal(t, []string{"left", "right", "children"}, fields["Tree"])
+	assert.Equal(t, []string{"b", "name"}, fields["A"])
+	assert.Equal(t, []string{"a", "siblings"}, fields["B"])
+
+	result, err := TrimMulti([]string{"tree/tree.proto"}, []string{"TreeService.Walk"}, nil, protoFiles)
+	require.NoError(t, err)
+	fds := parseTrimmed(t, result, nil, "tree/tree.proto")
+	children := fds[0].FindMessage("tree.v1.Tree").FindFieldByName("children")
+	require.NotNil(t, children)
+	assert.True(t, children.IsRepeated())
+	assert.Equal(t, "tree.v1.Tree", children.GetMessageType().GetFullyQualifiedName())
+}
+
+func Test_TrimMulti_FileHeaderComments(t *testing.T) {
+	protoFiles := map[string]string{
+		"licensed/service.proto": `// Copyright 2024 Example Corp.
+//
+// Licensed under the Apache License, Version 2.0.
+
+// Detached comment before the syntax declaration.
+
+// Service definitions for the licensed API.
+syntax = "proto3";
+
+// The licensed API package.
+package licensed.v1;
+
+// Generated Go code lives here.
+option go_package = "example.com/licensed/v1";
+
+service Api { rpc Get(Request) returns (Request); }
+message Request { string id = 1; }
+message Unused { string id = 1; }`,
+	}
+
+	result, err := TrimMulti([]string{"licensed/service.proto"}, []string{"Api.Get"}, nil, protoFiles)
+	require.NoError(t, err)
+
+	content := result["licensed/service.proto"]
+	assert.True(t, strings.HasPrefix(content, "// Copyright 2024 Example Corp.\n"), content)
+	assert.Contains(t, content, "// Licensed under the Apache License, Version 2.0.")
+	assert.Contains(t, content, "// Detached comment before the syntax declaration.")
+	assert.Contains(t, content, "// Service definitions for the licensed API.\nsyntax = \"proto3\";")
+	assert.Contains(t, content, "// The licensed API package.\npackage licensed.v1;")
+	assert.Contains(t, content, "// Generated Go code lives here.\noption go_package")
+	assert.NotContains(t, content, "message Unused")
+}
+
+func Test_TrimMulti_ForwardReferences(t *testing.T) {
+	protoFiles := map[string]string{
+		"forward/service.proto": `
+syntax = "proto3";
+package forward.v1;
+
+service ForwardService {
+  rpc Create(CreateRequest) returns (CreateResponse);
+  rpc Delete(DeleteRequest) returns (CreateResponse);
+}
+
+message CreateResponse {
+  Item item = 1;
+  Item.State state = 2;
+}
+
+message CreateRequest {
+  string name = 1;
+  Item template = 2;
+}
+
+message Item {
+  enum State { STATE_UNSPECIFIED = 0; STATE_READY = 1; }
+  string id = 1;
+  Owner owner = 2;
+}
+
+message Owner { string id = 1; }
+message DeleteRequest { string id = 1; }`,
+	}
+
+	result, err := TrimMulti([]string{"forward/service.proto"}, []string{"ForwardService.Create"}, nil, protoFiles)
+	require.NoError(t, err)
+
+	content := result["forward/service.proto"]
+	assert.Contains(t, content, "rpc Create ( CreateRequest ) returns ( CreateResponse );")
+	assert.NotContains(t, content, "rpc Delete")
+	assert.NotContains(t, content, "message DeleteRequest")
+
+	fds := parseTrimmed(t, result, nil, "forward/service.proto")
+	for _, name := range []string{"CreateRequest", "CreateResponse", "Item", "Owner"} {
+		assert.NotNil(t, fds[0].FindMessage("forward.v1."+name), name)
+	}
+	assert.NotNil(t, fds[0].FindEnum("forward.v1.Item.State"))
+}
+
+func Test_TrimMulti_Oneofs(t *testing.T) {
+	protoFiles := map[string]string{
+		"events/events.proto": `
+syntax = "proto3";
+package events.v1;
+service EventService { rpc Publish(Event) returns (Ack); }
+message Event {
+  string id = 1;
+  // 事件内容
+  oneof payload {
+    Created created = 2;
+    string deleted_id = 3;
+  }
+  message Meta {
+    oneof source {
+      string user = 1;
+      string system = 2;
+    }
+  }
+  Meta meta = 4;
+  optional string trace = 5;
+}
+message Created { string name = 1; }
+message Ack {}`,
+	}
+
+	fileSet, err := TrimMultiToDescriptorSet([]string{"events/events.proto"}, []string{"EventService.Publish"}, nil, protoFiles)
+	require.NoError(t, err)
+	require.Len(t, fileSet.GetFile(), 1)
+	var event *descriptorpb.DescriptorProto
+	for _, msg := range fileSet.GetFile()[0].GetMessageType() {
+		if msg.GetName() == "Event" {
+			event = msg
+		}
+	}
+	require.NotNil(t, event)
+	// 真实 oneof 在前, proto3 optional 的合成 oneof 在后
+	require.Len(t, event.GetOneofDecl(), 2)
+	assert.Equal(t, "payload", event.GetOneofDecl()[0].GetName())
+	assert.Equal(t, "_trace", event.GetOneofDecl()[1].GetName())
+	oneofIndexes := make(map[string]int32)
+	for _, field := range event.GetField() {
+		if field.OneofIndex != nil {
+			oneofIndexes[field.GetName()] = field.GetOneofIndex()
+		}
+	}
+	assert.Equal(t, map[string]int32{"created": 0, "deleted_id": 0, "trace": 1}, oneofIndexes)
+
+	result, err := TrimMulti([]string{"events/events.proto"}, []string{"EventService.Publish"}, nil, protoFiles)
+	require.NoError(t, err)
+	content := result["events/events.proto"]
+	assert.Contains(t, content, "// 事件内容\n  oneof payload {\n    Created created = 2;\n\n    string deleted_id = 3;\n  }")
+	assert.Contains(t, content, "oneof source {")
+	assert.Contains(t, content, "optional string trace = 5;")
+
+	fds := parseTrimmed(t, result, nil, "events/events.proto")
+	payload := fds[0].FindMessage("events.v1.Event").GetOneOfs()[0]
+	require.Len(t, payload.GetChoices(), 2)
+	assert.Equal(t, "created", payload.GetChoices()[0].GetName())
+	assert.Equal(t, "deleted_id", payload.GetChoices()[1].GetName())
+	assert.Len(t, fds[0].FindMessage("events.v1.Event.Meta").GetOneOfs()[0].GetChoices(), 2)
+}
+
+func Test_TrimMulti_MethodDeclarationOrder(t *testing.T) {
+	protoFiles := map[string]string{
+		"order/service.proto": `
+syntax = "proto3";
+package order.v1;
+service First {
+  // 第一个
+  rpc A(Msg) returns (Msg);
+  // 第二个
+  rpc B(Msg) returns (Msg);
+  // 第三个
+  rpc C(Msg) returns (Msg);
+  rpc D(Msg) returns (Msg);
+}
+service Second {
+  // 另一个服务
+  rpc E(Msg) returns (Msg);
+}
+message Msg {}`,
+	}
+
+	// 以与声明相反的顺序请求, 并交错两个服务的方法
+	result, err := TrimMulti([]string{"order/service.proto"}, []string{"Second.E", "First.C", "First.A"}, nil, protoFiles)
+	require.NoError(t, err)
+	content := result["order/service.proto"]
+	assert.Contains(t, content, "service First {\n  // 第一个\n  rpc A ( Msg ) returns ( Msg );\n\n  // 第三个\n  rpc C ( Msg ) returns ( Msg );\n}")
+	assert.Contains(t, content, "service Second {\n  // 另一个服务\n  rpc E ( Msg ) returns ( Msg );\n}")
+	assert.Less(t, strings.Index(content, "service First"), strings.Index(content, "service Second"))
+	assert.NotContains(t, content, "第二个")
+}
+
+func TestTrimEach(t *testing.T) {
+	protoContents, err := LoadProtos([]string{"example/muit"})
+	require.NoError(t, err)
+	opts := Options{
+		EntryFiles:    []string{"api/v1/commerce_service.proto"},
+		MethodNames:   []string{"CommerceService.GetOrder"},
+		ImportPaths:   []string{"example/muit"},
+		ProtoContents: protoContents,
+	}
+	expected, err := TrimWithOptions(opts)
+	require.NoError(t, err)
+
+	// 逐个读取的内容与一次性返回的结果一致, 且按路径顺序回调
+	streamed := make(map[string]string)
+	var paths []string
+	err = TrimEach(opts, func(path string, r io.Reader) error {
+		content, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		streamed[path] = string(content)
+		paths = append(paths, path)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, expected, streamed)
+	assert.True(t, sort.StringsAreSorted(paths), paths)
+
+	// 回调可以不读完内容; 其返回的错误会中止裁剪
+	stop := errors.New("stop")
+	calls := 0
+	err = TrimEach(opts, func(path string, r io.Reader) error {
+		calls++
+		if calls == 2 {
+			return stop
+		}
+		_, err := r.Read(make([]byte, 1))
+		return err
+	})
+	assert.ErrorIs(t, err, stop)
+	assert.Equal(t, 2, calls)
+}
+
+func Test_TrimMulti_StandardFileOptions(t *testing.T) {
+	protoFiles := map[string]string{
+		"std/service.proto": `
+syntax = "proto2";
+package std.v1;
+option go_package = "example.com/std/v1;stdv1";
+option java_package = "com.example.std.v1";
+option java_outer_classname = "ServiceProto";
+option java_multiple_files = true;
+option optimize_for = LITE_RUNTIME;
+option csharp_namespace = "Example.Std.V1";
+option objc_class_prefix = "STD";
+option cc_enable_arenas = true;
+option deprecated = true;
+service Api { rpc Ping(PingRequest) returns (PingRequest); }
+message PingRequest { optional string id = 1; }
+message Unused { optional string id = 1; }`,
+	}
+	parser := protoparse.Parser{Accessor: protoparse.FileContentsFromMap(protoFiles)}
+	fds, err := parser.ParseFiles("std/service.proto")
+	require.NoError(t, err)
+	want, err := proto.MarshalOptions{Deterministic: true}.Marshal(fds[0].GetFileOptions())
+	require.NoError(t, err)
+
+	// 标准文件选项在描述符层面原样保留
+	fileSet, err := TrimMultiToDescriptorSet([]string{"std/service.proto"}, []string{"Api.Ping"}, nil, protoFiles)
+	require.NoError(t, err)
+	require.Len(t, fileSet.GetFile(), 1)
+	got, err := proto.MarshalOptions{Deterministic: true}.Marshal(fileSet.GetFile()[0].GetOptions())
+	require.NoError(t, err)
+	assert.Equal(t, want, got)
+
+	// 打印的源码中同样保留
+	result, err := TrimMulti([]string{"std/service.proto"}, []string{"Api.Ping"}, nil, protoFiles)
+	require.NoError(t, err)
+	trimmed := parseTrimmed(t, result, nil, "std/service.proto")
+	options := trimmed[0].GetFileOptions()
+	assert.Equal(t, "example.com/std/v1;stdv1", options.GetGoPackage())
+	assert.Equal(t, "com.example.std.v1", options.GetJavaPackage())
+	assert.Equal(t, "ServiceProto", options.GetJavaOuterClassname())
+	assert.True(t, options.GetJavaMultipleFiles())
+	assert.Equal(t, descriptorpb.FileOptions_LITE_RUNTIME, options.GetOptimizeFor())
+	assert.Equal(t, "Example.Std.V1", options.GetCsharpNamespace())
+	assert.Equal(t, "STD", options.GetObjcClassPrefix())
+	assert.True(t, options.GetCcEnableArenas())
+	assert.True(t, options.GetDeprecated())
+}
+
+func Test_TrimMulti_NestedFieldComments(t *testing.T) {
+	protoFiles := map[string]string{
+		"nested/service.proto": `
+syntax = "proto3";
+package nested.v1;
+service Api { rpc Get(Request) returns (Request); }
+message Unused { string id = 1; }
+message Request {
+  // 外层字段
+  Outer outer = 1;
+  message Outer {
+    // 嵌套字段
+    string name = 1;
+    Inner inner = 2;
+    message Inner {
+      // 深层嵌套字段
+      int32 depth = 1; // 行尾注释
+    }
+    // 嵌套枚举
+    enum Kind {
+      // 枚举值
+      KIND_UNSPECIFIED = 0;
+    }
+    Kind kind = 3;
+  }
+}`,
+	}
+
+	result, err := TrimMulti([]string{"nested/service.proto"}, []string{"Api.Get"}, nil, protoFiles)
+	require.NoError(t, err)
+	content := result["nested/service.proto"]
+	assert.NotContains(t, content, "message Unused")
+	assert.Contains(t, content, "  // 外层字段\n  Outer outer = 1;")
+	assert.Contains(t, content, "    // 嵌套字段\n    string name = 1;")
+	assert.Contains(t, content, "      // 深层嵌套字段\n      int32 depth = 1; // 行尾注释")
+	assert.Contains(t, content, "    // 嵌套枚举\n    enum Kind {\n      // 枚举值\n      KIND_UNSPECIFIED = 0;")
+
+	// 移除嵌套消息中的字段后, 其后字段的注释仍按新的下标对应
+	result, err = TrimWithOptions(Options{
+		EntryFiles:          []string{"nested/service.proto"},
+		MethodNames:         []string{"Api.Get"},
+		ProtoContents:       protoFiles,
+		ExcludeTypes:        []string{"nested.v1.Request.Outer.Inner"},
+		StripExcludedFields: true,
+	})
+	require.NoError(t, err)
+	content = result["nested/service.proto"]
+	assert.NotContains(t, content, "Inner")
+	assert.NotContains(t, content, "深层嵌套字段")
+	assert.Contains(t, content, "    // 嵌套字段\n    string name = 1;")
+	assert.Contains(t, content, "    // 嵌套枚举\n    enum Kind {")
+}
+
+func Test_TrimMulti_Proto2LabelsAndDefaults(t *testing.T) {
+	protoFiles := map[string]string{
+		"legacy/service.proto": `
+syntax = "proto2";
+package legacy.v1;
+service Api { rpc Put(Record) returns (Record); }
+enum Color { RED = 1; GREEN = 2; }
+message Record {
+  required string id = 1;
+  optional int32 count = 2 [default = 42];
+  optional string label = 3 [default = "none"];
+  optional Color color = 4 [default = GREEN];
+  optional bool enabled = 5 [default = true];
+  optional double ratio = 6 [default = -1.5];
+  optional bytes raw = 7 [default = "\x01\x02"];
+  repeated Record children = 8;
+  required group Header = 9 { required int64 ts = 10; }
+}`,
+	}
+	parser := protoparse.Parser{Accessor: protoparse.FileContentsFromMap(protoFiles)}
+	fds, err := parser.ParseFiles("legacy/service.proto")
+	require.NoError(t, err)
+	original := fds[0].FindMessage("legacy.v1.Record").AsDescriptorProto()
+
+	fileSet, err := TrimMultiToDescriptorSet([]string{"legacy/service.proto"}, []string{"Api.Put"}, nil, protoFiles)
+	require.NoError(t, err)
+	require.Len(t, fileSet.GetFile(), 1)
+	var record *descriptorpb.DescriptorProto
+	for _, msg := range fileSet.GetFile()[0].GetMessageType() {
+		if msg.GetName() == "Record" {
+			record = msg
+		}
+	}
+	require.NotNil(t, record)
+	// 标签与默认值在描述符集合中原样保留
+	want, err := proto.MarshalOptions{Deterministic: true}.Marshal(original)
+	require.NoError(t, err)
+	got, err := proto.MarshalOptions{Deterministic: true}.Marshal(record)
+	require.NoError(t, err)
+	assert.Equal(t, want, got)
+
+	// 打印后重新解析, 标签与默认值依然一致
+	result, err := TrimMulti([]string{"legacy/service.proto"}, []string{"Api.Put"}, nil, protoFiles)
+	require.NoError(t, err)
+	content := result["legacy/service.proto"]
+	assert.Contains(t, content, "required string id = 1;")
+	assert.Contains(t, content, "default = 42")
+	trimmed := parseTrimmed(t, result, nil, "legacy/service.proto")[0].FindMessage("legacy.v1.Record")
+	require.NotNil(t, trimmed)
+	for _, field := range original.GetField() {
+		reparsed := trimmed.FindFieldByName(field.GetName())
+		require.NotNil(t, reparsed, field.GetName())
+		assert.Equal(t, field.GetLabel(), reparsed.GetLabel(), field.GetName())
+		assert.Equal(t, field.GetDefaultValue(), reparsed.AsFieldDescriptorProto().GetDefaultValue(), field.GetName())
+	}
+	assert.True(t, trimmed.FindFieldByName("id").IsRequired())
+	assert.Equal(t, int32(42), trimmed.FindFieldByName("count").GetDefaultValue())
+	assert.Equal(t, int32(2), trimmed.FindFieldByName("color").GetDefaultValue())
+}
+
+func Test_TrimMulti_TransitiveOptionFiles(t *testing.T) {
+	// 注解文件只被 types.proto 导入, 且只用在嵌套消息的字段、oneof 与枚举值上
+	protoFiles := map[string]string{
+		"acme/annotations.proto": `
+syntax = "proto3";
+package acme;
+import "google/protobuf/descriptor.proto";
+message Rule { string pattern = 1; }
+extend google.protobuf.FieldOptions { Rule rule = 50200; }
+extend google.protobuf.OneofOptions { bool required = 50201; }
+extend google.protobuf.EnumValueOptions { string label = 50202; }
+extend google.protobuf.MessageOptions { bool unused = 50203; }`,
+		"api/v1/types.proto": `
+syntax = "proto3";
+package api.v1;
+import "acme/annotations.proto";
+message Outer {
+  message Inner {
+    string email = 1 [(acme.rule) = { pattern: ".+@.+" }];
+    oneof contact {
+      option (acme.required) = true;
+      string phone = 2;
+      string fax = 3;
+    }
+    enum Kind {
+      KIND_UNSPECIFIED = 0;
+      KIND_HOME = 1 [(acme.label) = "home"];
+    }
+    Kind kind = 4;
+  }
+  Inner inner = 1;
+}`,
+		"api/v1/service.proto": `
+syntax = "proto3";
+package api.v1;
+import "api/v1/types.proto";
+service Api { rpc Get(Outer) returns (Outer); }`,
+	}
+
+	result, err := TrimMulti([]string{"api/v1/service.proto"}, []string{"Api.Get"}, nil, protoFiles)
+	require.NoError(t, err)
+	require.Contains(t, result, "acme/annotations.proto")
+	assert.Contains(t, result["api/v1/types.proto"], `import "acme/annotations.proto";`)
+
+	annotations := result["acme/annotations.proto"]
+	assert.Contains(t, annotations, "Rule rule = 50200;")
+	assert.Contains(t, annotations, "message Rule")
+	assert.Contains(t, annotations, "bool required = 50201;")
+	assert.Contains(t, annotations, "string label = 50202;")
+	assert.NotContains(t, annotations, "unused")
+
+	fds := parseTrimmed(t, result, nil, "api/v1/service.proto")
+	inner := fds[0].GetDependencies()[0].FindMessage("api.v1.Outer.Inner")
+	require.NotNil(t, inner)
+	assert.Len(t, inner.GetFields(), 4)
+}
+
+func Test_TrimMulti_EnumReserved(t *testing.T) {
+	protoFiles := map[string]string{
+		"api/service.proto": `
+syntax = "proto3";
+package api.v1;
+service Api { rpc Get(Req) returns (Req); }
+message Req {
+  E e = 1;
+  Nested nested = 2;
+  message Nested {
+    enum Inner {
+      INNER_UNSPECIFIED = 0;
+      reserved 3;
+      reserved "GONE";
+    }
+    Inner inner = 1;
+  }
+}
+enum E {
+  E_UNSPECIFIED = 0;
+  E_ONE = 1;
+  reserved 2, 4 to 6;
+  reserved "OLD";
+}`,
+	}
+
+	result, err := TrimMulti([]string{"api/service.proto"}, []string{"Api.Get"}, nil, protoFiles)
+	require.NoError(t, err)
+	content := result["api/service.proto"]
+	assert.Contains(t, content, "reserved 2, 4 to 6;")
+	assert.Contains(t, content, `reserved "OLD";`)
+	assert.Contains(t, content, "reserved 3;")
+	assert.Contains(t, content, `reserved "GONE";`)
+
+	// 保留的编号和名称在输出中依然生效
+	fds := parseTrimmed(t, result, nil, "api/service.proto")
+	enum := fds[0].FindEnum("api.v1.E")
+	require.NotNil(t, enum)
+	ranges := enum.AsEnumDescriptorProto().GetReservedRange()
+	require.Len(t, ranges, 2)
+	assert.Equal(t, int32(2), ranges[0].GetStart())
+	assert.Equal(t, int32(4), ranges[1].GetStart())
+	assert.Equal(t, int32(6), ranges[1].GetEnd())
+	assert.Equal(t, []string{"OLD"}, enum.AsEnumDescriptorProto().GetReservedName())
+}
+
+func Test_TrimMulti_WellKnownTypes(t *testing.T) {
+	protoFiles := map[string]string{
+		"api.proto": `
+syntax = "proto3";
+package api.v1;
+import "google/protobuf/timestamp.proto";
+import "google/protobuf/struct.proto";
+service Api { rpc Get(Req) returns (Req); }
+message Req {
+  google.protobuf.Timestamp at = 1;
+  google.protobuf.ListValue values = 2;
+}`,
+	}
+
+	// 未提供源码的标准文件由编译器自带, 只保留 import, 不输出
+	result, err := TrimMulti([]string{"api.proto"}, nil, nil, protoFiles)
+	require.NoError(t, err)
+	require.Len(t, result, 1)
+	assert.Contains(t, result["api.proto"], `import "google/protobuf/timestamp.proto";`)
+	assert.Contains(t, result["api.proto"], `import "google/protobuf/struct.proto";`)
+
+	var streamed []string
+	require.NoError(t, TrimEach(Options{EntryFiles: []string{"api.proto"}, ProtoContents: protoFiles}, func(path string, r io.Reader) error {
+		streamed = append(streamed, path)
+		return nil
+	}))
+	assert.Equal(t, []string{"api.proto"}, streamed)
+
+	// 描述符集仍然包含它们, 以保持自洽
+	fileSet, err := TrimMultiToDescriptorSet([]string{"api.proto"}, nil, nil, protoFiles)
+	require.NoError(t, err)
+	assert.Len(t, fileSet.GetFile(), 3)
+
+	// 随源码一起提供 (vendored) 的标准文件像普通文件一样被裁剪
+	protoFiles["google/protobuf/struct.proto"] = `
+syntax = "proto3";
+package google.protobuf;
+message Struct { map<string, Value> fields = 1; }
+message Value {
+  oneof kind {
+    NullValue null_value = 1;
+    string string_value = 3;
+    Struct struct_value = 5;
+    ListValue list_value = 6;
+  }
+}
+enum NullValue { NULL_VALUE = 0; }
+message ListValue { repeated Value values = 1; }
+message Vendored { string note = 1; }`
+	result, err = TrimMulti([]string{"api.proto"}, nil, nil, protoFiles)
+	require.NoError(t, err)
+	require.Len(t, result, 2)
+	vendored := result["google/protobuf/struct.proto"]
+	assert.Contains(t, vendored, "message ListValue")
+	assert.Contains(t, vendored, "message Struct")
+	assert.NotContains(t, vendored, "message Vendored")
+	assert.NotContains(t, result, "google/protobuf/timestamp.proto")
+}
+
+func Test_TrimMulti_OneMethodFromEachService(t *testing.T) {
+	protoFiles := map[string]string{
+		"api/services.proto": `
+syntax = "proto3";
+package api.v1;
+// 服务 A
+service ServiceA {
+  rpc M1(Msg) returns (Msg);
+  rpc Other(Msg) returns (Msg);
+}
+// 服务 B
+service ServiceB {
+  rpc Other(Msg) returns (Msg);
+  // 方法 M2
+  rpc M2(Msg) returns (Msg);
+}
+service ServiceC { rpc M3(Msg) returns (Msg); }
+message Msg {}`,
+	}
+
+	result, err := TrimMulti([]string{"api/services.proto"}, []string{"ServiceA.M1", "ServiceB.M2"}, nil, protoFiles)
+	require.NoError(t, err)
+	content := result["api/services.proto"]
+	assert.Contains(t, content, "// 服务 A\nservice ServiceA {\n  rpc M1 ( Msg ) returns ( Msg );\n}")
+	assert.Contains(t, content, "// 服务 B\nservice ServiceB {\n  // 方法 M2\n  rpc M2 ( Msg ) returns ( Msg );\n}")
+	assert.NotContains(t, content, "ServiceC")
+	assert.NotContains(t, content, "Other")
+
+	fds := parseTrimmed(t, result, nil, "api/services.proto")
+	services := fds[0].GetServices()
+	require.Len(t, services, 2)
+	for i, want := range []string{"M1", "M2"} {
+		require.Len(t, services[i].GetMethods(), 1)
+		assert.Equal(t, want, services[i].GetMethods()[0].GetName())
+	}
+}
+
+func TestRequiredFiles(t *testing.T) {
+	protoFiles, err := LoadProtos([]string{"example/muit"})
+	require.NoError(t, err)
+	// 以相对于根目录的名字为键, 与 RequiredFiles 的约定一致
+	contents := make(map[string]string, len(protoFiles))
+	for path, content := range protoFiles {
+		contents[strings.TrimPrefix(filepath.ToSlash(path), "example/muit/")] = content
+	}
+	entryFiles := []string{"api/v1/commerce_service.proto"}
+
+	for _, methods := range [][]string{nil, {"CommerceService.GetUser"}, {"CommerceService.PlaceOrder"}} {
+		files, err := RequiredFiles(entryFiles, methods, contents)
+		require.NoError(t, err)
+
+		result, err := TrimMulti(entryFiles, methods, nil, contents)
+		require.NoError(t, err)
+		expected := make([]string, 0, len(result))
+		for path := range result {
+			expected = append(expected, path)
+		}
+		sort.Strings(expected)
+		assert.Equal(t, expected, files, "%v", methods)
+	}
+
+	files, err := RequiredFiles(entryFiles, []string{"CommerceService.GetUser"}, contents)
+	require.NoError(t, err)
+	assert.Contains(t, files, "api/v1/commerce_service.proto")
+
+	_, err = RequiredFiles(entryFiles, []string{"CommerceService.Missing"}, contents)
+	assert.Error(t, err)
+}
+
+func Test_TrimMulti_NestedEnumsInNestedMessages(t *testing.T) {
+	protoFiles := map[string]string{
+		"api/types.proto": `
+syntax = "proto3";
+package api.v1;
+message Holder {
+  message Deep {
+    enum Kind {
+      KIND_UNSPECIFIED = 0;
+      KIND_DEEP = 1;
+    }
+  }
+  string unused = 1;
+}
+message Unrelated {}`,
+		"api/service.proto": `
+syntax = "proto3";
+package api.v1;
+import "api/types.proto";
+service Api { rpc Get(Top) returns (Top); }
+message Top {
+  message Mid {
+    enum Level {
+      LEVEL_UNSPECIFIED = 0;
+      LEVEL_HIGH = 1;
+    }
+    Level level = 1;
+    Holder.Deep.Kind kind = 2;
+  }
+  Mid mid = 1;
+}`,
+	}
+
+	result, err := TrimMulti([]string{"api/service.proto"}, []string{"Api.Get"}, nil, protoFiles)
+	require.NoError(t, err)
+	assert.Contains(t, result["api/service.proto"], "enum Level {")
+	types := result["api/types.proto"]
+	assert.Contains(t, types, "message Holder {")
+	assert.Contains(t, types, "enum Kind {")
+	assert.NotContains(t, types, "Unrelated")
+
+	// 输出可以重新解析, 嵌套枚举字段的类型都能解析到
+	fds := parseTrimmed(t, result, nil, "api/service.proto")
+	mid := fds[0].FindMessage("api.v1.Top.Mid")
+	require.NotNil(t, mid)
+	assert.Equal(t, "api.v1.Top.Mid.Level", mid.FindFieldByName("level").GetEnumType().GetFullyQualifiedName())
+	assert.Equal(t, "api.v1.Holder.Deep.Kind", mid.FindFieldByName("kind").GetEnumType().GetFullyQualifiedName())
+}
+
+func Test_TrimMulti_ExtensionRanges(t *testing.T) {
+	protoFiles := map[string]string{
+		"api/service.proto": `
+syntax = "proto2";
+package api.v1;
+import "google/protobuf/descriptor.proto";
+extend google.protobuf.ExtensionRangeOptions { optional string owner = 50300; }
+service Api { rpc Get(Req) returns (Req); }
+message Req {
+  optional string id = 1;
+  extensions 100 to 199;
+  extensions 500, 1000 to max [(owner) = "platform"];
+}
+message Unused { extensions 10 to 20; }`,
+	}
+
+	result, err := TrimMulti([]string{"api/service.proto"}, []string{"Api.Get"}, nil, protoFiles)
+	require.NoError(t, err)
+	content := result["api/service.proto"]
+	assert.Contains(t, content, "extensions 100 to 199;")
+	assert.Contains(t, content, `(owner) = "platform"`)
+	assert.NotContains(t, content, "Unused")
+
+	// 扩展范围及其选项在重新解析后依然有效
+	fds := parseTrimmed(t, result, nil, "api/service.proto")
+	req := fds[0].FindMessage("api.v1.Req")
+	require.NotNil(t, req)
+	ranges := req.AsDescriptorProto().GetExtensionRange()
+	require.Len(t, ranges, 3)
+	assert.Equal(t, int32(100), ranges[0].GetStart())
+	assert.Equal(t, int32(200), ranges[0].GetEnd())
+	assert.Equal(t, int32(500), ranges[1].GetStart())
+	assert.Equal(t, int32(1000), ranges[2].GetStart())
+	assert.True(t, ranges[2].GetOptions().ProtoReflect().IsValid())
+	assert.True(t, req.IsExtension(150))
+	assert.False(t, req.IsExtension(300))
+}
+
+func Test_TrimMulti_Proto3Optional(t *testing.T) {
+	protoFiles := map[string]string{
+		"api/service.proto": `
+syntax = "proto3";
+package api.v1;
+service Api { rpc Get(Profile) returns (Profile); }
+message Profile {
+  optional string nickname = 1;
+  oneof contact {
+    string email = 2;
+    string phone = 3;
+  }
+  optional Detail detail = 4;
+  optional int32 age = 5;
+  string plain = 6;
+}
+message Detail { optional Deeper deeper = 1; }
+message Deeper { string note = 1; }`,
+	}
+
+	assertOptional := func(t *testing.T, result map[string]string, fields ...string) *desc.MessageDescriptor {
+		content := result["api/service.proto"]
+		for _, field := range fields {
+			assert.Contains(t, content, "optional "+field)
+		}
+		assert.Contains(t, content, "  string plain = 6;")
+		fds := parseTrimmed(t, result, nil, "api/service.proto")
+		profile := fds[0].FindMessage("api.v1.Profile")
+		require.NotNil(t, profile)
+		for _, name := range []string{"nickname", "age"} {
+			field := profile.FindFieldByName(name)
+			require.NotNil(t, field, name)
+			assert.True(t, field.IsProto3Optional(), name)
+			require.NotNil(t, field.GetOneOf(), name)
+			assert.True(t, field.GetOneOf().IsSynthetic(), name)
+		}
+		assert.False(t, profile.FindFieldByName("email").GetOneOf().IsSynthetic())
+		assert.False(t, profile.FindFieldByName("plain").IsProto3Optional())
+		return profile
+	}
+
+	result, err := TrimMulti([]string{"api/service.proto"}, []string{"Api.Get"}, nil, protoFiles)
+	require.NoError(t, err)
+	profile := assertOptional(t, result, "string nickname = 1;", "Detail detail = 4;", "int32 age = 5;")
+	assert.True(t, profile.FindFieldByName("detail").IsProto3Optional())
+
+	// 字段被剪掉时, 其合成 oneof 一并移除, 其余 optional 字段的 oneof 重新编号后仍然有效
+	result, err = TrimWithOptions(Options{
+		EntryFiles:          []string{"api/service.proto"},
+		MethodNames:         []string{"Api.Get"},
+		ProtoContents:       protoFiles,
+		ExcludeTypes:        []string{"api.v1.Detail"},
+		StripExcludedFields: true,
+	})
+	require.NoError(t, err)
+	assert.NotContains(t, result["api/service.proto"], "detail")
+	profile = assertOptional(t, result, "string nickname = 1;", "int32 age = 5;")
+	assert.Len(t, profile.GetOneOfs(), 3)
+}
+
+func Test_TrimMulti_SelfReferentialMethod(t *testing.T) {
+	protoFiles := map[string]string{
+		"types/message.proto": `
+syntax = "proto3";
+package types;
+message Message {
+  string text = 1;
+  repeated Message replies = 2;
+}
+message Unused { string value = 1; }`,
+		"api/echo.proto": `
+syntax = "proto3";
+package api;
+import "types/message.proto";
+service EchoService {
+  rpc Echo(types.Message) returns (types.Message);
+  rpc Stream(stream types.Message) returns (stream types.Message);
+}`,
+	}
+
+	result, err := TrimMulti([]string{"api/echo.proto"}, []string{"EchoService.Echo"}, nil, protoFiles)
+	require.NoError(t, err)
+	require.Len(t, result, 2)
+
+	// 请求与响应为同一消息时，其所在文件只被 import 一次
+	assert.Equal(t, 1, strings.Count(result["api/echo.proto"], `import "types/message.proto";`))
+	assert.Equal(t, 1, strings.Count(result["types/message.proto"], "message Message {"))
+	assert.NotContains(t, result["types/message.proto"], "message Unused")
+
+	fds := parseTrimmed(t, result, nil, "api/echo.proto")
+	require.Len(t, fds[0].GetDependencies(), 1)
+	assert.Equal(t, "types/message.proto", fds[0].GetDependencies()[0].GetName())
+	method := fds[0].FindService("api.EchoService").FindMethodByName("Echo")
+	require.NotNil(t, method)
+	assert.Equal(t, "types.Message", method.GetInputType().GetFullyQualifiedName())
+	assert.Equal(t, "types.Message", method.GetOutputType().GetFullyQualifiedName())
+
+	// 描述符中的 Dependency 同样没有重复项
+	fileSet, err := TrimToDescriptorSet(Options{
+		EntryFiles:    []string{"api/echo.proto"},
+		MethodNames:   []string{"EchoService.Echo"},
+		ProtoContents: protoFiles,
+	})
+	require.NoError(t, err)
+	for _, fp := range fileSet.GetFile() {
+		if fp.GetName() == "api/echo.proto" {
+			assert.Equal(t, []string{"types/message.proto"}, fp.GetDependency())
+		}
+	}
+}
+
+func Test_TrimMulti_VendoredWellKnownDependencies(t *testing.T) {
+	protoFiles := map[string]string{
+		"api.proto": `
+syntax = "proto3";
+package api.v1;
+import "google/protobuf/struct.proto";
+import "google/protobuf/type.proto";
+service Api { rpc Get(Req) returns (Req); }
+message Req {
+  google.protobuf.Struct attributes = 1;
+  google.protobuf.Type schema = 2;
+}`,
+		"google/protobuf/struct.proto": `
+syntax = "proto3";
+package google.protobuf;
+message Struct { map<string, Value> fields = 1; }
+message Value {
+  oneof kind {
+    NullValue null_value = 1;
+    string string_value = 3;
+    Struct struct_value = 5;
+    ListValue list_value = 6;
+  }
+}
+enum NullValue { NULL_VALUE = 0; }
+message ListValue { repeated Value values = 1; }`,
+		"google/protobuf/type.proto": `
+syntax = "proto3";
+package google.protobuf;
+import "google/protobuf/any.proto";
+import "google/protobuf/source_context.proto";
+message Type {
+  string name = 1;
+  repeated Option options = 4;
+  SourceContext source_context = 5;
+}
+message Option { string name = 1; Any value = 2; }
+message Enum { string name = 1; }`,
+		"google/protobuf/source_context.proto": `
+syntax = "proto3";
+package google.protobuf;
+message SourceContext { string file_name = 1; }`,
+		"google/protobuf/duration.proto": `
+syntax = "proto3";
+package google.protobuf;
+message Duration { int64 seconds = 1; int32 nanos = 2; }`,
+	}
+
+	result, err := TrimMulti([]string{"api.proto"}, nil, nil, protoFiles)
+	require.NoError(t, err)
+
+	// vendored 的 Struct 连同同文件中递归引用的类型一起保留
+	structs := result["google/protobuf/struct.proto"]
+	for _, name := range []string{"message Struct", "message Value", "message ListValue", "enum NullValue"} {
+		assert.Contains(t, structs, name)
+	}
+
+	// vendored 的标准文件所依赖的其他 vendored 标准文件同样被保留和裁剪
+	types := result["google/protobuf/type.proto"]
+	assert.Contains(t, types, "message Type")
+	assert.Contains(t, types, "message Option")
+	assert.NotContains(t, types, "message Enum")
+	assert.Contains(t, types, `import "google/protobuf/source_context.proto";`)
+	assert.Contains(t, result["google/protobuf/source_context.proto"], "message SourceContext")
+
+	// 未 vendored 的 any.proto 仍只保留 import, 未使用的 duration.proto 被移除
+	assert.Contains(t, types, `import "google/protobuf/any.proto";`)
+	assert.NotContains(t, result, "google/protobuf/any.proto")
+	assert.NotContains(t, result, "google/protobuf/duration.proto")
+	assert.Len(t, result, 4)
+
+	parseTrimmed(t, result, nil, "api.proto")
+}
+
+func Test_TrimMulti_DeclarationOrder(t *testing.T) {
+	protoFiles := map[string]string{
+		"api.proto": `
+syntax = "proto3";
+package api;
+service Api { rpc Get(A) returns (C); }
+// A 是请求
+message A { string a = 1; }
+// B 未被使用
+message B { string b = 1; }
+// C 是响应
+message C {
+  // value 是 C 的字段
+  string value = 1;
+}`,
+	}
+
+	result, err := TrimMulti([]string{"api.proto"}, []string{"Api.Get"}, nil, protoFiles)
+	require.NoError(t, err)
+	content := result["api.proto"]
+	assert.NotContains(t, content, "message B")
+	assert.NotContains(t, content, "B 未被使用")
+
+	// 删除 B 之后 A、C 仍按声明顺序输出, 注释跟随各自的消息
+	assert.Less(t, strings.Index(content, "message A"), strings.Index(content, "message C"))
+	assert.Contains(t, content, "// A 是请求\nmessage A {")
+	assert.Contains(t, content, "// C 是响应\nmessage C {")
+	assert.Contains(t, content, "  // value 是 C 的字段\n  string value = 1;")
+
+	// 按名称排序输出时注释同样不会错位
+	protoFiles["api.proto"] = `
+syntax = "proto3";
+package api;
+service Api { rpc Get(A) returns (C); }
+// C 是响应
+message C { string value = 1; }
+// B 未被使用
+message B { string b = 1; }
+// A 是请求
+message A { string a = 1; }`
+	result, err = TrimWithOptions(Options{
+		EntryFiles:    []string{"api.proto"},
+		MethodNames:   []string{"Api.Get"},
+		ProtoContents: protoFiles,
+		SortElements:  true,
+	})
+	require.NoError(t, err)
+	content = result["api.proto"]
+	assert.Less(t, strings.Index(content, "message A"), strings.Index(content, "message C"))
+	assert.Contains(t, content, "// A 是请求\nmessage A {")
+	assert.Contains(t, content, "// C 是响应\nmessage C {")
+	assert.NotContains(t, content, "B 未被使用")
+}